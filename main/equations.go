@@ -266,9 +266,13 @@ suitable for relative distance to nearby traffic
 */
 
 // distRect returns distance and bearing to target #2 (e.g. traffic) from target #1 (e.g. ownship)
-// Inputs are lat / lon of both points in decimal degrees
-// Outputs are distance in meters and bearing in degrees (0° = north, 90° = east)
-// Secondary outputs are north and east components of distance in meters (north, east positive)
+// Inputs are lat / lon of both points in decimal degrees (north, east positive). Longitude differences wrap
+// across the antimeridian.
+// Outputs are distance in meters and true bearing in degrees, 0 <= bearing < 360 (0° = north, 90° = east)
+// Secondary outputs are north and east components of distance in meters (north, east positive); these are what
+// the FLARM PFLAA RelativeNorth / RelativeEast fields carry.
+// For identical points the distance is zero and the (undefined) bearing is reported as 0.
+// Uses the mean earth radius and the cosine of the mean latitude: within ~0.5% of great circle out to ~100 km.
 
 func distRect(lat1, lon1, lat2, lon2 float64) (dist, bearing, distN, distE float64) {
 	radius_earth := 6371008.8 // meters; mean radius
@@ -278,6 +282,9 @@ func distRect(lat1, lon1, lat2, lon2 float64) (dist, bearing, distN, distE float
 	distN = dLat * radius_earth
 	distE = dLon * radius_earth * math.Abs(math.Cos(avgLat))
 	dist = math.Pow(distN*distN+distE*distE, 0.5)
+	if dist == 0 {
+		return 0, 0, 0, 0 // bearing undefined; avoid atan2(±0, ±0) giving 180° or -0°
+	}
 	bearing = math.Atan2(distE, distN)
 	bearing = degreesHdg(bearing)
 	return
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistRectCityPairs(t *testing.T) {
+	// Great-circle distances and initial bearings on the mean-radius sphere.
+	for _, tc := range []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		km, bearing            float64
+	}{
+		{"Munich-Augsburg", 48.1374, 11.5755, 48.3705, 10.8978, 56.47, 297.6},
+		{"Zurich-Basel", 47.3769, 8.5417, 47.5596, 7.5886, 74.47, 286.2},
+		{"Vienna-Bratislava", 48.2082, 16.3738, 48.1486, 17.1077, 54.82, 96.7},
+		{"Munich-Salzburg", 48.1374, 11.5755, 47.8095, 13.0550, 116.01, 107.8},
+		{"Hamburg-Luebeck", 53.5511, 9.9937, 53.8655, 10.6866, 57.46, 52.2},
+	} {
+		dist, bearing, distN, distE := distRect(tc.lat1, tc.lon1, tc.lat2, tc.lon2)
+		if math.Abs(dist/1000-tc.km)/tc.km > 0.005 {
+			t.Errorf("%s: %.2f km, want %.2f km", tc.name, dist/1000, tc.km)
+		}
+		if math.Abs(bearing-tc.bearing) > 1 {
+			t.Errorf("%s: bearing %.1f°, want %.1f°", tc.name, bearing, tc.bearing)
+		}
+		if math.Abs(math.Hypot(distN, distE)-dist) > 1e-6 {
+			t.Errorf("%s: north %.0f / east %.0f don't add up to %.0f m", tc.name, distN, distE, dist)
+		}
+	}
+}
+
+func TestDistRectSigns(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		bearing                float64
+		northSign, eastSign    float64
+	}{
+		{"north", 48.0, 11.0, 48.1, 11.0, 0, 1, 0},
+		{"east", 48.0, 11.0, 48.0, 11.1, 90, 0, 1},
+		{"south", 48.0, 11.0, 47.9, 11.0, 180, -1, 0},
+		{"west", 48.0, 11.0, 48.0, 10.9, 270, 0, -1},
+		{"southwest, southern hemisphere", -33.9, 151.2, -34.0, 151.1, 219.7, -1, -1},
+		{"east across the antimeridian", 0, 179.9, 0, -179.9, 90, 0, 1},
+	} {
+		dist, bearing, distN, distE := distRect(tc.lat1, tc.lon1, tc.lat2, tc.lon2)
+		if math.Abs(bearing-tc.bearing) > 0.5 {
+			t.Errorf("%s: bearing %.1f°, want %.1f°", tc.name, bearing, tc.bearing)
+		}
+		sign := func(x float64) float64 {
+			if math.Abs(x) < 1e-6*dist {
+				return 0
+			}
+			return math.Copysign(1, x)
+		}
+		if sign(distN) != tc.northSign || sign(distE) != tc.eastSign {
+			t.Errorf("%s: north %.0f m, east %.0f m", tc.name, distN, distE)
+		}
+		if dist > 30000 {
+			t.Errorf("%s: %.0f m, expected a short hop", tc.name, dist)
+		}
+	}
+
+	dist, bearing, distN, distE := distRect(48.0, 11.0, 48.0, 11.0)
+	if dist != 0 || bearing != 0 || distN != 0 || distE != 0 {
+		t.Errorf("identical points: %v %v %v %v, want all 0", dist, bearing, distN, distE)
+	}
+}
@@ -60,6 +60,20 @@ type AprsFlarmData struct {
 	Valid          bool
 }
 
+// flarmAddressIDType maps the OGN address type (0 random, 1 ICAO, 2 FLARM, 3 OGN) to the PFLAA IDType (0 random,
+// 1 ICAO, 2 FLARM, 3 anonymous in stealth mode).
+func flarmAddressIDType(addressType byte, stealth bool) uint8 {
+	switch {
+	case stealth:
+		return 3
+	case addressType == 0:
+		return 0
+	case addressType == 1:
+		return 1
+	}
+	return 2 // an ID the device chose
+}
+
 func decodeFLARMAircraftType(aircraftType byte) string {
 	switch aircraftType {
 	case 0:
@@ -385,6 +399,7 @@ func processAprsData(aprsData string) {
 		}
 
 		ti.Icao_addr = data.Address
+		ti.FlarmIDType = flarmAddressIDType(data.AddressType, data.StealthMode)
 		ti.Tail = strings.ToUpper(fmt.Sprintf("F%s%s", decodeFLARMAircraftType(data.AircraftType), strconv.FormatInt(int64(data.Address), 16)))
 		ti.Last_source = TRAFFIC_SOURCE_FLARM
 
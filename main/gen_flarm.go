@@ -12,15 +12,19 @@
 package main
 
 import (
-	//"bufio" 
+	"bufio"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
+	"sort"
 	"time"
 	"strings"
 	"strconv"
+	"sync"
 )
 
 /*
@@ -31,6 +35,13 @@ import (
 		This should also allow FLARM-formatted messages to be sent over serial output, if so configured in network.go.
 */
 
+// Output profiles for the FLARM NMEA stream, selected by globalSettings.FLARMOutputProfile.
+const (
+	FLARM_PROFILE_FLARM      = "FLARM"      // FLARM sentences with the "!CALLSIGN" PFLAA extension (default)
+	FLARM_PROFILE_PILOTAWARE = "PilotAware" // plain FLARM sentences as sent by PilotAware and SkyEcho units
+	FLARM_PROFILE_XCSOAR     = "XCSoar"     // FLARM sentences, with a no-fix GPGGA (not GPTXT) while there is no GPS fix
+)
+
 func InBetween(i, min, max int16) bool {
 	if (i >= min) && (i <= max) {
 		return true
@@ -39,20 +50,2238 @@ func InBetween(i, min, max int16) bool {
 	}
 }
 
-func sendNetFLARM(msg string) {
-	if globalSettings.NetworkFLARM {
-		sendMsg([]byte(msg), NETWORK_FLARM_NMEA, false) // UDP and future serial output. Traffic messages are always non-queuable -- hence 'false'.
+// flarmSink receives every FLARM NMEA sentence. Tests replace it to capture the output without a network.
+var flarmSink = sendFlarmNetwork
+
+func sendNetFLARM(msg string) {
+	if msg == "" {
+		return // refused by nmeaSentence()
+	}
+	recordFlarmSentence(msg)
+	spendFlarmBudget(len(msg))
+	flarmSink(msg)
+}
+
+/*
+	FLARM output health for the web UI (/getFLARMStatus). Zero values until the first sentence is sent or the first
+		client connects.
+*/
+
+type FLARMStatus struct {
+	LastSent        map[string]time.Time // stratuxClock time each sentence type (e.g. "PFLAA") was last sent
+	TCPClients      int                  // connected NMEA TCP clients
+	GDL90Clients    int                  // connected GDL90 bridge clients
+	TCPPorts        []int                // TCP ports being listened on
+	TCPDropped      uint64               // sentences dropped for TCP clients that weren't keeping up, since startup
+	TCPQueueDropped uint64               // sentences dropped because the TCP server wasn't taking any, since startup
+	UDPEnabled      bool                 // NetworkFLARM
+	TrafficDivisor  int                  // 1 = traffic every cycle; higher while throttled
+	GDL90Port       int                  // GDL90 bridge port being listened on, 0 = none
+	BudgetShed      uint64               // PFLAA left out to stay within FLARMMaxBytesPerSec, since startup
+}
+
+var flarmLastSentMutex sync.Mutex
+var flarmLastSent = make(map[string]time.Time)
+var flarmPFLAUCount uint64 // PFLAU sentences sent, for the idle PFLAU guarantee
+
+func recordFlarmSentence(msg string) {
+	talker := strings.TrimPrefix(msg, "$")
+	if i := strings.IndexAny(talker, ",*"); i >= 0 {
+		talker = talker[:i]
+	}
+	flarmLastSentMutex.Lock()
+	flarmLastSent[talker] = stratuxClock.Time
+	if talker == "PFLAU" {
+		flarmPFLAUCount++
+	}
+	flarmLastSentMutex.Unlock()
+	if globalSettings.FLARMConnectReplay {
+		cacheFlarmReplay(talker, msg)
+	}
+}
+
+/*
+	Replay on connect. With FLARMConnectReplay set, the last GPRMC and GPGGA sent and the last PFLAA of each target
+		are kept, and a client connecting to a regular port gets them right after the handshake, so its display fills
+		at once instead of after the next cycle. Only what was sent within flarmReplayMaxAge is replayed: a target
+		that has stopped being sent is gone. The GPS sentences come first, as XCSoar wants a fix before any traffic.
+*/
+
+const flarmReplayMaxAge = 3 * time.Second
+
+type flarmReplayEntry struct {
+	msg  string
+	sent time.Time
+}
+
+var flarmReplay = make(map[string]flarmReplayEntry) // "GPRMC", "GPGGA", or "PFLAA," + ID
+var flarmReplayMutex sync.Mutex
+
+func cacheFlarmReplay(talker, msg string) {
+	key := talker
+	switch talker {
+	case "GPRMC", "GPGGA":
+	case "PFLAA":
+		f := strings.SplitN(msg, ",", 8)
+		if len(f) < 8 {
+			return
+		}
+		key += "," + strings.SplitN(f[6], "!", 2)[0]
+	default:
+		return
+	}
+	flarmReplayMutex.Lock()
+	flarmReplay[key] = flarmReplayEntry{msg: msg, sent: stratuxClock.Time}
+	flarmReplayMutex.Unlock()
+}
+
+// pruneFlarmReplay drops whatever is too old to replay.
+func pruneFlarmReplay() {
+	flarmReplayMutex.Lock()
+	defer flarmReplayMutex.Unlock()
+	for key, e := range flarmReplay {
+		if stratuxClock.Since(e.sent) > flarmReplayMaxAge {
+			delete(flarmReplay, key)
+		}
+	}
+}
+
+// flarmReplaySentences returns the sentences to replay to a new client: GPS first unless gps is false, then the
+// PFLAA by ID.
+func flarmReplaySentences(gps bool) []string {
+	pruneFlarmReplay()
+	flarmReplayMutex.Lock()
+	defer flarmReplayMutex.Unlock()
+	var out, pflaa []string
+	if gps {
+		for _, key := range []string{"GPRMC", "GPGGA"} {
+			if e, ok := flarmReplay[key]; ok {
+				out = append(out, e.msg)
+			}
+		}
+	}
+	keys := make([]string, 0, len(flarmReplay))
+	for key := range flarmReplay {
+		if strings.HasPrefix(key, "PFLAA,") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pflaa = append(pflaa, flarmReplay[key].msg)
+	}
+	return append(out, pflaa...)
+}
+
+func flarmStatus() FLARMStatus {
+	status := FLARMStatus{
+		LastSent:       make(map[string]time.Time),
+		UDPEnabled:     globalSettings.NetworkFLARM,
+	}
+	flarmCycleMutex.Lock()
+	status.TrafficDivisor = flarmTrafficDivisorLast
+	flarmCycleMutex.Unlock()
+	flarmBudgetMutex.Lock()
+	status.BudgetShed = flarmBudgetShed
+	flarmBudgetMutex.Unlock()
+	flarmLastSentMutex.Lock()
+	for talker, t := range flarmLastSent {
+		status.LastSent[talker] = t
+	}
+	flarmLastSentMutex.Unlock()
+
+	tcpClientMutex.Lock()
+	status.TCPClients = tcpClientCount
+	status.GDL90Clients = tcpGDL90ClientCount
+	status.TCPPorts = append([]int(nil), tcpPorts...)
+	status.TCPDropped = tcpClientDroppedTotal
+	status.TCPQueueDropped = tcpQueueDropped
+	status.GDL90Port = tcpGDL90Port
+	tcpClientMutex.Unlock()
+	return status
+}
+
+func sendFlarmNetwork(msg string) {
+	if globalSettings.NetworkFLARM {
+		if m, ok := flarmOutputSentence(msg, globalSettings.FLARMUDPSentences, globalSettings.FLARMUDPLineEnd); ok {
+			sendFlarmUDP(m)
+		}
+	}
+	if globalSettings.FLARMSerialOutput {
+		if m, ok := flarmOutputSentence(msg, globalSettings.FLARMSerialSentences, globalSettings.FLARMSerialLineEnd); ok {
+			sendMsg([]byte(m), NETWORK_FLARM_SERIAL, false)
+		}
+	}
+	select {
+	case msgchan <- clientMessage{msg: msg}: // TCP output.
+	default:
+		tcpQueueFull()
+	}
+}
+
+/*
+	Per-output formats. UDP and, with FLARMSerialOutput set, the serial output (in place of GDL90) get the same cycle,
+		each through its own filter. FLARMUDPSentences / FLARMSerialSentences list the sentence types the output gets,
+		e.g. "GPRMC,GPGGA" for a panel display that only wants GPS; empty for all of them. FLARMUDPLineEnd /
+		FLARMSerialLineEnd "LF" ends lines with a bare line feed for devices that want one; anything else keeps the NMEA
+		CR/LF. TCP clients have their own formats (clientFormat).
+*/
+
+// flarmOutputSentence returns the sentence as an output configured with sentences and lineEnd gets it, or false if
+// the output doesn't take this sentence type.
+func flarmOutputSentence(msg, sentences, lineEnd string) (string, bool) {
+	if sentences != "" {
+		talker := strings.TrimPrefix(msg, "$")
+		if i := strings.IndexAny(talker, ",*"); i >= 0 {
+			talker = talker[:i]
+		}
+		if !isFlarmSentenceListed(sentences, talker) {
+			return "", false
+		}
+	}
+	if strings.EqualFold(lineEnd, "LF") {
+		msg = strings.TrimSuffix(msg, "\r\n") + "\n"
+	}
+	return msg, true
+}
+
+// isFlarmSentenceListed reports whether a comma separated list of sentence types names this one.
+func isFlarmSentenceListed(sentences, sentenceType string) bool {
+	for _, s := range strings.Split(sentences, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), sentenceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpQueueFull counts a message dropped because the TCP server isn't taking any (stuck or not started yet). Dropping
+// rather than waiting keeps traffic generation, and with it the UDP output, going.
+func tcpQueueFull() {
+	tcpClientMutex.Lock()
+	tcpQueueDropped++
+	dropped := tcpQueueDropped
+	tcpClientMutex.Unlock()
+	if dropped%1000 == 1 {
+		log.Printf("FLARM: TCP output queue full, %d sentences dropped so far\n", dropped)
+	}
+}
+
+/*
+	UDP batching. With FLARMUDPBatch set, the cycle's sentences are packed into as few UDP datagrams as they fit, each at
+		most flarmUDPBatchSize bytes so it isn't fragmented on a 1500-byte MTU, instead of one small datagram per
+		sentence. For receivers that parse a buffer of sentences; one expecting a sentence per datagram needs it off,
+		the default. sendFlarmTrafficUpdates() flushes the rest at the end of every cycle. A sentence sent outside a cycle
+		(a PFLAC reply, say) goes out at once. TCP is unaffected.
+*/
+
+const flarmUDPBatchSize = 1400 // bytes
+
+var flarmUDPPending []byte
+var flarmUDPInCycle bool // between startFlarmUDPBatch() and flushFlarmUDP()
+var flarmUDPMutex sync.Mutex
+
+func sendFlarmUDP(msg string) {
+	if !globalSettings.FLARMUDPBatch {
+		sendMsg([]byte(msg), NETWORK_FLARM_NMEA, false) // UDP and future serial output. Traffic messages are always non-queuable -- hence 'false'.
+		return
+	}
+	flarmUDPMutex.Lock()
+	defer flarmUDPMutex.Unlock()
+	if len(flarmUDPPending)+len(msg) > flarmUDPBatchSize {
+		flushFlarmUDPLocked()
+	}
+	flarmUDPPending = append(flarmUDPPending, msg...)
+	if !flarmUDPInCycle {
+		flushFlarmUDPLocked()
+	}
+}
+
+// startFlarmUDPBatch holds UDP sentences back for batching until the cycle's flushFlarmUDP().
+func startFlarmUDPBatch() {
+	flarmUDPMutex.Lock()
+	flarmUDPInCycle = true
+	flarmUDPMutex.Unlock()
+}
+
+// flushFlarmUDP sends the sentences batched so far, if any, and ends the cycle's batching.
+func flushFlarmUDP() {
+	flarmUDPMutex.Lock()
+	defer flarmUDPMutex.Unlock()
+	flarmUDPInCycle = false
+	flushFlarmUDPLocked()
+}
+
+func flushFlarmUDPLocked() {
+	if len(flarmUDPPending) == 0 {
+		return
+	}
+	sendMsg(flarmUDPPending, NETWORK_FLARM_NMEA, false)
+	flarmUDPPending = nil // the queued datagram keeps its buffer
+}
+
+/*
+	Output budget. With FLARMMaxBytesPerSec set, the NMEA stream is held to that many bytes per second by a token
+		bucket that fills at that rate and holds at most one second's worth. Every sentence sent takes its bytes from
+		the bucket, but only a PFLAA without an alarm is ever left out for lack of them (sendFlarmTraffic()): the GPS
+		sentences, the PFLAU and every alarming target go out regardless, and may run the bucket into debt. The PFLAA
+		list goes most relevant first, so it's the most distant traffic that is shed.
+*/
+
+var flarmBudget float64       // bytes available
+var flarmBudgetLast time.Time // stratuxClock time of the last refill
+var flarmBudgetShed uint64
+var flarmBudgetMutex sync.Mutex
+
+func refillFlarmBudgetLocked() {
+	rate := float64(globalSettings.FLARMMaxBytesPerSec)
+	if flarmBudgetLast.IsZero() {
+		flarmBudget = rate
+	} else {
+		flarmBudget += rate * stratuxClock.Since(flarmBudgetLast).Seconds()
+	}
+	if flarmBudget > rate {
+		flarmBudget = rate
+	}
+	flarmBudgetLast = stratuxClock.Time
+}
+
+// spendFlarmBudget takes n bytes from the bucket, even if that leaves it in debt.
+func spendFlarmBudget(n int) {
+	if globalSettings.FLARMMaxBytesPerSec <= 0 {
+		return
+	}
+	flarmBudgetMutex.Lock()
+	defer flarmBudgetMutex.Unlock()
+	refillFlarmBudgetLocked()
+	flarmBudget -= float64(n)
+}
+
+// hasFlarmBudget reports whether n more bytes fit, counting a sentence shed if they don't.
+func hasFlarmBudget(n int) bool {
+	if globalSettings.FLARMMaxBytesPerSec <= 0 {
+		return true
+	}
+	flarmBudgetMutex.Lock()
+	defer flarmBudgetMutex.Unlock()
+	refillFlarmBudgetLocked()
+	if flarmBudget < float64(n) {
+		flarmBudgetShed++
+		return false
+	}
+	return true
+}
+
+/*
+	GDL90 bridge. With FLARMGDL90Port set, TCP clients on that port get GDL90 instead of NMEA, built in the same cycle
+		from the same traffic: heartbeat and ownship, then a traffic report for each target sent as PFLAA. Filtering and
+		target selection are shared; bridge clients don't count towards the NMEA throttling. The traffic alert bit is
+		set from FLARM alarm level flarmGDL90AlertLevel on: level 1 covers all traffic within 12 km, far more than a
+		GDL90 app should alert on. Vertical speed is the PFLAA's, see flarmVerticalSpeed().
+*/
+
+// flarmFormatSink receives every message for the clients of one format only. Tests replace it like flarmSink.
+var flarmFormatSink = sendFlarmFormatNetwork
+
+func sendFlarmFormatNetwork(format clientFormat, msg string) {
+	select {
+	case msgchan <- clientMessage{format: format, msg: msg}: // same queue, so the order of the stream is kept
+	default:
+		tcpQueueFull()
+	}
+}
+
+func sendFlarmGDL90(msg []byte) {
+	if globalSettings.FLARMGDL90Port != 0 {
+		flarmFormatSink(clientFormatGDL90, string(msg))
+	}
+}
+
+const flarmGDL90AlertLevel = 2
+
+// makeFlarmGDL90Traffic builds the bridge's traffic report for a target, with the vertical speed the PFLAA shows.
+func makeFlarmGDL90Traffic(target flarmTarget) []byte {
+	ti := target.ti
+	if fpm, ok := flarmVerticalSpeed(ti); ok && !globalSettings.FLARMGDL90NoClimb {
+		ti.Vvel = fpm
+	} else {
+		ti.Vvel = VVEL_UNAVAILABLE
+	}
+	return makeTrafficReport(ti, target.alarmLevel >= flarmGDL90AlertLevel)
+}
+
+func sendFlarmGDL90Ownship() {
+	if globalSettings.FLARMGDL90Port == 0 {
+		return
+	}
+	sendFlarmGDL90(makeHeartbeat())
+	if msg, ok := makeOwnshipReportMsg(); ok {
+		sendFlarmGDL90(msg)
+	}
+	if msg, ok := makeOwnshipGeometricAltitudeMsg(); ok {
+		sendFlarmGDL90(msg)
+	}
+}
+
+/*
+	PFLAA variants. Clients on FLARMPlainPFLAAPort get every PFLAA with the plain 6-digit ID, those on
+		FLARMExtPFLAAPort with the "!CALLSIGN" extension, whatever FLARMOutputProfile says; everything else in their
+		stream is the regular one. Clients on the regular ports get the PFLAA as set by FLARMOutputProfile.
+*/
+
+func sendFlarmPFLAAVariants(msg string, ti TrafficInfo) {
+	if msg == "" {
+		return
+	}
+	if globalSettings.FLARMPlainPFLAAPort != 0 {
+		flarmFormatSink(clientFormatPFLAAPlain, flarmPFLAAVariant(msg, ti.Tail, false))
+	}
+	if globalSettings.FLARMExtPFLAAPort != 0 {
+		flarmFormatSink(clientFormatPFLAAExtended, flarmPFLAAVariant(msg, ti.Tail, true))
+	}
+}
+
+// flarmPFLAAVariant rewrites the ID field of a PFLAA to the plain or the extended form. The fields after the ID are
+// numbers, so its end is found counting back from the end of the sentence.
+func flarmPFLAAVariant(msg, tail string, extended bool) string {
+	end := strings.LastIndex(msg, "*")
+	if end < 0 {
+		return msg
+	}
+	fields := strings.SplitN(strings.TrimPrefix(msg[:end], "$"), ",", 7) // "PFLAA", 5 fields, then the ID onwards
+	if len(fields) < 7 {
+		return msg
+	}
+	cut := len(fields[6])
+	for i := 0; i < 5; i++ { // Track, TurnRate, GroundSpeed, ClimbRate, AcftType
+		if cut = strings.LastIndex(fields[6][:cut], ","); cut < 0 {
+			return msg
+		}
+	}
+	id, rest := fields[6][:cut], fields[6][cut:]
+	if i := strings.Index(id, "!"); i >= 0 {
+		id = id[:i]
+	}
+	if extended {
+		id += "!" + sanitizeFlarmTail(tail)
+	}
+	return nmeaSentence(strings.Join(fields[:6], ",") + "," + id + rest)
+}
+
+/*
+	nmeaSentence() wraps a sentence body in the leading '$' and the trailing '*<checksum>' and CR/LF. The checksum is
+		the XOR of all bytes between '$' and '*'. The result is checked with validateSentence() before anything can send
+		it: a field that slipped a '*' or a line break past sanitizing would make every parser misread the sentence, so a
+		malformed one is logged and replaced by "", which sendNetFLARM() drops.
+*/
+
+func nmeaSentence(msg string) string {
+	s := nmeaFrame(msg)
+	if err := validateSentence(s); err != nil {
+		log.Printf("FLARM: not sending malformed sentence: %v\n", err)
+		return ""
+	}
+	return s
+}
+
+// nmeaFrame adds the framing and checksum to a sentence body without validating the result.
+func nmeaFrame(msg string) string {
+	var checksum byte
+	for i := 0; i < len(msg); i++ {
+		checksum = checksum ^ msg[i]
+	}
+	return fmt.Sprintf("$%s*%02X\r\n", msg, checksum)
+}
+
+/*
+	NMEA 0183 limits a sentence to 82 characters, from the '$' through the "\r\n". Some sentences legitimately run
+		longer, e.g. a PFLAA with a long callsign, and are accepted by tolerant parsers up to 86; FLARMLongSentences lists
+		the sentence types allowed that much. A sentence over its limit is logged and not sent.
+*/
+
+const (
+	nmeaStandardLength = 82
+	nmeaTolerantLength = 86
+)
+
+// nmeaMaxLength returns the length limit for a sentence type.
+func nmeaMaxLength(sentenceType string) int {
+	if globalSettings.FLARMLongSentences != "" && isFlarmSentenceListed(globalSettings.FLARMLongSentences, sentenceType) {
+		return nmeaTolerantLength
+	}
+	return nmeaStandardLength
+}
+
+// validateSentence checks the framing, checksum and length of a sentence as produced by nmeaFrame().
+func validateSentence(s string) error {
+	body := strings.TrimSuffix(s, "\r\n")
+	if !strings.HasPrefix(body, "$") {
+		return fmt.Errorf("sentence doesn't start with '$': %q", s)
+	}
+	star := len(body) - 3
+	if star < 1 || body[star] != '*' || strings.IndexByte(body, '*') != star {
+		return fmt.Errorf("checksum delimiter '*' not 3 characters from the end: %q", s)
+	}
+	if strings.ContainsAny(body[1:star], "$\r\n") {
+		return fmt.Errorf("'$' or line break inside the sentence: %q", s)
+	}
+	want, err := strconv.ParseUint(body[star+1:], 16, 8)
+	if err != nil {
+		return fmt.Errorf("bad checksum %q: %q", body[star+1:], s)
+	}
+	var checksum byte
+	for i := 1; i < star; i++ {
+		checksum = checksum ^ body[i]
+	}
+	if checksum != byte(want) {
+		return fmt.Errorf("checksum %02X, expected %02X: %q", want, checksum, s)
+	}
+	sentenceType := body[1:star]
+	if i := strings.IndexByte(sentenceType, ','); i >= 0 {
+		sentenceType = sentenceType[:i]
+	}
+	if n, limit := len(body)+len("\r\n"), nmeaMaxLength(sentenceType); n > limit {
+		return fmt.Errorf("%s sentence is %d characters, limit %d (see FLARMLongSentences): %q", sentenceType, n, limit, s)
+	}
+	return nil
+}
+
+// nmeaRound rounds to the nearest integer, halves away from zero. Truncating would under-report slow targets.
+func nmeaRound(x float64) int {
+	if x < 0 {
+		return -int(math.Floor(-x + 0.5))
+	}
+	return int(math.Floor(x + 0.5))
+}
+
+/*
+	sanitizeFlarmTail() reduces a tail / callsign to printable ASCII. Tails decoded from OGN can carry UTF-8 (e.g. "Müller"),
+		which NMEA does not allow and which many EFBs either reject or checksum per rune instead of per byte. The result
+		goes through nmeaField() and is capped at flarmTailMaxLen, so even a garbage decode keeps the PFLAA ID field
+		intact and the sentence within the length limit.
+*/
+
+const flarmTailMaxLen = 16
+
+func sanitizeFlarmTail(tail string) string {
+	tail = nmeaField(tail)
+	if len(tail) > flarmTailMaxLen {
+		tail = strings.TrimSpace(tail[:flarmTailMaxLen])
+	}
+	return tail
+}
+
+/*
+	nmeaField() is the escaping layer for any free-text value placed in an NMEA field. Everything outside printable
+		ASCII is dropped, as are the characters NMEA 0183 reserves for framing and field structure: '$' and '!' start a
+		sentence (and '!' separates the ID from the callsign in PFLAA), '*' starts the checksum, ',' separates fields,
+		'\' and '^' escape, '~' is reserved. CR and LF fall under the control characters. Dropping rather than replacing
+		keeps the output identical for the usual clean callsigns.
+*/
+
+func nmeaField(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7E || strings.IndexByte(nmeaReserved, c) >= 0 {
+			continue
+		}
+		b = append(b, c)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+const nmeaReserved = "$!*,\\^~"
+
+/*
+	Adaptive output reduction. A club with half a dozen tablets on one Pi access point can saturate the link, so the
+		PFLAA rate is divided down as the number of connected clients grows, or when even the best TCP client is losing
+		sentences. A single slow client only drops its own sentences (see handleMessages()) and never throttles the others.
+*/
+
+const (
+	flarmThrottleClients    = 4   // clients served at the full traffic rate
+	flarmThrottleDropRate   = 0.1 // fraction of dropped TCP sentences treated as a saturated link
+	flarmThrottleMaxDivisor = 3   // never send traffic less often than every third cycle
+)
+
+const flarmStatusInterval = 5 * time.Second                // between PSTX status sentences
+const flarmAlarmsDisabledWarningInterval = 5 * time.Minute // between "alarms disabled" log warnings
+const flarmDeclinationWarningInterval = 5 * time.Minute    // between "no declination" log warnings
+
+var flarmTrafficCycle uint64
+var flarmTrafficDivisorLast = 1 // guarded by flarmCycleMutex
+
+/*
+	flarmTrafficDivisor() returns the number of traffic cycles per PFLAA emission for the given client count and
+		lowest per-client TCP drop rate. 1 means every cycle.
+*/
+
+func flarmTrafficDivisor(clients int, dropRate float64) int {
+	divisor := 1
+	if clients > flarmThrottleClients {
+		divisor += (clients - flarmThrottleClients + 1) / 2
+	}
+	if dropRate > flarmThrottleDropRate {
+		divisor++
+	}
+	if divisor > flarmThrottleMaxDivisor {
+		divisor = flarmThrottleMaxDivisor
+	}
+	return divisor
+}
+
+/*
+	Idle backoff. With FLARMIdleInterval set, a cycle while nothing consumes the output (UDP and serial off, no TCP
+		client) runs only every FLARMIdleInterval seconds, which keeps the per-target state ticking over at a fraction
+		of the power. A client connecting is published right away (setTCPClientCount()), so the very next cycle runs at
+		full rate again.
+*/
+
+func flarmIdleBackoff(consumers bool) (skip bool) {
+	c := flarmStates
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interval := time.Duration(globalSettings.FLARMIdleInterval) * time.Second
+	if consumers || interval <= 0 {
+		if c.idle {
+			log.Printf("FLARM: output back to full rate\n")
+			c.idle = false
+		}
+		return false
+	}
+	if !c.idle {
+		log.Printf("FLARM: no client and UDP/serial output off, slowing to one cycle every %v\n", interval)
+		c.idle = true
+	} else if stratuxClock.Since(c.idleLast) < interval {
+		return true
+	}
+	c.idleLast = stratuxClock.Time
+	return false
+}
+
+/*
+	Fixed-rate output. Traffic reports arrive irregularly, and the 1 s traffic update inherits that jitter. With
+		FLARMFixedInterval set, flarmFixedRateSender() emits the latest known state of every target on a steady
+		cadence instead. A target that stops reporting is repeated as last seen until it goes stale (isFlarmFresh()).
+		Either way only one cycle runs at a time (flarmCycleMutex): when the setting changes, a tick can coincide with
+		the traffic update. Periodic output (PSTX, warnings) goes by time, so it keeps its rate at any cadence.
+*/
+
+const flarmMinFixedInterval = 200 * time.Millisecond
+
+var flarmCycleMutex sync.Mutex
+
+func flarmFixedInterval() time.Duration {
+	interval := time.Duration(globalSettings.FLARMFixedInterval) * time.Millisecond
+	if interval > 0 && interval < flarmMinFixedInterval {
+		interval = flarmMinFixedInterval
+	}
+	return interval
+}
+
+func flarmFixedRateSender() {
+	for {
+		interval := flarmFixedInterval()
+		if interval <= 0 {
+			time.Sleep(time.Second) // off: sendTrafficUpdates() drives the output
+			continue
+		}
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if flarmFixedInterval() != interval {
+				break // setting changed; restart at the new rate
+			}
+			sendFlarmTrafficUpdates(flarmTrafficSnapshot())
+		}
+		ticker.Stop()
+	}
+}
+
+// isFlarmFresh reports a target recent enough for the FLARM output. Mode C targets have no position, so their
+// freshness is judged by the last altitude report.
+func isFlarmFresh(ti TrafficInfo) bool {
+	return (ti.Position_valid && ti.Age < 6) || (!ti.Position_valid && ti.AgeLastAlt < 6)
+}
+
+// flarmTrafficSnapshot returns the current non-ownship FLARM targets, with age, distance and bearing as of now.
+func flarmTrafficSnapshot() []TrafficInfo {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	code, _ := strconv.ParseInt(globalSettings.OwnshipModeS, 16, 32)
+	targets := make([]TrafficInfo, 0, len(traffic))
+	for _, ti := range traffic {
+		ti.Age = stratuxClock.Since(ti.Last_seen).Seconds()
+		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
+		if ti.Icao_addr == uint32(code) || !isFlarmFresh(ti) {
+			continue
+		}
+		if isGPSValid() {
+			ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+			ti.BearingDist_valid = true
+		} else {
+			ti.Distance, ti.Bearing, ti.BearingDist_valid = 0, 0, false
+		}
+		targets = append(targets, ti)
+	}
+	return targets
+}
+
+/*
+	Ownship jump gate. A receiver can report a valid fix hundreds of km from the previous one for a cycle (multipath, a
+		bad solution after a cold start), and every relative position in that cycle would be off by as much. A fix
+		implying a ground speed over FLARMMaxOwnSpeed since the last accepted one is treated as no fix for the cycle:
+		no-fix GPRMC / GPGGA and no traffic. After flarmOwnFixGap without an accepted fix (a long dropout, or a real
+		relocation held back by the gate) the next fix is accepted wherever it is.
+*/
+
+const (
+	flarmMaxOwnSpeedDefault = 1000             // knots, used when FLARMMaxOwnSpeed is 0
+	flarmOwnFixGap          = 10 * time.Second // accept any fix after this long without an accepted one
+	flarmOwnFixMinInterval  = 1.0              // seconds; floor on the fix-to-fix time, so fix timing jitter can't trip the gate
+)
+
+type flarmOwnFix struct {
+	lat, lng float64
+	t        time.Time // GPSLastFixLocalTime
+}
+
+var flarmLastOwnFix flarmOwnFix // last fix accepted by the gate
+var flarmOwnFixRejected bool    // the current cycle's fix was rejected
+var flarmOwnFixMutex sync.Mutex
+
+func flarmMaxOwnSpeed() float64 {
+	if globalSettings.FLARMMaxOwnSpeed > 0 {
+		return float64(globalSettings.FLARMMaxOwnSpeed)
+	}
+	return flarmMaxOwnSpeedDefault
+}
+
+// checkFlarmOwnFix runs the jump gate on the current fix. Called once per cycle, before any sentence is built.
+func checkFlarmOwnFix() {
+	flarmOwnFixMutex.Lock()
+	defer flarmOwnFixMutex.Unlock()
+	wasRejected := flarmOwnFixRejected
+	flarmOwnFixRejected = false
+	if !isGPSValid() {
+		return
+	}
+	fix := flarmOwnFix{lat: float64(mySituation.GPSLatitude), lng: float64(mySituation.GPSLongitude), t: mySituation.GPSLastFixLocalTime}
+	last := flarmLastOwnFix
+	if !last.t.IsZero() && fix.t.Sub(last.t) < flarmOwnFixGap {
+		dist, _ := distance(last.lat, last.lng, fix.lat, fix.lng)
+		speed := dist / math.Max(fix.t.Sub(last.t).Seconds(), flarmOwnFixMinInterval) * 3600 / 1852 // knots
+		if speed > flarmMaxOwnSpeed() {
+			if !wasRejected {
+				log.Printf("FLARM: ignoring GPS fix %.0f m from the last one (%.0f kt)\n", dist, speed)
+			}
+			flarmOwnFixRejected = true
+			return
+		}
+	}
+	flarmLastOwnFix = fix
+}
+
+/*
+	Fix age. isGPSValid() accepts a fix up to 3 s old, and a lagging GPS goroutine can leave mySituation that stale while
+		still valid. Every relative position is then off by however far we have moved since, so the traffic math only
+		uses a fix younger than FLARMMaxFixAge (default flarmMaxFixAgeDefault, which rides out a 1 Hz receiver's jitter).
+*/
+
+const flarmMaxFixAgeDefault = 2 * time.Second
+
+func flarmMaxFixAge() time.Duration {
+	if globalSettings.FLARMMaxFixAge > 0 {
+		return time.Duration(globalSettings.FLARMMaxFixAge) * time.Millisecond
+	}
+	return flarmMaxFixAgeDefault
+}
+
+// isFlarmGPSValid reports a GPS fix the FLARM traffic output can use: valid, with a fix quality, fresh, and not
+// rejected by the jump gate. Any quality will do, DGPS / SBAS (2) like a plain fix (1); a fix from few satellites only
+// loses the GPS altitude (isGPSFix2D()), never the traffic.
+func isFlarmGPSValid() bool {
+	flarmOwnFixMutex.Lock()
+	rejected := flarmOwnFixRejected
+	flarmOwnFixMutex.Unlock()
+	return isGPSValid() && mySituation.GPSFixQuality > 0 && !rejected &&
+		stratuxClock.Since(mySituation.GPSLastFixLocalTime) <= flarmMaxFixAge()
+}
+
+/*
+	Idle PFLAU. PFLAU is only sent for traffic, so a cycle with no traffic, or with every target filtered out, has none,
+		and an EFB waiting for the FLARM heartbeat times the device out after a couple of seconds. An idle PFLAU is sent
+		when a cycle has produced none and none went out for FLARMPFLAUInterval (every such cycle if 0).
+
+		With FLARMEmitPFLAU off, no PFLAU is sent at all, only the PFLAA traffic list, for setups where a separate FLARM
+		owns the alarms. Such an EFB may then time the device out for want of a heartbeat; FLARMPFLAUHeartbeat keeps the
+		idle PFLAU (and the GPS-only one), which never carries an alarm, while every traffic PFLAU stays suppressed.
+*/
+
+const flarmPFLAUSlack = 100 * time.Millisecond // cycle timing jitter
+
+func isFlarmIdlePFLAUDue(pflauBefore uint64) bool {
+	flarmLastSentMutex.Lock()
+	defer flarmLastSentMutex.Unlock()
+	if flarmPFLAUCount != pflauBefore {
+		return false // this cycle had one
+	}
+	interval := time.Duration(globalSettings.FLARMPFLAUInterval) * time.Millisecond
+	return interval <= 0 || stratuxClock.Since(flarmLastSent["PFLAU"]) >= interval-flarmPFLAUSlack
+}
+
+// isFlarmPFLAUHeartbeatOn reports whether the "no traffic" PFLAU may be sent.
+func isFlarmPFLAUHeartbeatOn() bool {
+	return globalSettings.FLARMEmitPFLAU || globalSettings.FLARMPFLAUHeartbeat
+}
+
+// makeFlarmIdlePFLAU returns a "no traffic" PFLAU, with the GPS field telling whether we have a fix.
+func makeFlarmIdlePFLAU() string {
+	return nmeaSentence(fmt.Sprintf("PFLAU,0,1,%d,%d,0,,0,,,", flarmGPSField(), flarmPower()))
+}
+
+/*
+	sendFlarmTrafficUpdates() is called from sendTrafficUpdates() once per second (or by flarmFixedRateSender()) with the current (non-ownship) traffic
+		and emits GPRMC / GPGGA followed by a PFLAA for each relevant target. UDP output doesn't depend on TCP clients,
+		so a passive logger on UDP gets the full stream; with FLARMSkipIdle set, nothing is generated while
+		UDP is off and no TCP client is connected. Every target can raise the cycle's PFLAU alarm; only the PFLAA
+		traffic list is reduced when the output is throttled.
+*/
+
+func sendFlarmTrafficUpdates(targets []TrafficInfo) {
+	flarmCycleMutex.Lock()
+	defer flarmCycleMutex.Unlock()
+	clients, dropRate := getTCPClientLoad()
+	// The GDL90 bridge is built in the same cycle, so its clients keep the cycle running; they don't count for the
+	// NMEA throttling below.
+	consumers := globalSettings.NetworkFLARM || globalSettings.FLARMSerialOutput || clients > 0 || getFlarmGDL90Clients() > 0
+	if globalSettings.FLARMSkipIdle && !consumers {
+		return // nobody listening on UDP, serial or TCP; don't spend the CPU building sentences
+	}
+	if flarmIdleBackoff(consumers) {
+		return
+	}
+	flarmStates.sweep()
+	pruneFlarmReplay()
+	if int(globalStatus.Connected_Users) > clients {
+		clients = int(globalStatus.Connected_Users)
+	}
+
+	divisor := flarmTrafficDivisor(clients, dropRate)
+	if divisor != flarmTrafficDivisorLast {
+		if divisor > 1 {
+			log.Printf("FLARM: throttling traffic output to every %d cycles (%d clients, %.0f%% TCP drops)\n", divisor, clients, dropRate*100)
+		} else {
+			log.Printf("FLARM: traffic output back to full rate (%d clients)\n", clients)
+		}
+		flarmTrafficDivisorLast = divisor
+	}
+
+	flarmTrafficCycle++
+	sendTraffic := flarmTrafficCycle%uint64(divisor) == 0
+
+	if globalSettings.FLARMAlarmsDisabled && flarmStates.due(&flarmStates.warningLast, flarmAlarmsDisabledWarningInterval) {
+		log.Printf("FLARM: WARNING - traffic alarms are disabled (FLARMAlarmsDisabled). Traffic is shown without alarms.\n")
+	}
+	if globalSettings.FLARMMagneticBearing && globalSettings.FLARMDeclination == 0 && flarmStates.due(&flarmStates.declinationWarningLast, flarmDeclinationWarningInterval) {
+		log.Printf("FLARM: WARNING - FLARMMagneticBearing is set but FLARMDeclination isn't. PFLAU bearings stay true.\n")
+	}
+
+	startFlarmUDPBatch()
+
+	// Ownship position every cycle, always ahead of the traffic: XCSoar drops PFLAA that arrives before it has a
+	// fresh GPGGA. The no-fix forms are sent while there is no valid GPS fix.
+	checkFlarmOwnFix()
+	sendNetFLARM(makeGPRMCString())
+	sendNetFLARM(makeGPGGAString())
+	sendFlarmGDL90Ownship()
+
+	emitted := 0
+	if globalSettings.FLARMGPSOnly {
+		// Stratux as a plain GPS source for an EFB with its own traffic. Optionally keep a "no traffic" PFLAU so apps
+		// that wait for a FLARM heartbeat still accept the stream.
+		if globalSettings.FLARMGPSOnlyPFLAU && isFlarmPFLAUHeartbeatOn() && isFlarmGPSValid() {
+			sendNetFLARM(makeFlarmIdlePFLAU())
+		}
+	} else {
+		flarmLastSentMutex.Lock()
+		pflauBefore := flarmPFLAUCount
+		flarmLastSentMutex.Unlock()
+		emitted = sendFlarmTraffic(append(targets[:len(targets):len(targets)], flarmTestObjects()...), sendTraffic)
+		if isFlarmPFLAUHeartbeatOn() && isFlarmIdlePFLAUDue(pflauBefore) {
+			sendNetFLARM(makeFlarmIdlePFLAU())
+		}
+	}
+
+	if globalSettings.FLARMStatusSentence && flarmStates.due(&flarmStates.statusLast, flarmStatusInterval) {
+		sendNetFLARM(makeFlarmStatusString(flarmTargetCount(targets)))
+	}
+	if globalSettings.FLARMTrafficSentence {
+		sendNetFLARM(makeFlarmTrafficCountString(targets, emitted))
+	}
+	flushFlarmUDP()
+}
+
+// flarmTargetCount returns the number of targets last received from FLARM / OGN.
+func flarmTargetCount(targets []TrafficInfo) int {
+	count := 0
+	for _, ti := range targets {
+		if ti.Last_source == TRAFFIC_SOURCE_FLARM {
+			count++
+		}
+	}
+	return count
+}
+
+// sendFlarmTraffic emits the cycle's PFLAU and, on cycles that aren't throttled, the PFLAA traffic list. It returns the
+// number of PFLAA sent.
+func sendFlarmTraffic(targets []TrafficInfo, sendTraffic bool) (emitted int) {
+	relevant := make([]flarmTarget, 0, len(targets))
+	shown := false // at least one target, alarming or not, for the no-alarm PFLAU
+	var alarms []flarmTarget
+	for _, ti := range targets {
+		ti.Tail = flarmCallsign(ti)
+		if isFlarmOwnshipTail(ti) {
+			continue
+		}
+		if globalSettings.FLARMAirborneOnly && !isFlarmAirborne(ti) {
+			continue
+		}
+		if isFlarmPositionJump(ti) {
+			continue
+		}
+		if globalSettings.FLARMDeadReckoning {
+			ti = deadReckonFlarmTarget(ti)
+		}
+		msg, alarmLevel, dist, pflau, id, valid := makeFlarmPFLAA(ti)
+		if !valid {
+			continue
+		}
+		shown = true
+		target := flarmTarget{icao: ti.Icao_addr, id: id, msg: msg, alarmLevel: alarmLevel, dist: dist, pflau: pflau, ti: ti}
+		if pflau != "" {
+			alarms = append(alarms, target) // every target can alarm, including those not in the PFLAA list
+		}
+		if isFlarmAllowed(ti) && (alarmLevel > 0 || !isFlarmBehind(ti)) {
+			relevant = append(relevant, target) // traffic behind us only while it alarms, e.g. overtaking fast
+		}
+	}
+
+	alarm, ok := selectFlarmAlarm(alarms)
+	if globalSettings.FLARMEmitPFLAU { // off: PFLAA only, the alarm still counts for the all-clear below
+		if ok {
+			sendNetFLARM(alarm.pflau)
+		} else if shown && isFlarmGPSValid() {
+			sendNetFLARM(nmeaSentence(fmt.Sprintf("PFLAU,1,1,%d,%d,0,,0,,,", flarmGPSField(), flarmPower())))
+		}
+	}
+	if peak, cleared := flarmAllClear(alarm.alarmLevel); cleared {
+		log.Printf("FLARM: traffic clear (peak alarm level %d)\n", peak)
+		if globalSettings.FLARMClearSentence {
+			sendNetFLARM(nmeaSentence(fmt.Sprintf("PSTXC,%d", peak)))
+		}
+	}
+
+	if sendTraffic {
+		for _, target := range selectFlarmTargets(relevant, globalSettings.FLARMMaxTargets) {
+			if target.ti.Position_valid {
+				// Every cycle, even when the PFLAA is a skipped duplicate: GDL90 apps expire traffic within seconds.
+				sendFlarmGDL90(makeFlarmGDL90Traffic(target))
+			}
+			if globalSettings.FLARMSkipDuplicates && isFlarmDuplicate(target) {
+				continue
+			}
+			if target.alarmLevel == 0 && !hasFlarmBudget(len(target.msg)) {
+				continue // over the output budget; alarms are never shed
+			}
+			sendNetFLARM(target.msg)
+			if globalSettings.FLARMSkipDuplicates {
+				markFlarmPFLAASent(target) // only once actually sent: a shed PFLAA is no duplicate next cycle
+			}
+			sendFlarmPFLAAVariants(target.msg, target.ti)
+			if globalSettings.FLARMSignalSentence {
+				sendNetFLARM(makeFlarmSignalString(target.msg, target.ti))
+			}
+			emitted++
+		}
+	}
+	return emitted
+}
+
+/*
+	Duplicate addresses. Two aircraft transmitting the same ICAO address (a decode error or spoofing) share one traffic
+		entry, which takes the position of whichever was heard last, and the EFB icon jumps between the two places from
+		cycle to cycle. A position that is farther from the last one sent than the target could have flown since
+		(flarmMaxGroundSpeed() plus flarmJumpSlack for position noise) is held back, so the output stays on the track
+		it has been following; with FLARMDupKeepClosest, it moves to the other one at once if that is closer to us.
+		A jump that persists for flarmJumpHold is real (the first aircraft is gone, or we lost it for a while) and is
+		followed. An ADS-R / TIS-B relay repeating an address reports the same aircraft at the same place and passes.
+*/
+
+const (
+	flarmJumpSlack = 1000.0 // meters
+	flarmJumpHold  = 5 * time.Second
+)
+
+func isFlarmPositionJump(ti TrafficInfo) bool {
+	if ti.Icao_addr == 0 || !ti.Position_valid || ti.Last_seen.IsZero() {
+		return false // pseudo IDs are matched by position already
+	}
+	st := flarmStates.get(ti.Icao_addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	accept := func() bool {
+		st.posLat, st.posLng, st.posSeen, st.posValid = ti.Lat, ti.Lng, ti.Last_seen, true
+		st.jumpSince = time.Time{}
+		return false
+	}
+	moved := ti.Lat != st.posLat || ti.Lng != st.posLng
+	if !st.posValid || (!moved && ti.Last_seen.After(st.posSeen)) {
+		return accept()
+	}
+	if !moved {
+		return false
+	}
+	if !ti.Last_seen.After(st.posSeen) {
+		return true // no new report since one was held back
+	}
+	jump, _ := distance(float64(st.posLat), float64(st.posLng), float64(ti.Lat), float64(ti.Lng))
+	reach := flarmMaxGroundSpeed()*0.514444*ti.Last_seen.Sub(st.posSeen).Seconds() + flarmJumpSlack
+	if jump <= reach {
+		return accept()
+	}
+	if globalSettings.FLARMDupKeepClosest && isGPSValid() {
+		ownLat, ownLng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+		held, _ := distance(ownLat, ownLng, float64(st.posLat), float64(st.posLng))
+		if now, _ := distance(ownLat, ownLng, float64(ti.Lat), float64(ti.Lng)); now < held {
+			return accept()
+		}
+	}
+	if st.jumpSince.IsZero() {
+		st.jumpSince = ti.Last_seen
+		if globalSettings.DEBUG {
+			log.Printf("FLARM: target %06X jumped %.0f m; two aircraft with one address?\n", ti.Icao_addr, jump)
+		}
+	}
+	if ti.Last_seen.Sub(st.jumpSince) >= flarmJumpHold {
+		return accept()
+	}
+	return true
+}
+
+// flarmOwnAltitude returns our altitude (feet) on the same basis as the target's: pressure altitude, or GPS altitude
+// for FLARM targets and when there is no pressure sensor. known is false with neither a pressure sensor nor a 3D fix.
+func flarmOwnAltitude(ti TrafficInfo) (alt float32, known bool) {
+	gpsAlt := isGPSValid() && !isGPSFix2D()
+	if isTempPressValid() && (!strings.Contains(ti.Tail, "F-") || !gpsAlt) {
+		return mySituation.BaroPressureAltitude, true
+	}
+	if gpsAlt {
+		return float32(mySituation.GPSAltitudeMSL), true
+	}
+	return 0, false // neither baro nor a 3D fix
+}
+
+/*
+	flarmAltitudes() returns the target and own altitude (feet) the relative vertical is computed from. A GNSS altitude
+		from ADS-B or FLARM is height above the ellipsoid; with FLARMGeoidCorrection it is brought to MSL with our geoid
+		separation and compared to our GPS MSL altitude, rather than mixing HAE with MSL or pressure altitude. A test
+		object's height is MSL and compared to our GPS MSL altitude as it is.
+*/
+
+func flarmAltitudes(ti TrafficInfo) (target, own float32, known bool) {
+	if ti.Last_source == flarmTestObjectSource && isGPSValid() && !isGPSFix2D() {
+		return float32(ti.Alt), mySituation.GPSAltitudeMSL, true
+	}
+	if globalSettings.FLARMGeoidCorrection && ti.AltIsGNSS && isGPSValid() && !isGPSFix2D() {
+		return float32(ti.Alt) - mySituation.GPSGeoidSep, mySituation.GPSAltitudeMSL, true
+	}
+	own, known = flarmOwnAltitude(ti)
+	return float32(ti.Alt), own, known
+}
+
+/*
+	deadReckonFlarmTarget() moves the target along its track at its ground speed for the time since its last position
+		report, so targets reported less often than once a second still move smoothly on the EFB. A target is never
+		extrapolated more than flarmDeadReckoningLimit; after that it stays where DR last put it until it is reported
+		again or times out.
+*/
+
+const flarmDeadReckoningLimit = 3.0 // seconds
+
+func deadReckonFlarmTarget(ti TrafficInfo) TrafficInfo {
+	if !ti.Position_valid || !ti.Speed_valid || ti.TrackType == TRACK_TYPE_NONE || ti.Age <= 0 {
+		return ti // no velocity to move it along
+	}
+	t := ti.Age
+	if t > flarmDeadReckoningLimit {
+		t = flarmDeadReckoningLimit
+	}
+	const radiusEarth = 6371008.8 // meters; as in distRect()
+	dist := float64(ti.Speed) * 0.5144 * t
+	track := float64(ti.Track) * math.Pi / 180
+	lat := float64(ti.Lat) * math.Pi / 180
+	ti.Lat += float32(dist * math.Cos(track) / radiusEarth * 180 / math.Pi)
+	ti.Lng += float32(dist * math.Sin(track) / (radiusEarth * math.Cos(lat)) * 180 / math.Pi)
+	ti.ExtrapolatedPosition = true
+	return ti
+}
+
+/*
+	isFlarmAirborne() is the FLARMAirborneOnly filter: the target has to be moving and not report itself on the ground.
+		While we're on the ground ourselves, our altitude is the field elevation, so the target must also be clearly
+		above us - MSL altitude alone would make every aircraft on a high field look airborne.
+*/
+
+const (
+	flarmOwnshipGroundSpeed = 30  // knots; slower than this, we're taxiing or parked
+	flarmAirborneMinHeight  = 100 // feet above our own (ground) altitude
+)
+
+func isFlarmAirborne(ti TrafficInfo) bool {
+	if ti.OnGround || !ti.Speed_valid || ti.Speed == 0 {
+		return false
+	}
+	if isGPSValid() && mySituation.GPSGroundSpeed < flarmOwnshipGroundSpeed {
+		if ownAlt, known := flarmOwnAltitude(ti); known {
+			return float32(ti.Alt)-ownAlt > flarmAirborneMinHeight
+		}
+	}
+	return true
+}
+
+// isFlarmStationary reports a target below the FLARMStationarySpeed threshold that is on the ground or is an obstacle.
+// A hovering helicopter also reports ~0 kt but is airborne, so keeps its velocity fields.
+func isFlarmStationary(ti TrafficInfo) bool {
+	if globalSettings.FLARMStationarySpeed <= 0 || int(ti.Speed) >= globalSettings.FLARMStationarySpeed {
+		return false
+	}
+	return ti.OnGround || isFlarmObstacle(ti)
+}
+
+// isFlarmObstacle reports a fixed obstacle: the ADS-B point, cluster and line obstacle emitter categories.
+func isFlarmObstacle(ti TrafficInfo) bool {
+	return ti.Emitter_category >= 19 && ti.Emitter_category <= 21
+}
+
+/*
+	flarmGroundTrack() returns the PFLAA Track, the true ground track. Some sources report a heading instead. Without
+		the wind the track can't be worked out from it, but for a fast aircraft the wind can only turn it a little, so
+		from flarmHeadingTrackSpeed up the heading, converted to true, stands in. A slower one, which in a strong wind
+		may be flying a track tens of degrees off its heading, gets an empty Track, and so does a magnetic heading while
+		FLARMDeclination isn't set, or a target that reports no track at all.
+*/
+
+const flarmHeadingTrackSpeed = 150 // knots; 40 kt of crosswind then turns the track by 15° at most
+
+func flarmGroundTrack(ti TrafficInfo) string {
+	track := float64(ti.Track)
+	switch ti.TrackType {
+	case TRACK_TYPE_TRUE_TRACK:
+		return strconv.Itoa(int(ti.Track))
+	case TRACK_TYPE_NONE:
+		return ""
+	case TRACK_TYPE_MAG_HEADING:
+		if globalSettings.FLARMDeclination == 0 {
+			return "" // can't convert to true
+		}
+		track += globalSettings.FLARMDeclination
+	}
+	if !ti.Speed_valid || ti.Speed < flarmHeadingTrackSpeed {
+		return ""
+	}
+	return strconv.Itoa((nmeaRound(track)%360 + 360) % 360)
+}
+
+/*
+	isFlarmRelativeOnly() reports a target from a source that gives bearing and distance from us instead of a position
+		(flagged RelativeOnly by the source). A relative bearing without a distance (Distance 0) doesn't count: such a
+		target gets the bearing-less form, like Mode-C. A target that has merely lost its position is not relative-only;
+		its last bearing and distance were computed from where we were then.
+*/
+
+func isFlarmRelativeOnly(ti TrafficInfo) bool {
+	return ti.RelativeOnly && !ti.Position_valid && ti.BearingDist_valid && ti.Distance > 0
+}
+
+// flarmPFLAUBearing converts a true bearing to the PFLAU -180..180 range, referenced to magnetic north if configured.
+// FLARMDeclination is east-positive: magnetic = true - declination. While it isn't set (0) the bearing stays true.
+func flarmPFLAUBearing(bearing float64) float64 {
+	if globalSettings.FLARMMagneticBearing && globalSettings.FLARMDeclination != 0 {
+		bearing -= globalSettings.FLARMDeclination
+	}
+	bearing = math.Mod(bearing, 360)
+	if bearing > 180 {
+		bearing -= 360
+	} else if bearing <= -180 {
+		bearing += 360
+	}
+	return bearing
+}
+
+/*
+	Rear sector. With FLARMRearArc set, non-alarming traffic within that arc centered on our tail is left out of the
+		PFLAA list, e.g. to follow only the gliders ahead in a gaggle. A target behind that does alarm, such as a faster
+		aircraft overtaking, stays in the list. Without a track of our own (too slow for a GPS track and no heading from
+		the EFB) or a bearing to the target (Mode-C), nothing counts as behind.
+*/
+
+func isFlarmBehind(ti TrafficInfo) bool {
+	arc := globalSettings.FLARMRearArc
+	if arc <= 0 || !isFlarmOwnTrackKnown() {
+		return false
+	}
+	var bearing float64
+	switch {
+	case ti.Position_valid:
+		_, bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	case isFlarmRelativeOnly(ti):
+		bearing = ti.Bearing
+	default:
+		return false
+	}
+	relative := math.Mod(bearing-float64(ownshipTrack())+720, 360) // 0 = dead ahead, 180 = dead astern
+	return math.Abs(relative-180) <= float64(arc)/2
+}
+
+// isFlarmOwnTrackKnown reports whether ownshipTrack() is a real track or heading rather than a stale GPS course.
+func isFlarmOwnTrackKnown() bool {
+	if isGPSValid() && mySituation.GPSGroundSpeed >= flarmMinTrackSpeed {
+		return true
+	}
+	flarmClientMutex.Lock()
+	defer flarmClientMutex.Unlock()
+	return !flarmClientHeadingTime.IsZero() && stratuxClock.Since(flarmClientHeadingTime) < flarmClientHeadingTimeout
+}
+
+// flarmGPSField returns the PFLAU <GPS> field: 0 without a usable fix, 1 with a 2D fix and 2 with a 3D fix.
+func flarmGPSField() int {
+	switch {
+	case !isFlarmGPSValid():
+		return 0
+	case isGPSFix2D():
+		return 1
+	}
+	return 2
+}
+
+// flarmPower returns the PFLAU <Power> field: 0 when supplyVoltageMonitor() reports a voltage below the configured
+// threshold, otherwise 1. Without a sensor (SupplyVoltage 0) or threshold the supply is assumed OK.
+func flarmPower() int {
+	v := globalStatus.SupplyVoltage
+	if v > 0 && globalSettings.FLARMLowVoltage > 0 && float64(v) < globalSettings.FLARMLowVoltage {
+		return 0
+	}
+	return 1
+}
+
+/*
+	Per-target state. Everything the FLARM output remembers about a target between cycles (Mode-C band, first-seen
+		alarm hold, climb smoothing, last PFLAA sent, last callsign, last position) lives in one flarmTargetState per ICAO address in flarmStates.
+		Each feature checks its own timestamps for staleness; sweep() runs every cycle and drops targets not touched
+		for flarmStateTTL, so the cache never holds more than the traffic of the last flarmStateTTL, however dense.
+		Targets without an address (pseudo IDs) are tracked by position instead and never get an entry.
+
+		The state of the output as a whole (pseudo IDs, the PFLAU alarm target, the all-clear episode, idle backoff) is
+		kept in flarmStates too, guarded by its mu.
+*/
+
+const flarmStateTTL = flarmPseudoIDTimeout
+
+type flarmTargetState struct {
+	mu      sync.Mutex
+	touched time.Time // last get(), for the sweeper
+
+	ringLevel uint8 // distance ring hysteresis
+	ringSeen  time.Time
+
+	modeCShown bool // Mode-C band
+	modeCSeen  time.Time
+
+	frames     int // first-seen alarm hold
+	firstSeen  time.Time
+	lastSeen   time.Time
+	reportSeen time.Time // Last_seen of the last report counted
+
+	climbValid bool // climb smoothing
+	climbRate  float32
+	climbSeen  time.Time
+
+	pflaa     string // duplicate PFLAA suppression
+	pflaaSent time.Time
+
+	callsign     string // callsign cache
+	callsignSeen time.Time
+
+	datumFlagged bool // non-WGS84 position logged
+
+	idType     uint8 // IDType first sent
+	idTypeSeen time.Time
+
+	posValid  bool // position jump check
+	posLat    float32
+	posLng    float32
+	posSeen   time.Time // Last_seen of the position
+	jumpSince time.Time // Last_seen of the first report off the track, zero while on it
+}
+
+type flarmStateCache struct {
+	states sync.Map // uint32 ICAO address -> *flarmTargetState
+	ttl    time.Duration
+
+	mu          sync.Mutex // guards the cycle-wide state below
+	alarmID     uint32     // PFLAA ID of the previous cycle's PFLAU alarm target
+	alarmValid  bool
+	alarmPeak   uint8     // highest alarm level since the last all clear; 0 outside an alarm episode
+	alarmLast   time.Time // stratuxClock time of the last alarm
+	idle        bool      // the output is backed off
+	idleLast    time.Time // stratuxClock time of the last cycle run while backed off
+	pseudo      []*flarmPseudoTarget
+	statusLast  time.Time // last PSTX status sentence
+	warningLast time.Time // last "alarms disabled" warning
+
+	declinationWarningLast time.Time // last "no declination" warning
+}
+
+var flarmStates = &flarmStateCache{ttl: flarmStateTTL}
+
+// get returns the state for icao, creating it if needed. The caller locks st.mu to use it.
+func (c *flarmStateCache) get(icao uint32) *flarmTargetState {
+	v, _ := c.states.LoadOrStore(icao, &flarmTargetState{})
+	st := v.(*flarmTargetState)
+	st.mu.Lock()
+	st.touched = stratuxClock.Time
+	st.mu.Unlock()
+	return st
+}
+
+// due reports whether interval has passed since *last, a time in c, and restarts the interval if so.
+func (c *flarmStateCache) due(last *time.Time, interval time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !last.IsZero() && stratuxClock.Since(*last) < interval {
+		return false
+	}
+	*last = stratuxClock.Time
+	return true
+}
+
+// sweep drops every target not touched for the TTL.
+func (c *flarmStateCache) sweep() {
+	c.states.Range(func(k, v interface{}) bool {
+		st := v.(*flarmTargetState)
+		st.mu.Lock()
+		expired := stratuxClock.Since(st.touched) > c.ttl
+		st.mu.Unlock()
+		if expired {
+			c.states.Delete(k)
+		}
+		return true
+	})
+}
+
+/*
+	Duplicate PFLAA suppression. A target whose PFLAA is byte-for-byte the same as the last one sent for it is skipped,
+		but never for longer than flarmDuplicateRefresh, so the receiver doesn't time the target out.
+*/
+
+const flarmDuplicateRefresh = 2 * time.Second
+
+func isFlarmDuplicate(target flarmTarget) bool {
+	if target.icao == 0 {
+		return false // pseudo IDs are tracked by position, not address
+	}
+	st := flarmStates.get(target.icao)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.pflaa == target.msg && stratuxClock.Since(st.pflaaSent) < flarmDuplicateRefresh
+}
+
+// markFlarmPFLAASent records the target's PFLAA as the last one sent for it.
+func markFlarmPFLAASent(target flarmTarget) {
+	if target.icao == 0 {
+		return
+	}
+	st := flarmStates.get(target.icao)
+	st.mu.Lock()
+	st.pflaa = target.msg
+	st.pflaaSent = stratuxClock.Time
+	st.mu.Unlock()
+}
+
+/*
+	Stable IDType. An aircraft received both by ADS-B and as a FLARM / OGN beacon comes in with the same address, but
+		the sources disagree about the IDType: always ICAO (1) for ADS-B, what the beacon says for FLARM. An EFB keying
+		targets on IDType and ID would see a second aircraft whenever the source changes, so each address keeps the
+		IDType it was first sent with. Once the address hasn't been seen for flarmStateTTL it starts over, so a recycled
+		address on a different aircraft gets its own IDType.
+*/
+
+// flarmSourceIDType returns the IDType the target's current source gives its address.
+func flarmSourceIDType(ti TrafficInfo) uint8 {
+	if ti.Last_source == TRAFFIC_SOURCE_FLARM {
+		return ti.FlarmIDType
+	}
+	return 1
+}
+
+func flarmStableIDType(icao uint32, idType uint8) uint8 {
+	st := flarmStates.get(icao)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.idTypeSeen.IsZero() && stratuxClock.Since(st.idTypeSeen) < flarmStateTTL {
+		if st.idType != idType && globalSettings.DEBUG {
+			log.Printf("FLARM: target %06X reported with IDType %d, keeping %d\n", icao, idType, st.idType)
+		}
+		idType = st.idType
+	}
+	st.idType = idType
+	st.idTypeSeen = stratuxClock.Time
+	return idType
+}
+
+/*
+	Position datum. Every distance and bearing here takes positions as WGS84, like our own GPS fix. A target from a
+		source that tags its position with another datum could be misplaced by hundreds of meters, so it isn't shown
+		at all. The first rejection of each address is logged.
+*/
+
+func flagFlarmDatum(ti TrafficInfo) {
+	if ti.Icao_addr != 0 {
+		st := flarmStates.get(ti.Icao_addr)
+		st.mu.Lock()
+		flagged := st.datumFlagged
+		st.datumFlagged = true
+		st.mu.Unlock()
+		if flagged {
+			return
+		}
+	}
+	log.Printf("FLARM: dropping target %X (%s): position datum %q is not WGS84\n", ti.Icao_addr, ti.Tail, ti.Datum)
+}
+
+/*
+	Callsign cache. Partial decodes leave the tail of a target empty every few frames, and the EFB label flashes between
+		the callsign and the bare ID. The last non-empty callsign of each address is kept for flarmCallsignHold and used
+		while the tail is empty. A callsign that really changes simply replaces the cached one.
+*/
+
+const flarmCallsignHold = 60 * time.Second
+
+func flarmCallsign(ti TrafficInfo) string {
+	if ti.Icao_addr == 0 {
+		return ti.Tail // pseudo IDs are tracked by position, not address
+	}
+	st := flarmStates.get(ti.Icao_addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if strings.TrimSpace(ti.Tail) != "" {
+		st.callsign = ti.Tail
+		st.callsignSeen = stratuxClock.Time
+		return ti.Tail
+	}
+	if st.callsign != "" && stratuxClock.Since(st.callsignSeen) < flarmCallsignHold {
+		return st.callsign
+	}
+	return ti.Tail
+}
+
+/*
+	isFlarmOwnshipTail() returns true if the target's tail matches globalSettings.FLARMOwnshipTail, e.g. our own second
+		transponder or a buddy using the same placeholder. It only matches a non-empty configured tail, so targets with
+		no tail are never suppressed.
+*/
+
+func isFlarmOwnshipTail(ti TrafficInfo) bool {
+	ownTail := strings.TrimSpace(globalSettings.FLARMOwnshipTail)
+	return ownTail != "" && strings.EqualFold(strings.TrimSpace(ti.Tail), ownTail)
+}
+
+/*
+	isFlarmAllowed() applies the optional globalSettings.FLARMICAOAllowlist, e.g. to follow a single buddy while testing.
+		An empty list allows everything. Only the PFLAA traffic list is filtered: every target can still raise a PFLAU alarm.
+*/
+
+func isFlarmAllowed(ti TrafficInfo) bool {
+	if len(globalSettings.FLARMICAOAllowlist) == 0 {
+		return true
+	}
+	for _, icao := range globalSettings.FLARMICAOAllowlist {
+		if icao == ti.Icao_addr {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	flarmAircraftType() returns the PFLAA <AcftType> (hex digit). ADS-B emitter categories can't tell a tow plane (2) or
+		a skydiver drop plane (5) from any other light aircraft, so those come from the FLARMTowPlanes / FLARMDropPlanes
+		tags, which take precedence, or from the aircraft type OGN/FLARM reports (in the tail, see flarm.go).
+*/
+
+func flarmAircraftType(ti TrafficInfo) int {
+	for _, icao := range globalSettings.FLARMTowPlanes {
+		if icao == ti.Icao_addr {
+			return 2
+		}
+	}
+	for _, icao := range globalSettings.FLARMDropPlanes {
+		if icao == ti.Icao_addr {
+			return 5
+		}
+	}
+	if ti.Last_source == TRAFFIC_SOURCE_FLARM {
+		if strings.HasPrefix(ti.Tail, "FTOW") {
+			return 2
+		} else if strings.HasPrefix(ti.Tail, "FDROP") {
+			return 5
+		}
+	}
+
+	// Otherwise based on the ADS-B aircraft categories.
+	switch ti.Emitter_category {
+	case 19, 20, 21:
+		return 0xF // static object
+	case 9:
+		return 1 // glider
+	case 7:
+		return 3 // rotorcraft
+	case 1:
+		return 8 // assume all light aircraft are piston
+	case 2, 3, 4, 5, 6:
+		return 9 // assume all heavier aircraft are jets
+	}
+	return 0
+}
+
+// flarmIDString formats a FLARM ID as 6 hex digits, uppercase unless the paired device matches IDs in lowercase.
+func flarmIDString(id uint32) string {
+	if globalSettings.FLARMLowercaseID {
+		return fmt.Sprintf("%06x", id)
+	}
+	return fmt.Sprintf("%06X", id)
+}
+
+// flarmTarget is a target that passed makeFlarmPFLAAString() in the current cycle.
+type flarmTarget struct {
+	icao       uint32
+	id         uint32  // PFLAA ID: the address, or the pseudo ID of an address-less target
+	msg        string  // PFLAA sentence
+	alarmLevel uint8   // 0-3
+	dist       float64 // horizontal distance, meters
+	pflau      string  // PFLAU alarm sentence; empty without an alarm
+	ti         TrafficInfo
+}
+
+/*
+	selectFlarmAlarm() picks the target for the cycle's single PFLAU: highest alarm level first, then closest. With
+		FLARMGliderPriority set, a glider or FLARM-sourced target beats ADS-B traffic at the same alarm level as long as
+		it is at most flarmGliderPriorityMargin farther away. An alarm level spans kilometers, so beyond that the closer
+		ADS-B target keeps the alarm, and a higher alarm level always wins.
+
+		Two threats at nearly the same distance would otherwise trade places with every bit of position noise and the
+		alarm (bearing, distance, ID) would jump between them each cycle. The previous cycle's alarm target therefore
+		keeps the PFLAU as long as it is still alarming at the best level and class and no other target is closer by more
+		than FLARMAlarmTieMargin. Exactly equal distances go to the lower ID, so the choice never depends on the
+		order the targets arrive in. Both go by the PFLAA ID rather than the address, which address-less targets all
+		share as 0.
+*/
+
+const (
+	flarmAlarmTieMargin       = 100  // meters, default for FLARMAlarmTieMargin
+	flarmGliderPriorityMargin = 1000 // meters a glider may be farther than ADS-B traffic and still take the alarm
+)
+
+func selectFlarmAlarm(alarms []flarmTarget) (flarmTarget, bool) {
+	flarmStates.mu.Lock()
+	defer flarmStates.mu.Unlock()
+	var best flarmTarget
+	found := false
+	for _, a := range alarms {
+		if !found || flarmAlarmBefore(a, best) {
+			best = a
+			found = true
+		}
+	}
+	if found && flarmStates.alarmValid && best.id != flarmStates.alarmID {
+		margin := float64(globalSettings.FLARMAlarmTieMargin)
+		if margin == 0 {
+			margin = flarmAlarmTieMargin
+		}
+		for _, a := range alarms {
+			if a.id == flarmStates.alarmID && isFlarmAlarmTie(a, best, margin) {
+				best = a
+				break
+			}
+		}
+	}
+	flarmStates.alarmID, flarmStates.alarmValid = best.id, found
+	return best, found
+}
+
+func flarmAlarmBefore(a, b flarmTarget) bool {
+	if a.alarmLevel != b.alarmLevel {
+		return a.alarmLevel > b.alarmLevel
+	}
+	if globalSettings.FLARMGliderPriority && math.Abs(a.dist-b.dist) <= flarmGliderPriorityMargin {
+		if ga, gb := isFlarmGlider(a.ti), isFlarmGlider(b.ti); ga != gb {
+			return ga
+		}
+	}
+	if a.dist != b.dist {
+		return a.dist < b.dist
+	}
+	return a.id < b.id
+}
+
+// isFlarmAlarmTie reports whether the previous alarm target a is as urgent as the closest one, best, within margin meters.
+func isFlarmAlarmTie(a, best flarmTarget, margin float64) bool {
+	if margin < 0 || a.alarmLevel != best.alarmLevel {
+		return false
+	}
+	if globalSettings.FLARMGliderPriority && isFlarmGlider(a.ti) != isFlarmGlider(best.ti) {
+		return false
+	}
+	return a.dist-best.dist <= margin
+}
+
+// isFlarmGlider reports whether a target is a glider, or comes from FLARM / OGN where most traffic is gliders.
+func isFlarmGlider(ti TrafficInfo) bool {
+	return ti.Last_source == TRAFFIC_SOURCE_FLARM || flarmAircraftType(ti) == 1
+}
+
+/*
+	selectFlarmTargets() orders the cycle's targets by relevance - highest alarm level first, then closest - and returns
+		at most max of them (all of them if max <= 0). The ranking is rebuilt every cycle, so a distant target emitted last
+		cycle yields to a closer one that has since appeared.
+*/
+
+func selectFlarmTargets(targets []flarmTarget, max int) []flarmTarget {
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].alarmLevel != targets[j].alarmLevel {
+			return targets[i].alarmLevel > targets[j].alarmLevel
+		}
+		if targets[i].dist != targets[j].dist {
+			return targets[i].dist < targets[j].dist
+		}
+		return targets[i].icao < targets[j].icao
+	})
+	if max > 0 && len(targets) > max {
+		targets = targets[:max]
+	}
+	return targets
+}
+
+/*
+	Pseudo IDs for targets without an address. An address-less target is matched to the nearest pseudo target from
+		previous cycles that hasn't been claimed yet in this cycle, so each keeps its ID as it moves and two such targets
+		close together still get distinct IDs.
+*/
+
+const (
+	flarmPseudoIDTimeout = 10 * time.Second // forget a pseudo target not seen for this long
+	flarmPseudoIDMaxJump = 2000.0           // meters; further than this from every known pseudo target is a new target
+)
+
+type flarmPseudoTarget struct {
+	id       uint32
+	lat, lng float32
+	lastSeen time.Time
+	cycle    uint64 // traffic cycle that last claimed this ID
+}
+
+func flarmPseudoID(ti TrafficInfo) uint32 {
+	c := flarmStates
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var match *flarmPseudoTarget
+	matchDist := flarmPseudoIDMaxJump
+	known := c.pseudo[:0]
+	for _, p := range c.pseudo {
+		if stratuxClock.Since(p.lastSeen) > flarmPseudoIDTimeout {
+			continue
+		}
+		known = append(known, p)
+		if p.cycle == flarmTrafficCycle {
+			continue // already taken by another target this cycle
+		}
+		if dist, _, _, _ := distRect(float64(p.lat), float64(p.lng), float64(ti.Lat), float64(ti.Lng)); dist < matchDist {
+			match = p
+			matchDist = dist
+		}
+	}
+	c.pseudo = known
+
+	if match == nil {
+		match = &flarmPseudoTarget{id: c.newPseudoID(ti)}
+		c.pseudo = append(c.pseudo, match)
+	}
+	match.lat, match.lng = ti.Lat, ti.Lng
+	match.lastSeen = stratuxClock.Time
+	match.cycle = flarmTrafficCycle
+	return match.id
+}
+
+// newPseudoID derives a 24-bit ID from where and when the target was first seen, avoiding IDs already in use. The
+// caller holds c.mu.
+func (c *flarmStateCache) newPseudoID(ti TrafficInfo) uint32 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%f,%f,%d", ti.Lat, ti.Lng, stratuxClock.Time.UnixNano())
+	id := h.Sum32() & 0xFFFFFF
+	for id == 0 || c.pseudoIDInUse(id) {
+		id = (id + 1) & 0xFFFFFF
+	}
+	return id
+}
+
+func (c *flarmStateCache) pseudoIDInUse(id uint32) bool {
+	for _, p := range c.pseudo {
+		if p.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Mode-C vertical band. A Mode-C target has no position, so it is only shown while its altitude is close to ours. Once
+		shown, it is kept until it is flarmModeCHysteresis beyond the band, so altitude jitter at the edge doesn't make it
+		flicker in and out.
+*/
+
+const (
+	flarmModeCBandDefault = 310 // meters (~1000 ft), used when FLARMModeCBand is 0
+	flarmModeCHysteresis  = 30  // meters (~100 ft)
+)
+
+func flarmModeCInBand(icao uint32, relativeVertical int16) bool {
+	band := int16(globalSettings.FLARMModeCBand)
+	if band <= 0 {
+		band = flarmModeCBandDefault
+	}
+	st := flarmStates.get(icao)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.modeCShown && stratuxClock.Since(st.modeCSeen) <= flarmPseudoIDTimeout {
+		band += flarmModeCHysteresis
+	}
+	if !InBetween(relativeVertical, -band, band) {
+		st.modeCShown = false
+		return false
+	}
+	st.modeCShown = true
+	st.modeCSeen = stratuxClock.Time
+	return true
+}
+
+/*
+	First-seen alarm suppression. A new target's first position or altitude can be bad and fire a one-frame phantom
+		alarm. With FLARMAlarmConfirm set, a target has to be seen in flarmFirstSeenFrames consecutive frames (distinct
+		reports, however often the output repeats them) before it can alarm.
+		The hold never lasts longer than flarmFirstSeenMaxHold, so a genuinely sudden close target still alarms at once
+		on its next frame. Targets report at 1-2 Hz, so a second report is all that fits in the hold, and the setting is
+		on or off rather than a frame count.
+*/
+
+const (
+	flarmFirstSeenAlarmFloor = 0                      // alarm level allowed while suppressed
+	flarmFirstSeenMaxHold    = 500 * time.Millisecond // never suppress longer than this
+	flarmFirstSeenGap        = 3 * time.Second        // a target missing for this long starts over
+	flarmFirstSeenFrames     = 2                      // frames a new target needs; no more arrive within flarmFirstSeenMaxHold
+)
+
+func flarmAlarmAllowed(ti TrafficInfo) bool {
+	if !globalSettings.FLARMAlarmConfirm || ti.Icao_addr == 0 {
+		return true
+	}
+
+	st := flarmStates.get(ti.Icao_addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.frames == 0 || stratuxClock.Since(st.lastSeen) > flarmFirstSeenGap {
+		st.frames = 0
+		st.firstSeen = stratuxClock.Time
+	}
+	if st.frames == 0 || !ti.Last_seen.Equal(st.reportSeen) {
+		st.frames++
+		st.reportSeen = ti.Last_seen
+	}
+	st.lastSeen = stratuxClock.Time
+	return st.frames >= flarmFirstSeenFrames || stratuxClock.Since(st.firstSeen) >= flarmFirstSeenMaxHold
+}
+
+/*
+	Distance rings. A target at or inside a ring's radius gets its alarm level. Once at a level, a target keeps it until it
+		is more than the ring hysteresis (FLARMRingHysteresis, default flarmRingHysteresisDefault) beyond the radius, so one
+		holding station right at a ring doesn't flap between two levels with every bit of position jitter.
+*/
+
+var flarmAlarmRings = []struct {
+	radius float64 // meters, inclusive
+	level  uint8
+}{
+	{4000, 3},  // ~2 NM (the 0.5 NM ring is level 3 as well)
+	{8000, 2},  // ~4 NM
+	{12000, 1}, // ~6 NM
+}
+
+const flarmRingHysteresisDefault = 200.0 // meters
+
+func flarmRingLevelAt(dist float64) uint8 {
+	for _, ring := range flarmAlarmRings {
+		if dist <= ring.radius {
+			return ring.level
+		}
+	}
+	return 0
+}
+
+func flarmRingLevel(icao uint32, dist float64) uint8 {
+	level := flarmRingLevelAt(dist)
+	if icao == 0 {
+		return level
+	}
+	hysteresis := flarmRingHysteresisDefault
+	if globalSettings.FLARMRingHysteresis > 0 {
+		hysteresis = float64(globalSettings.FLARMRingHysteresis)
+	}
+	st := flarmStates.get(icao)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ringLevel > level && stratuxClock.Since(st.ringSeen) <= flarmPseudoIDTimeout {
+		if held := flarmRingLevelAt(dist - hysteresis); held > level {
+			level = held
+			if level > st.ringLevel {
+				level = st.ringLevel
+			}
+		}
+	}
+	st.ringLevel = level
+	st.ringSeen = stratuxClock.Time
+	return level
+}
+
+/*
+	isFlarmOverheadSeparated() returns true for a target within flarmOverheadRadius horizontally but at least
+		FLARMOverheadSep meters above or below us. Such a target trips the innermost distance ring on every pass although
+		it is safely separated. A target at our own altitude is never de-emphasized.
+*/
+
+const flarmOverheadRadius = 300.0 // meters
+
+func isFlarmOverheadSeparated(dist float64, relativeVertical int16) bool {
+	sep := globalSettings.FLARMOverheadSep
+	if sep <= 0 || dist >= flarmOverheadRadius {
+		return false
+	}
+	return int(relativeVertical) >= sep || int(relativeVertical) <= -sep
+}
+
+/*
+	flarmVerticallyConverging() returns true if the vertical separation to the target (relativeVertical, meters, positive
+		= target above) is closing fast enough to be gone within flarmVerticalConvergenceWindow. A target 500 ft above
+		and descending toward us is more urgent than one level at the same range; one climbing away from us is not.
+*/
+
+const (
+	flarmVerticalConvergenceWindow  = 60.0 // seconds
+	flarmVerticalConvergenceMinRate = 1.0  // m/s (~200 fpm); slower closure is just altitude noise
+)
+
+func flarmVerticallyConverging(relativeVertical int16, ti TrafficInfo) bool {
+	ownClimb := float64(mySituation.GPSVerticalSpeed) * 0.3048 // ft/s to m/s
+	climbRate, ok := flarmClimbRate(ti)
+	if !ok {
+		return false
+	}
+	relativeClimb := float64(climbRate) - ownClimb
+	closure := relativeClimb // target below us: closing when it climbs relative to us
+	if relativeVertical > 0 {
+		closure = -relativeClimb
+	}
+	if closure < flarmVerticalConvergenceMinRate {
+		return false
+	}
+	return math.Abs(float64(relativeVertical))/closure < flarmVerticalConvergenceWindow
+}
+
+/*
+	Plausibility limits. A bit error in a velocity message can report 2000 kt or 20000 fpm; such a target is dropped
+		(speed) or sent without climb rate, and logged, rather than shown with nonsense.
+*/
+
+const (
+	flarmMaxGroundSpeedDefault = 1000  // knots, used when FLARMMaxGroundSpeed is 0
+	flarmMaxVvel               = 10000 // fpm
+)
+
+func flarmMaxGroundSpeed() float64 {
+	if globalSettings.FLARMMaxGroundSpeed > 0 {
+		return float64(globalSettings.FLARMMaxGroundSpeed)
+	}
+	return flarmMaxGroundSpeedDefault
+}
+
+/*
+	flarmVerticalSpeed() is the single source of a target's vertical speed for the FLARM outputs (PFLAA and the GDL90
+		bridge), so the two can't disagree: feet per minute, positive = climbing, with FLARMInvertClimb applied for a
+		source reporting descent as positive. ok is false for no vertical speed or an implausible one. The main GDL90
+		feed doesn't go through here; FLARM settings don't change what other apps show.
+*/
+
+func flarmVerticalSpeed(ti TrafficInfo) (fpm int16, ok bool) {
+	if ti.Vvel == VVEL_UNAVAILABLE || ti.Vvel > flarmMaxVvel || ti.Vvel < -flarmMaxVvel {
+		return 0, false
+	}
+	if globalSettings.FLARMInvertClimb {
+		return -ti.Vvel, true
+	}
+	return ti.Vvel, true
+}
+
+// flarmClimbRate converts the target's vertical speed to the PFLAA ClimbRate, in m/s with positive = climbing.
+func flarmClimbRate(ti TrafficInfo) (climbRate float32, ok bool) {
+	fpm, ok := flarmVerticalSpeed(ti)
+	return float32(fpm) * 0.3048 / 60, ok
+}
+
+/*
+	formatFlarmClimbRate() formats the PFLAA ClimbRate: one decimal by default, whole m/s with FLARMClimbInteger, and
+		without the leading zero (".5", "-.5") with FLARMClimbNoLeadZero, for receivers with strict number parsers.
+		Small negative rates that round to zero come out unsigned, never as "-0" or "-0.0".
+*/
+
+func formatFlarmClimbRate(climbRate float32) string {
+	var s string
+	if globalSettings.FLARMClimbInteger {
+		s = strconv.Itoa(nmeaRound(float64(climbRate)))
+	} else {
+		s = fmt.Sprintf("%.1f", climbRate)
+		if s == "-0.0" {
+			s = "0.0"
+		}
+	}
+	if globalSettings.FLARMClimbNoLeadZero {
+		if strings.HasPrefix(s, "0.") || strings.HasPrefix(s, "-0.") {
+			s = strings.Replace(s, "0.", ".", 1)
+		}
+	}
+	return s
+}
+
+/*
+	Climb rate smoothing. Raw Vvel jumps around by a few hundred fpm from report to report, which makes the EFB's trend
+		arrow flicker. With FLARMClimbSmoothing set, the climb rate of each target is passed through an exponential
+		filter with that time constant. A change larger than flarmClimbSmoothingJump is a real maneuver, not noise, and
+		is passed through unfiltered.
+*/
+
+const flarmClimbSmoothingJump = 7.5 // m/s (~1500 fpm)
+
+func smoothFlarmClimbRate(icao uint32, climbRate float32) float32 {
+	if globalSettings.FLARMClimbSmoothing <= 0 || icao == 0 {
+		return climbRate
+	}
+
+	st := flarmStates.get(icao)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.climbValid || stratuxClock.Since(st.climbSeen) > flarmPseudoIDTimeout ||
+		math.Abs(float64(climbRate-st.climbRate)) > flarmClimbSmoothingJump {
+		st.climbRate = climbRate // new target, or a real maneuver
+		st.climbValid = true
+	} else {
+		dt := stratuxClock.Since(st.climbSeen).Seconds()
+		alpha := 1 - math.Exp(-dt/float64(globalSettings.FLARMClimbSmoothing))
+		st.climbRate += float32(alpha) * (climbRate - st.climbRate)
+	}
+	st.climbSeen = stratuxClock.Time
+	return st.climbRate
+}
+
+/*
+	PFLAU alarm types. EFBs pick the alarm sound by the type, so it says what the alarm is about:
+		flarmAlarmTypeAircraft  an aircraft inside the alarm rings
+		flarmAlarmTypeObstacle  a fixed obstacle inside the alarm rings (isFlarmObstacle())
+		flarmAlarmTypeAdvisory  traffic without a ring alarm, e.g. well above or below us, that will still pass close,
+		                        soon (flarmCollisionCourse()): information only, no collision sound
+		A ring alarm always keeps its level. As in the FLARM data port spec, an advisory goes out with AlarmLevel 0 in
+		PFLAU and PFLAA: EFBs choose the collision sound by the level. Anything else without an alarm is
+		flarmAlarmTypeNone.
+*/
+
+const (
+	flarmAlarmTypeNone     = 0
+	flarmAlarmTypeAircraft = 2
+	flarmAlarmTypeObstacle = 3
+	flarmAlarmTypeAdvisory = 4
+)
+
+func flarmAlarmType(ti TrafficInfo, alarmLevel uint8, distN, distE float64) uint8 {
+	switch {
+	case alarmLevel > 0 && isFlarmObstacle(ti):
+		return flarmAlarmTypeObstacle
+	case alarmLevel > 0:
+		return flarmAlarmTypeAircraft
+	case ti.Speed_valid && flarmCollisionCourse(distN, distE, ti):
+		return flarmAlarmTypeAdvisory
+	}
+	return flarmAlarmTypeNone
+}
+
+/*
+	flarmCollisionCourse() returns true if the target, flying straight on at its current track and speed while we do the
+		same, passes within flarmCollisionMissDistance of us in the next flarmCollisionHorizon. distN / distE is the
+		target position relative to ownship, in meters. Co-track and overtaking traffic closes slowly, so its closest
+		approach is beyond the horizon even when the miss distance is small. Below flarmMinTrackSpeed we count as
+		stationary: on the ground the GPS track is noise or missing altogether, and our motion doesn't matter anyway.
+*/
+
+const (
+	flarmCollisionMissDistance = 500.0 // meters
+	flarmCollisionHorizon      = 60.0  // seconds
+)
+
+func flarmCollisionCourse(distN, distE float64, ti TrafficInfo) bool {
+	const knotsToMps = 0.5144
+	var ownTrack, ownSpeed float64
+	if mySituation.GPSGroundSpeed >= flarmMinTrackSpeed {
+		ownTrack = float64(ownshipTrack()) * math.Pi / 180
+		ownSpeed = mySituation.GPSGroundSpeed * knotsToMps
+	}
+	track := float64(ti.Track) * math.Pi / 180
+	speed := float64(ti.Speed) * knotsToMps
+
+	// Target velocity relative to ownship.
+	vN := speed*math.Cos(track) - ownSpeed*math.Cos(ownTrack)
+	vE := speed*math.Sin(track) - ownSpeed*math.Sin(ownTrack)
+	v2 := vN*vN + vE*vE
+	if v2 == 0 {
+		return false
+	}
+
+	tCPA := -(distN*vN + distE*vE) / v2 // time to closest point of approach
+	if tCPA <= 0 || tCPA > flarmCollisionHorizon {
+		return false // diverging, or too far off to matter yet
+	}
+	missN, missE := distN+vN*tCPA, distE+vE*tCPA
+	return math.Sqrt(missN*missN+missE*missE) < flarmCollisionMissDistance
+}
+
+// flarmClampInt16 truncates meters to an int16 field value, saturating at the ends of the range rather than wrapping.
+func flarmClampInt16(v float64) int16 {
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// flarmMaxRange returns the range (meters) out to which traffic is sent as it is: FLARMMaxRangeNM if set, but never
+// beyond what the int16 PFLAA RelativeNorth / RelativeEast can hold; further traffic is clamped to that. It's what a
+// "$PFLAC,R,RANGE" query is answered with.
+func flarmMaxRange() float64 {
+	max := float64(math.MaxInt16)
+	if nm := globalSettings.FLARMMaxRangeNM; nm > 0 && nm*1852 < max {
+		max = nm * 1852
+	}
+	return max
+}
+
+// flarmPFLAUDistance returns the PFLAU RelativeDistance field: never negative, and at most FLARMPFLAUMaxDist if set.
+func flarmPFLAUDistance(dist float64) int16 {
+	d := flarmClampInt16(dist)
+	if d < 0 {
+		d = 0
+	}
+	if max := globalSettings.FLARMPFLAUMaxDist; max > 0 && int(d) > max {
+		d = int16(max)
+	}
+	return d
+}
+
+// flarmQuantize rounds a relative coordinate (meters) to the nearest multiple of step, staying within the int16 range.
+func flarmQuantize(v int16, step int) int16 {
+	q := nmeaRound(float64(v)/float64(step)) * step
+	if q > math.MaxInt16 {
+		q -= step
+	} else if q < -math.MaxInt16 {
+		q += step
+	}
+	return int16(q)
+}
+
+/*
+	flarmModeCDistance() estimates the distance (meters) to a Mode-C / Mode-S target without position from its signal
+		level. Bearing-less traffic puts this distance in the PFLAA RelativeNorth field, so it is never negative.
+		0 means the signal is too weak to be worth showing.
+*/
+
+var flarmModeCDistances = []struct {
+	signalLevel float64 // dB RSSI; stronger than this ...
+	dist        int16   // ... is assumed to be within this many meters
+}{
+	{-5, 463},    // 0.25 NM
+	{-10, 3704},  // 2.0 NM
+	{-15, 7408},  // 4.0 NM
+	{-18, 11112}, // 6.0 NM
+	{-20, 14816}, // 8.0 NM
+	{-25, 29632}, // 16.0 NM
+}
+
+func flarmModeCDistance(signalLevel float64) int16 {
+	for _, d := range flarmModeCDistances {
+		if signalLevel > d.signalLevel {
+			return d.dist
+		}
+	}
+	return 0
+}
+
+/*
+	makeFlarmTrafficCountString() creates the proprietary Stratux traffic health sentence, sent every cycle with
+		FLARMTrafficSentence set. Like PSTX it is outside the FLARM namespace. All fields are always present; with no
+		traffic they are 0.
+
+		Format: $PSTXT,<ESTargets>,<UATTargets>,<ModeCTargets>,<FLARMTargets>,<Emitted>,<Filtered>*<checksum>
+			<ESTargets>,<UATTargets>,<ModeCTargets>,<FLARMTargets>: current targets (the ones passed to the cycle) by source.
+				Mode-C counts 1090 MHz targets without a position.
+			<Emitted>: PFLAA sent this cycle. <Filtered>: the remaining targets, not sent for whatever reason (filters,
+				target limit, duplicates, throttling).
+*/
+
+func makeFlarmTrafficCountString(targets []TrafficInfo, emitted int) string {
+	var es, uat, modeC, flarm int
+	for _, ti := range targets {
+		switch {
+		case ti.Last_source == TRAFFIC_SOURCE_FLARM:
+			flarm++
+		case ti.Last_source == TRAFFIC_SOURCE_UAT:
+			uat++
+		case !ti.Position_valid:
+			modeC++
+		default:
+			es++
+		}
+	}
+	return nmeaSentence(fmt.Sprintf("PSTXT,%d,%d,%d,%d,%d,%d", es, uat, modeC, flarm, emitted, len(targets)-emitted))
+}
+
+/*
+	makeFlarmSignalString() creates the proprietary per-target signal sentence, sent right after the target's PFLAA with
+		FLARMSignalSentence set, to tell weak reception from targets that were dropped. Kept out of PFLAA, which has no
+		room for it.
+
+		Format: $PSTXS,<ID>,<Signal>,<Source>*<checksum>
+			<ID>: the PFLAA's ID, without any "!CALLSIGN".
+			<Signal>: TrafficInfo.SignalLevel, dB with one decimal (RSSI for 1090ES / UAT, SNR from OGN). Empty if the
+				source reported none.
+			<Source>: ES, UAT or FLARM.
+*/
+
+func makeFlarmSignalString(pflaa string, ti TrafficInfo) string {
+	id := ""
+	if fields := strings.SplitN(strings.TrimPrefix(pflaa, "$"), ",", 8); len(fields) == 8 {
+		id = strings.SplitN(fields[6], "!", 2)[0] // the fields up to the ID are numbers, so this holds for any callsign
+	}
+	signal := ""
+	if ti.SignalLevel != 0 && !math.IsInf(ti.SignalLevel, 0) && !math.IsNaN(ti.SignalLevel) {
+		signal = strconv.FormatFloat(ti.SignalLevel, 'f', 1, 64)
+	}
+	source := "ES"
+	switch ti.Last_source {
+	case TRAFFIC_SOURCE_UAT:
+		source = "UAT"
+	case TRAFFIC_SOURCE_FLARM:
+		source = "FLARM"
+	}
+	return nmeaSentence(fmt.Sprintf("PSTXS,%s,%s,%s", id, signal, source))
+}
+
+/*
+	All clear. When the cycle's highest alarm level drops back to 0 and stays there for flarmAllClearHold, the end of
+		the alarm is logged and, with FLARMClearSentence set, sent as a proprietary sentence so an EFB can announce
+		"traffic clear". The hold debounces a target flapping around an alarm boundary: one clear per alarm episode,
+		not one per flap.
+
+		Format: $PSTXC,<PeakLevel>*<checksum>
+			<PeakLevel>: highest alarm level of the episode that cleared, 1-3.
+*/
+
+const flarmAllClearHold = 3 * time.Second
+
+// flarmAllClear tracks the cycle's highest alarm level and returns the episode's peak level once it has cleared.
+func flarmAllClear(level uint8) (peak uint8, cleared bool) {
+	c := flarmStates
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if level > 0 {
+		if level > c.alarmPeak {
+			c.alarmPeak = level
+		}
+		c.alarmLast = stratuxClock.Time
+		return 0, false
+	}
+	if c.alarmPeak == 0 || stratuxClock.Since(c.alarmLast) < flarmAllClearHold {
+		return 0, false
+	}
+	peak, c.alarmPeak = c.alarmPeak, 0
+	return peak, true
+}
+
+/*
+	makeFlarmStatusString() creates the proprietary Stratux health sentence for wired panel displays. The 'PSTX' talker
+		keeps it clear of the FLARM 'PFLA' namespace, so FLARM-only devices simply ignore it.
+
+		Format: $PSTX,<CPUTemp>,<GPSSatellites>,<GPSFixQuality>,<ESTargets>,<UATTargets>,<FLARMTargets>*<checksum>
+			<CPUTemp>: degrees C, one decimal. Empty until the first valid reading.
+			<GPSSatellites>,<GPSFixQuality>: satellites in solution and GGA fix quality. Empty while no GPS is connected.
+			<ESTargets>,<UATTargets>,<FLARMTargets>: targets currently tracked per source. Empty if the source is disabled.
+*/
+
+func makeFlarmStatusString(flarmTargets int) string {
+	var cpuTemp, sats, fix, es, uat, flarm string
+
+	if isCPUTempValid(globalStatus.CPUTemp) {
+		cpuTemp = fmt.Sprintf("%.1f", globalStatus.CPUTemp)
+	}
+	if globalStatus.GPS_connected {
+		sats = strconv.Itoa(int(mySituation.GPSSatellites))
+		fix = strconv.Itoa(int(mySituation.GPSFixQuality))
 	}
-	msgchan <- msg // TCP output.
+	if globalSettings.ES_Enabled {
+		es = strconv.Itoa(int(globalStatus.ES_traffic_targets_tracking))
+	}
+	if globalSettings.UAT_Enabled {
+		uat = strconv.Itoa(int(globalStatus.UAT_traffic_targets_tracking))
+	}
+	if globalSettings.FLARM_Enabled && ognDecoderIsRunning {
+		flarm = strconv.Itoa(flarmTargets)
+	}
+
+	return nmeaSentence(fmt.Sprintf("PSTX,%s,%s,%s,%s,%s,%s", cpuTemp, sats, fix, es, uat, flarm))
 }
 
 
 /*
 	makeFlarmPFLAAString() creates a NMEA-formatted PFLAA string (FLARM traffic format) with checksum from the referenced
-		traffic object.
+		traffic object. It also returns the alarm level and the (possibly estimated) horizontal distance in meters, which
+		are used to rank targets when the output is limited.
 */
 
-func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
+func makeFlarmPFLAAString(ti TrafficInfo) (msg string, alarmLevel uint8, dist float64, valid bool) {
+	msg, alarmLevel, dist, _, _, valid = makeFlarmPFLAA(ti)
+	return
+}
+
+// makeFlarmPFLAA is makeFlarmPFLAAString() plus the target's PFLAU alarm sentence (empty without an alarm) and the ID
+// sent for it: the address, or the pseudo ID of an address-less target.
+func makeFlarmPFLAA(ti TrafficInfo) (msg string, alarmLevel uint8, dist float64, pflau string, targetID uint32, valid bool) {
 
 	/*	Format: $PFLAA,<AlarmLevel>,<RelativeNorth>,<RelativeEast>,<RelativeVertical>,<IDType>,<ID>,<Track>,<TurnRate>,<GroundSpeed>, <ClimbRate>,<AcftType>*<checksum>
 		            $PFLAA,0,-10687,-22561,-10283,1,A4F2EE,136,0,269,0.0,0*4E
@@ -64,7 +2293,7 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 							3 = alarm, 0-8 seconds to impact
 			<RelativeNorth>,<RelativeEast>,<RelativeVertical> are distances in meters. Decimal integer value. Range: from -32768 to 32767.
 				For traffic without known bearing, assign estimated distance to <RelativeNorth> and leave <RelativeEast> empty
-			<IDType>: 1 = official ICAO 24-bit aircraft address; 2 = stable FLARM ID (chosen by FLARM) 3 = anonymous ID, used if stealth mode is activated.
+			<IDType>: 0 = random ID; 1 = official ICAO 24-bit aircraft address; 2 = stable FLARM ID (chosen by FLARM) 3 = anonymous ID, used if stealth mode is activated.
 			For ADS-B traffic, we'll always pick 1.
 			<ID>: 6-digit hexadecimal value (e.g. “5A77B1”) as configured in the target’s PFLAC,,ID sentence. For ADS-B targets always use reported 24-bit ICAO address.
 				NOTE: Appending "!CALLSIGN" will cause compatible applications to display a callsign or tail number. 
@@ -93,22 +2322,16 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 							F = static object
 	*/
 
-	var idType, checksum uint8
+	var idType uint8
 	var relativeNorth, relativeEast, relativeVertical, groundSpeed int16
 	var climbRate float32
-	var alarmType, alarmLevel uint8
-	var msgPFLAU string
-	var relativeBearing float64
+	var alarmType uint8
+	var relativeBearing string
 	var track, rEast, gSpeed, cRate string
 	var alt_valid bool
 	var track_valid bool
 	var modec_valid bool
-   
-	idType = 1
- 	alarmLevel = 0
-	alarmType = 0
-	modec_valid = false
-   
+
 	// determine distance and bearing to target
 	dist, bearing, distN, distE := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
 
@@ -127,40 +2350,55 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 	
 	if !alt_valid {
 		msg = ""
-		msgPFLAU = ""
 		valid = false
 		if globalSettings.DEBUG {
 			log.Printf("RELEVANT NO Altitude *** icao=%X (%s)\n", ti.Icao_addr, ti.Tail)
 		}			
 		return
 		
-	} else if alt_valid && ti.Position_valid && ti.Speed_valid && isGPSValid() && mySituation.GPSFixQuality > 0 { 		
-		relativeNorth = int16(distN)
-		relativeEast = int16(distE)
+	} else if ti.Position_valid && !isWGS84Datum(ti.Datum) {
+		flagFlarmDatum(ti)
+		valid = false
+		return
+
+	} else if ti.Speed_valid && float64(ti.Speed) > flarmMaxGroundSpeed() {
+		log.Printf("FLARM: dropping target %X (%s): ground speed %d kt is implausible, likely a decode error\n", ti.Icao_addr, ti.Tail, ti.Speed)
+		valid = false
+		return
+
+	} else if alt_valid && ti.Position_valid && ti.Speed_valid && isFlarmGPSValid() { 		
+		relativeNorth = flarmClampInt16(distN)
+		relativeEast = flarmClampInt16(distE)
 		rEast = strconv.Itoa(int(relativeEast))
-		track = strconv.Itoa(int(ti.Track))
+		track = flarmGroundTrack(ti)
 		modec_valid = false
 		
 		if globalSettings.DEBUG {
 			log.Printf("RELEVANT ADSB *** icao=%X (%s), relN=%v, RelE=%v\n", ti.Icao_addr, ti.Tail, relativeNorth, rEast)
 		}			
 		
-	} else if alt_valid && !ti.Position_valid && !ti.Speed_valid && !track_valid && isGPSValid() && mySituation.GPSFixQuality > 0 {
-
-		if (ti.SignalLevel > -5) { // 463 m = 0.25 NM; 
-		relativeNorth = 463
-		} else if (ti.SignalLevel > -10) { // 3704 m = 2.0 NM; 
-		relativeNorth = 3704
-		} else if (ti.SignalLevel > -15) { // 7408 m = 4.0 NM; 
-		relativeNorth = 7408
-		} else if (ti.SignalLevel > -18) { // 11112 m = 6.0 NM; 
-		relativeNorth = 11112
-		} else if (ti.SignalLevel > -20) { // 14816 m = 8.0 NM; 
-		relativeNorth = 14816
-		} else if (ti.SignalLevel > -25) { // 29632 m = 16.0 NM; 
-		relativeNorth = 29632
+	} else if alt_valid && isFlarmRelativeOnly(ti) && isFlarmGPSValid() {
+		// The source gave bearing and distance from us instead of a position.
+		dist = ti.Distance
+		distN = dist * math.Cos(ti.Bearing*math.Pi/180)
+		distE = dist * math.Sin(ti.Bearing*math.Pi/180)
+		relativeNorth = flarmClampInt16(distN)
+		relativeEast = flarmClampInt16(distE)
+		rEast = strconv.Itoa(int(relativeEast))
+		if track_valid {
+			track = flarmGroundTrack(ti)
 		}
-		
+		modec_valid = false
+
+		if globalSettings.DEBUG {
+			log.Printf("RELEVANT RELATIVE *** icao=%X (%s), dist=%.0f, bearing=%.0f\n", ti.Icao_addr, ti.Tail, ti.Distance, ti.Bearing)
+		}
+
+	} else if alt_valid && !ti.Position_valid && (ti.BearingDist_valid || !ti.Speed_valid && !track_valid) && isFlarmGPSValid() {
+		// Mode-C, or a relative bearing without a distance: the bearing-less form with the distance estimated from
+		// the signal strength.
+		relativeNorth = flarmModeCDistance(ti.SignalLevel)
+
 		rEast = ""	
 		dist = float64(relativeNorth)
 		track = ""
@@ -183,15 +2421,28 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 		return			
 	}
 	
-	altf := mySituation.BaroPressureAltitude
-	
-	if !isTempPressValid() { // if no pressure altitude available, use GPS altitude
-		altf = float32(mySituation.GPSAltitudeMSL)
-	} else if strings.Contains(ti.Tail, "F-") { // if FLARM target, use GPS altitude
-		altf = float32(mySituation.GPSAltitudeMSL)
+	if globalSettings.FLARMMaxRangeNM > 0 && dist > flarmMaxRange() {
+		valid = false
+		return
+	}
+
+	// Without an own altitude there is no relative vertical: the field is sent empty, and alarms go by horizontal
+	// distance alone. A Mode-C target has nothing else to go by, so it isn't shown.
+	targetAlt, altf, altKnown := flarmAltitudes(ti)
+	rVert := ""
+	if altKnown {
+		relativeVertical = flarmClampInt16(float64(targetAlt*0.3048 - altf*0.3048)) // convert to meters
+		rVert = strconv.Itoa(int(relativeVertical))
+	} else if modec_valid {
+		valid = false
+		return
+	}
+	pflaaVert := rVert
+	if altKnown && globalSettings.FLARMVerticalAGL && !modec_valid {
+		if agl, ok := flarmRelativeHeightAGL(ti, targetAlt, altf); ok {
+			pflaaVert = strconv.Itoa(int(agl))
+		}
 	}
- 
-	relativeVertical = int16(float32(ti.Alt)*0.3048 - altf*0.3048) // convert to meters
 
 
 	if globalSettings.DEBUG {
@@ -199,10 +2450,10 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 	}	
 	
 	 
-	// check ModeC and range must be between -305m to 305m (+/- 1000ft) 
-	if modec_valid && !InBetween(relativeVertical, -310, 310) {
+	// check ModeC and range must be within the vertical band (default +/- 1000ft)
+	if modec_valid && !flarmModeCInBand(ti.Icao_addr, relativeVertical) {
 		if globalSettings.DEBUG {
-			log.Printf("ModeC *** RelVert is NOT in the range +/- 1000ft, icao=%X (%s), RelVert=%v\n", ti.Icao_addr, ti.Tail, relativeVertical)
+			log.Printf("ModeC *** RelVert is NOT in the vertical band, icao=%X (%s), RelVert=%v\n", ti.Icao_addr, ti.Tail, relativeVertical)
 		}
 		valid=false
 		return
@@ -216,107 +2467,190 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool) {
 	
 	// There's no one setting that will please everyone. Change this if you don't like it.
 
-	//if (dist < 926) && (relativeVertical < 304) && (relativeVertical > -304) { // 926 m = 0.5 NM; 304 = +/-1000ft
-	if (dist < 926) && InBetween(relativeVertical, -304, 304) { // 926 m = 0.5 NM; 304 = +/-1000ft
-		alarmLevel = 3
-		alarmType = 2
-		} else if (dist < 4000) && InBetween(relativeVertical, -304, 304) { // 3704 m = 2.0 NM; 304 = +/-1000ft	
-		alarmLevel = 3
-		alarmType = 2
-		} else if (dist < 8000) && InBetween(relativeVertical, -304, 304) { // 7408 m = 4.0 NM; 304 = +/-1000ft
-		alarmLevel = 2
-		alarmType = 2
-		} else if (dist < 12000) && InBetween(relativeVertical, -304, 304) { // 11112 m = 6.0 NM; 304 = +/-1000ft
-		alarmLevel = 1
-		alarmType = 2
-		} else {
+	alarmLevel = 0
+	if InBetween(relativeVertical, -304, 304) { // 304 = +/-1000ft
+		alarmLevel = flarmRingLevel(ti.Icao_addr, dist)
+	}
+
+	if alarmLevel > 1 && isFlarmOverheadSeparated(dist, relativeVertical) {
+		alarmLevel = 1 // passing over or under us with room to spare; the bearing swings wildly, so don't shout
+	}
+
+	if globalSettings.FLARMConvergingAlarm && alarmLevel > 0 && alarmLevel < 3 && ti.Speed_valid && altKnown && flarmVerticallyConverging(relativeVertical, ti) {
+		alarmLevel++
+	}
+
+	if alarmAllowed := flarmAlarmAllowed(ti); alarmLevel > flarmFirstSeenAlarmFloor && !alarmAllowed {
+		alarmLevel = flarmFirstSeenAlarmFloor // too new to trust; shown, but no alarm yet
+	}
+
+	if globalSettings.FLARMAlarmsDisabled { // formation / airshow mode: show traffic, but never alarm
 		alarmLevel = 0
-		alarmType = 0  
-		}
+	}
+	if isFlarmTestObjectQuiet(ti) {
+		alarmLevel = 0 // a test object we haven't got clear of yet
+	}
+	alarmType = flarmAlarmType(ti, alarmLevel, distN, distE)
+	if alarmType == flarmAlarmTypeAdvisory && (modec_valid || globalSettings.FLARMAlarmsDisabled || isFlarmTestObjectQuiet(ti)) {
+		alarmType = flarmAlarmTypeNone // no course to go by, or kept quiet on purpose
+	}
   
-	if ti.Speed_valid {
-		groundSpeed = int16(float32(ti.Speed) * 0.5144) // convert to m/s
+	if modec_valid {
+		// Bearing-less: the distance in RelativeNorth is all there is. Without a direction a velocity means nothing,
+		// even when the target reports one, so Track, GroundSpeed and ClimbRate stay empty along with RelativeEast.
+		gSpeed = ""
+		cRate = ""
+	} else if ti.Speed_valid && isFlarmStationary(ti) {
+		gSpeed = "" // no velocity vector for a parked aircraft or obstacle
+		cRate = ""
+	} else if ti.Speed_valid {
+		groundSpeed = int16(nmeaRound(float64(ti.Speed) * 0.5144)) // convert to m/s, to the nearest m/s
 		gSpeed = strconv.Itoa(int(groundSpeed))
 		
-		climbRate = float32(ti.Vvel) * 0.3048 / 60 // convert to meters per second, and limit to ±32.7
-		if climbRate > 32.7 {
+		var climbValid bool
+		climbRate, climbValid = flarmClimbRate(ti) // meters per second, positive = climbing
+		climbRate = smoothFlarmClimbRate(ti.Icao_addr, climbRate)
+		if climbRate > 32.7 { // limit to ±32.7
 			climbRate = 32.7
 		} else if climbRate < -32.7 {
 			climbRate = -32.7
-		} 
+		} else if climbRate > -0.05 && climbRate < 0.05 {
+			climbRate = 0 // level: never "-0.0"
+		} else if math.Abs(float64(climbRate)) < globalSettings.FLARMClimbDeadband {
+			climbRate = 0 // vario noise around level flight
+		}
 		//cRate = strconv.FormatFloat(climbRate, 'E', -1, 32)	
-		cRate = fmt.Sprintf("%.1f", climbRate)
+		cRate = formatFlarmClimbRate(climbRate)
+		if !climbValid {
+			if ti.Vvel != VVEL_UNAVAILABLE {
+				log.Printf("FLARM: target %X (%s): climb rate %d fpm is implausible, likely a decode error; not sent\n", ti.Icao_addr, ti.Tail, ti.Vvel)
+			}
+			cRate = ""
+		}
 		
 	} else {
 		gSpeed = ""
 		cRate = ""
 	}
 
-	// Set the FLARM aircraft type based on the ADS-B aircraft categories. 
-	
-	acType := 0
-	switch ti.Emitter_category {
-	case 9:
-		acType = 1 // glider
-	case 7:
-		acType = 3 // rotorcraft
-	case 1:
-		acType = 8 // assume all light aircraft are piston
-	case 2, 3, 4, 5, 6:
-		acType = 9 // assume all heavier aircraft are jets
+	acType := flarmAircraftType(ti)
+
+	flarmID := ti.Icao_addr
+	if flarmID == 0 {
+		// No address decoded. All such targets would share ID 000000, so give each a stable ID of our own choosing (IDType 2).
+		flarmID = flarmPseudoID(ti)
+		idType = 2
+	} else {
+		idType = flarmStableIDType(ti.Icao_addr, flarmSourceIDType(ti))
+	}
+	targetID = flarmID
+
+	var id string
+	switch globalSettings.FLARMOutputProfile {
+	case FLARM_PROFILE_PILOTAWARE:
+		// PilotAware / SkyEcho receivers expect the plain 6-digit ID. We have no turn rate, so that field stays empty.
+		id = flarmIDString(flarmID)
 	default:
-		acType = 0
+		id = flarmIDString(flarmID) + "!" + sanitizeFlarmTail(ti.Tail) // extended message type; might not be compatible with all systems.
 	}
 
-	msg = fmt.Sprintf("PFLAA,%d,%d,%s,%d,%d,%X!%s,%s,,%s,%s,%d", alarmLevel, relativeNorth, rEast, relativeVertical, idType, ti.Icao_addr, ti.Tail, track, gSpeed, cRate, acType) // extended message type; might not be compatible with all systems.
+	if rEast != "" && globalSettings.FLARMPositionStep > 1 {
+		// Display precision only; the alarm level above was computed from the exact position.
+		relativeNorth = flarmQuantize(relativeNorth, globalSettings.FLARMPositionStep)
+		rEast = strconv.Itoa(int(flarmQuantize(relativeEast, globalSettings.FLARMPositionStep)))
+	}
+	if rEast == "" && relativeNorth < 0 {
+		relativeNorth = -relativeNorth // bearing-less: RelativeNorth carries the distance, which is never negative
+	}
+	msg = fmt.Sprintf("PFLAA,%d,%d,%s,%s,%d,%s,%s,,%s,%s,%X", alarmLevel, relativeNorth, rEast, pflaaVert, idType, id, track, gSpeed, cRate, acType)
 
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
+	msg = nmeaSentence(msg)
+	if msg == "" {
+		return // malformed; logged by nmeaSentence()
 	}
-	msg = (fmt.Sprintf("$%s*%02X\r\n", msg, checksum))
 
-// Set the FLARM aircraft ALARM. 
+// Set the FLARM aircraft ALARM. sendFlarmTraffic() sends only the most urgent one of the cycle.
 // syntax: PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,<AlarmType>,<RelativeVertical>,<RelativeDistance>,<ID>
 
-	if alarmLevel > 0 && isGPSValid() && mySituation.GPSFixQuality > 0 && !modec_valid {     
+	if alarmType != flarmAlarmTypeNone && isFlarmGPSValid() && !modec_valid {
 		if globalSettings.DEBUG {
 		   log.Printf("FLARM Alarm: Traffic %X, AlarmType %d, AlarmLevel %d\n", ti.Icao_addr, alarmType, alarmLevel) 
 		}  
 		
-		if ti.Bearing > 180.0 {
-			relativeBearing = ti.Bearing - 360.0 
-		} else if ti.Bearing < -180.0 {
-			relativeBearing = ti.Bearing + 360.0 
-		}    
+		relativeBearing = strconv.Itoa(nmeaRound(flarmPFLAUBearing(ti.Bearing)))
+		if dist < float64(globalSettings.FLARMMinBearingDist) {
+			relativeBearing = "" // so close that position noise swings the bearing around: alarm without a direction
+		}
     
-		msgPFLAU = fmt.Sprintf("PFLAU,1,1,2,1,%d,%d,%d,%d,%d,%X", alarmLevel, int16(relativeBearing), alarmType, relativeVertical, int16(dist), ti.Icao_addr)
- 
-		checksumPFLAU := byte(0x00)
-		for i := range msgPFLAU {
-		checksumPFLAU = checksumPFLAU ^ byte(msgPFLAU[i])
+		// The PFLAA's ID, pseudo ID included, so the EFB can tie the alarm to the target it shows.
+		pflauID := flarmIDString(flarmID)
+		if globalSettings.FLARMPFLAUFullID {
+			pflauID = id
 		}
-		msgPFLAU = (fmt.Sprintf("$%s*%02X\r\n", msgPFLAU, checksumPFLAU))
+		pflau = fmt.Sprintf("PFLAU,1,1,%d,%d,%d,%s,%d,%s,%d,%s", flarmGPSField(), flarmPower(), alarmLevel, relativeBearing, alarmType, rVert, flarmPFLAUDistance(dist), pflauID)
  
-	}	else if isGPSValid() && mySituation.GPSFixQuality > 0 { 
-		msgPFLAU = fmt.Sprintf("PFLAU,1,1,2,1,0,,0,,,")
-		
-		checksumPFLAU := byte(0x00)
-		for i := range msgPFLAU {
-		checksumPFLAU = checksumPFLAU ^ byte(msgPFLAU[i])
-		}
-		msgPFLAU = (fmt.Sprintf("$%s*%02X\r\n", msgPFLAU, checksumPFLAU))
-	}  
-    
-  sendNetFLARM(msgPFLAU)
-  
-	if globalSettings.DEBUG {
-		  log.Printf(msgPFLAU) 
-	}	
+		pflau = nmeaSentence(pflau)
+	}
 
 	valid = true
 	return
 }
 
+/*
+	nmeaTime() formats the GPRMC / GPGGA UTC time field, hhmmss.ss, or hhmmss with FLARMWholeSeconds for parsers that
+		choke on the decimals. The time is rounded to the centisecond first and whole seconds are cut from that, so a
+		fix at 12:34:59.996 is 123500.00 or 123500, never 123460.00.
+*/
+
+func nmeaTime(secondsSinceMidnight float64) string {
+	cs := int64(math.Floor(secondsSinceMidnight*100+0.5)) % (24 * 3600 * 100)
+	hms := fmt.Sprintf("%02d%02d%02d", cs/360000, cs/6000%60, cs/100%60)
+	if globalSettings.FLARMWholeSeconds {
+		return hms
+	}
+	return fmt.Sprintf("%s.%02d", hms, cs%100)
+}
+
+/*
+	nmeaLatLng() converts a position in decimal degrees to the NMEA ddmm.mmm / dddmm.mmm fields and their hemisphere
+		letters. precision is the number of decimal places on the minutes, 3 to 6; 0 selects the default of 5.
+*/
+
+func nmeaLatLng(lat, lng float64, precision int) (latField, ns, lngField, ew string) {
+	if precision == 0 {
+		precision = 5
+	} else if precision < 3 {
+		precision = 3
+	} else if precision > 6 {
+		precision = 6
+	}
+
+	ns = "N"
+	if lat < 0 {
+		lat = -lat
+		ns = "S"
+	}
+	ew = "E"
+	if lng < 0 {
+		lng = -lng
+		ew = "W"
+	}
+
+	return nmeaCoordinate(lat, 2, precision), ns, nmeaCoordinate(lng, 3, precision), ew
+}
+
+// nmeaCoordinate formats a non-negative coordinate as zero-padded degrees followed by minutes with precision decimals.
+func nmeaCoordinate(coord float64, degreeDigits, precision int) string {
+	scale := math.Pow(10, float64(precision))
+	deg := math.Floor(coord)
+	min := math.Floor((coord-deg)*60*scale+0.5) / scale
+	if min >= 60 { // rounding 59.9999... up must carry into the degrees, or the field reads e.g. 4760.000
+		deg++
+		min -= 60
+	}
+	return fmt.Sprintf("%0*.f%0*.*f", degreeDigits, deg, precision+3, precision, min)
+}
+
 /*
 	makeGPRMCString() creates a NMEA-formatted GPRMC string (GPS recommended minimum data) with checksum from the current GPS position.
 		If current position is invalid, the GPRMC string will indicate no-fix.
@@ -355,70 +2689,299 @@ func makeGPRMCString() string {
 		GPSLastGroundTrackTime     time.Time
 	*/
 
-	lastFix := float64(mySituation.GPSLastFixSinceMidnightUTC)
-	hr := math.Floor(lastFix / 3600)
-	lastFix -= 3600 * hr
-	mins := math.Floor(lastFix / 60)
-	sec := lastFix - mins*60
+	situation, valid, _ := flarmGPSSituation()
+	fixTime := nmeaTime(float64(situation.GPSLastFixSinceMidnightUTC))
+
+	status := "V"
+	if valid && situation.GPSFixQuality > 0 {
+		status = "A"
+	}
+
+	lat, ns, lng, ew := nmeaLatLng(float64(situation.GPSLatitude), float64(situation.GPSLongitude), globalSettings.FLARMLatLngPrecision)
+
+	gs := float32(situation.GPSGroundSpeed)
+	trueCourse := float32(situation.GPSTrueCourse)
+	yy, mm, dd := time.Now().UTC().Date()
+	yy = yy % 100
+	var magVar, mvEW string
+	mode := "N" // data not valid
+	if status == "A" { // right after the fix is lost, GPSFixQuality may still hold the last fix's quality
+		switch situation.GPSFixQuality {
+		case 1:
+			mode = "A"
+		case 2:
+			mode = "D"
+		case 6:
+			mode = "E" // dead reckoning through a dropout; GPGGA carries the same fix quality 6
+		}
+	}
+
+	var msg string
+
+	if valid {
+		msg = fmt.Sprintf("GPRMC,%s,%s,%s,%s,%s,%s,%.1f,%.1f,%02d%02d%02d,%s,%s,%s", fixTime, status, lat, ns, lng, ew, gs, trueCourse, dd, mm, yy, magVar, mvEW, mode)
+	} else {
+		msg = fmt.Sprintf("GPRMC,,%s,,,,,,,%02d%02d%02d,%s,%s,%s", status, dd, mm, yy, magVar, mvEW, mode) // return null lat-lng and velocity if Stratux does not have a valid GPS fix
+	}
+	if globalSettings.FLARMNMEA41 {
+		msg += ",V" // NMEA 4.1 navigational status: not provided, as sent by u-blox receivers
+	}
+
+	return nmeaSentence(msg)
+}
+
+/*
+	Test objects. For trying out obstacle alarms without an obstacle database, FLARMTestObjects sets up to
+		flarmMaxTestObjects static objects as "<lat> <lng> <feet MSL>", separated by ";". Each is sent like traffic, as a
+		point obstacle (AcftType F, ID flarmTestObjectID + n) at the given height, and raises an obstacle alarm when
+		approached. An object we start out close to, e.g. one set up on the field Stratux is parked on, stays quiet until
+		we have been flarmTestObjectArmDistance away from it once, so it doesn't alarm on the ground. The height is MSL
+		and compared with our GPS altitude (flarmAltitudes()), not our pressure altitude, so it is right whatever the QNH.
+		Test objects are told from traffic by their Last_source, not their ID, so a real aircraft with such an address
+		is never silenced.
+*/
+
+const (
+	flarmMaxTestObjects        = 16
+	flarmTestObjectID          = 0xFFFFF0
+	flarmTestObjectArmDistance = 1000.0 // meters
+	flarmTestObjectSource      = 0x80   // Last_source of a test object; no receiver uses it
+)
+
+type flarmTestObject struct {
+	lat, lng float32 // degrees
+	alt      int32   // feet MSL
+	armed    bool    // we have been clear of it, so it may alarm
+}
+
+var flarmTestObjectsSetting string // FLARMTestObjects the list was parsed from
+var flarmTestObjectList []flarmTestObject
+var flarmTestObjectMutex sync.Mutex
+
+func parseFlarmTestObjects(setting string) ([]flarmTestObject, error) {
+	var objects []flarmTestObject
+	for _, item := range strings.Split(setting, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		var o flarmTestObject
+		if _, err := fmt.Sscan(item, &o.lat, &o.lng, &o.alt); err != nil {
+			return nil, fmt.Errorf("expected \"<lat> <lng> <feet MSL>\", separated by \";\": %v", err)
+		}
+		if o.lat < -90 || o.lat > 90 || o.lng < -180 || o.lng > 180 {
+			return nil, fmt.Errorf("position out of range: %q", strings.TrimSpace(item))
+		}
+		objects = append(objects, o)
+	}
+	if len(objects) > flarmMaxTestObjects {
+		return nil, fmt.Errorf("%d objects, at most %d", len(objects), flarmMaxTestObjects)
+	}
+	return objects, nil
+}
+
+// flarmTestObjects returns the configured test objects as traffic, arming each one we are clear of.
+func flarmTestObjects() []TrafficInfo {
+	setting := strings.TrimSpace(globalSettings.FLARMTestObjects)
+	flarmTestObjectMutex.Lock()
+	defer flarmTestObjectMutex.Unlock()
+	if setting != flarmTestObjectsSetting {
+		flarmTestObjectList, _ = parseFlarmTestObjects(setting) // rejected by the settings handler already
+		flarmTestObjectsSetting = setting
+	}
 
-	status := "V"
-	if isGPSValid() && mySituation.GPSFixQuality > 0 {
-		status = "A"
+	targets := make([]TrafficInfo, 0, len(flarmTestObjectList))
+	for i := range flarmTestObjectList {
+		o := &flarmTestObjectList[i]
+		ti := TrafficInfo{
+			Icao_addr:        flarmTestObjectID + uint32(i),
+			Tail:             fmt.Sprintf("TEST%d", i+1),
+			Emitter_category: 19, // point obstacle
+			Position_valid:   true,
+			Lat:              o.lat,
+			Lng:              o.lng,
+			Alt:              o.alt,
+			Speed_valid:      true,
+			Vvel:             VVEL_UNAVAILABLE,
+			Last_seen:        stratuxClock.Time,
+			Last_alt:         stratuxClock.Time,
+			Last_source:      flarmTestObjectSource,
+		}
+		if isGPSValid() {
+			ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(o.lat), float64(o.lng))
+			ti.BearingDist_valid = true
+			if ti.Distance > flarmTestObjectArmDistance {
+				o.armed = true
+			}
+		}
+		targets = append(targets, ti)
 	}
+	return targets
+}
 
-	lat := float64(mySituation.GPSLatitude)
-	ns := "N"
-	if lat < 0 {
-		lat = -lat
-		ns = "S"
+// isFlarmTestObjectQuiet reports a test object that mustn't alarm yet.
+func isFlarmTestObjectQuiet(ti TrafficInfo) bool {
+	if ti.Last_source != flarmTestObjectSource || ti.Icao_addr < flarmTestObjectID {
+		return false
 	}
+	flarmTestObjectMutex.Lock()
+	defer flarmTestObjectMutex.Unlock()
+	i := int(ti.Icao_addr - flarmTestObjectID)
+	return i < len(flarmTestObjectList) && !flarmTestObjectList[i].armed
+}
+
+/*
+	GPS simulator for ground testing. With FLARMSimGPS set to "<lat> <lng> <track> <knots> <feet MSL>", GPRMC and
+		GPGGA report a 3D fix moving from that position along the track at that speed (dead reckoning on a flat earth,
+		plenty for a bench test), starting when the setting is applied. The simulated fix lives in a shadow situation
+		used only by the GPS sentence generators: mySituation, the traffic geometry and everything else still see the
+		real GPS. A debug aid; don't leave it set in the air.
+*/
 
-	deg := math.Floor(lat)
-	min := (lat - deg) * 60
-	lat = deg*100 + min
+type flarmSimGPS struct {
+	setting  string // FLARMSimGPS the simulation was started from
+	start    time.Time
+	lat, lng float64 // degrees
+	track    float64 // degrees true
+	speed    float64 // knots
+	alt      float32 // feet MSL
+}
 
-	ew := "E"
-	lng := float64(mySituation.GPSLongitude)
-	if lng < 0 {
-		lng = -lng
-		ew = "W"
+var flarmSim flarmSimGPS
+var flarmSimMutex sync.Mutex
+
+func parseFlarmSimGPS(setting string) (sim flarmSimGPS, err error) {
+	var alt float64
+	if _, err = fmt.Sscan(setting, &sim.lat, &sim.lng, &sim.track, &sim.speed, &alt); err != nil {
+		return sim, fmt.Errorf("expected \"<lat> <lng> <track> <knots> <feet MSL>\": %v", err)
+	}
+	if sim.lat < -90 || sim.lat > 90 || sim.lng < -180 || sim.lng > 180 || sim.speed < 0 {
+		return sim, fmt.Errorf("position or speed out of range")
 	}
+	sim.alt = float32(alt)
+	sim.setting = setting
+	return sim, nil
+}
 
-	deg = math.Floor(lng)
-	min = (lng - deg) * 60
-	lng = deg*100 + min
+// flarmSimulatedSituation returns the simulated fix as of now, or false if the simulator is off.
+func flarmSimulatedSituation() (SituationData, bool) {
+	setting := strings.TrimSpace(globalSettings.FLARMSimGPS)
+	if setting == "" {
+		return SituationData{}, false
+	}
+	flarmSimMutex.Lock()
+	defer flarmSimMutex.Unlock()
+	if flarmSim.setting != setting {
+		sim, err := parseFlarmSimGPS(setting)
+		if err != nil {
+			return SituationData{}, false // rejected by the settings handler already; stay on the real GPS
+		}
+		sim.start = stratuxClock.Time
+		flarmSim = sim
+	}
 
-	gs := float32(mySituation.GPSGroundSpeed)
-	trueCourse := float32(mySituation.GPSTrueCourse)
-	yy, mm, dd := time.Now().UTC().Date()
-	yy = yy % 100
-	var magVar, mvEW string
-	mode := "N"
-	if mySituation.GPSFixQuality == 1 {
-		mode = "A"
-	} else if mySituation.GPSFixQuality == 2 {
-		mode = "D"
+	dist := flarmSim.speed * 1852 / 3600 * stratuxClock.Since(flarmSim.start).Seconds() // meters
+	track := flarmSim.track * math.Pi / 180
+	lat := flarmSim.lat + dist*math.Cos(track)/111320
+	lng := flarmSim.lng + dist*math.Sin(track)/(111320*math.Cos(flarmSim.lat*math.Pi/180))
+
+	now := time.Now().UTC()
+	return SituationData{
+		GPSLatitude:                float32(lat),
+		GPSLongitude:               float32(lng),
+		GPSAltitudeMSL:             flarmSim.alt,
+		GPSFixQuality:              1,
+		GPSSatellites:              8,
+		GPSHDOP:                    1.0,
+		GPSGroundSpeed:             flarmSim.speed,
+		GPSTrueCourse:              float32(flarmSim.track),
+		GPSLastFixSinceMidnightUTC: float32(3600*now.Hour()+60*now.Minute()+now.Second()) + float32(now.Nanosecond())/1e9,
+	}, true
+}
+
+// flarmGPSSituation returns the situation GPRMC / GPGGA report, with whether it is a valid fix and a 2D one.
+func flarmGPSSituation() (situation SituationData, valid, fix2D bool) {
+	if sim, ok := flarmSimulatedSituation(); ok {
+		return sim, true, false
 	}
+	flarmOwnFixMutex.Lock()
+	defer flarmOwnFixMutex.Unlock()
+	return mySituation, isGPSValid() && !flarmOwnFixRejected, isGPSFix2D()
+}
 
-	var msg string
+/*
+	AGL vertical. For low-level flying, how high a target is above its ground compared with how high we are above ours
+		can mean more than the plain altitude difference. With FLARMVerticalAGL set, the PFLAA RelativeVertical is
+		that difference of heights above ground, from the terrain elevation flarmTerrain gives at both positions.
+		Alarms and the PFLAU keep the true vertical separation. Without terrain data at either position (the default
+		flarmTerrain has none; a terrain database can replace it) the PFLAA falls back to the altitude difference.
+*/
 
-	if isGPSValid() {
-		msg = fmt.Sprintf("GPRMC,%02.f%02.f%05.2f,%s,%010.5f,%s,%011.5f,%s,%.1f,%.1f,%02d%02d%02d,%s,%s,%s", hr, mins, sec, status, lat, ns, lng, ew, gs, trueCourse, dd, mm, yy, magVar, mvEW, mode)
-	} else {
-		msg = fmt.Sprintf("GPRMC,,%s,,,,,,,%02d%02d%02d,%s,%s,%s", status, dd, mm, yy, magVar, mvEW, mode) // return null lat-lng and velocity if Stratux does not have a valid GPS fix
+var flarmTerrain = noFlarmTerrain
+
+// noFlarmTerrain is the terrain source without any data. A terrain source returns the elevation in feet MSL.
+func noFlarmTerrain(lat, lng float64) (elevation float32, ok bool) {
+	return 0, false
+}
+
+// flarmRelativeHeightAGL returns the target's height above its terrain minus ours above our terrain, in meters.
+// targetAlt and ownAlt are the altitudes (feet) flarmAltitudes() compares.
+func flarmRelativeHeightAGL(ti TrafficInfo, targetAlt, ownAlt float32) (int16, bool) {
+	if !ti.Position_valid {
+		return 0, false
+	}
+	targetGround, ok := flarmTerrain(float64(ti.Lat), float64(ti.Lng))
+	if !ok {
+		return 0, false
 	}
+	ownGround, ok := flarmTerrain(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude))
+	if !ok {
+		return 0, false
+	}
+	return flarmClampInt16(float64((targetAlt-targetGround)*0.3048 - (ownAlt-ownGround)*0.3048)), true
+}
 
-	var checksum byte
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
+/*
+	flarmBaroAltitudeMSL() converts the pressure altitude (feet) to altitude above MSL (feet) with the QNH set in
+		globalSettings.FLARMQNH, using the ISA pressure-altitude relation. Without a plausible QNH a pressure altitude
+		isn't an MSL altitude, and none is returned.
+*/
+
+func flarmBaroAltitudeMSL() (float32, bool) {
+	qnh := globalSettings.FLARMQNH
+	if !isTempPressValid() || qnh < 900 || qnh > 1100 {
+		return 0, false
+	}
+	const h0 = 145366.45 // feet; pressure altitude = h0 * (1 - (p / 1013.25)^0.190284)
+	palt := float64(mySituation.BaroPressureAltitude)
+	return float32(h0 - math.Pow(1013.25/qnh, 0.190284)*(h0-palt)), true
+}
+
+/*
+	nmeaHDOP() returns the HDOP reported by the receiver. Receivers that only report an accuracy estimate (e.g. UBX
+		without PUBX,00) get an HDOP derived from it, the inverse of the estimate in gps.go.
+*/
+
+func nmeaHDOP(situation SituationData) float32 {
+	if situation.GPSHDOP > 0 {
+		return situation.GPSHDOP
 	}
-	msg = fmt.Sprintf("$%s*%X\r\n", msg, checksum)
-	return msg
+	if situation.GPSHorizontalAccuracy <= 0 || situation.GPSHorizontalAccuracy >= 999999 {
+		return 1.0
+	}
+	hdop := situation.GPSHorizontalAccuracy / 8.0
+	if situation.GPSFixQuality == 2 {
+		hdop = situation.GPSHorizontalAccuracy / 4.0
+	}
+	if hdop < 0.7 {
+		hdop = 0.7
+	}
+	return hdop
 }
 
 /*
 	makeGPGGAstring() creates a NMEA-formatted GPGGA string (GPS fix data) with checksum from the current GPS position.
-		If current position is invalid, the a GPTXT string indicating the error condition will be returned.
+		If current position is invalid, the a GPTXT string indicating the error condition will be returned (a no-fix GPGGA
+		with the XCSoar profile).
 
 		This function is needed by some EFBs to generate traffic targets (for others, GPRMC is sufficient).
 */
@@ -443,61 +3006,39 @@ func makeGPGGAString() string {
 	 diffStation
 	*/
 
-	thisSituation := mySituation
-	lastFix := float64(thisSituation.GPSLastFixSinceMidnightUTC)
-	hr := math.Floor(lastFix / 3600)
-	lastFix -= 3600 * hr
-	mins := math.Floor(lastFix / 60)
-	sec := lastFix - mins*60
-
-	lat := float64(mySituation.GPSLatitude)
-	ns := "N"
-	if lat < 0 {
-		lat = -lat
-		ns = "S"
-	}
-
-	deg := math.Floor(lat)
-	min := (lat - deg) * 60
-	lat = deg*100 + min
-
-	ew := "E"
-	lng := float64(mySituation.GPSLongitude)
-	if lng < 0 {
-		lng = -lng
-		ew = "W"
-	}
+	thisSituation, valid, fix2D := flarmGPSSituation()
+	fixTime := nmeaTime(float64(thisSituation.GPSLastFixSinceMidnightUTC))
 
-	deg = math.Floor(lng)
-	min = (lng - deg) * 60
-	lng = deg*100 + min
+	lat, ns, lng, ew := nmeaLatLng(float64(thisSituation.GPSLatitude), float64(thisSituation.GPSLongitude), globalSettings.FLARMLatLngPrecision)
 
 	numSV := thisSituation.GPSSatellites
-	if numSV > 12 { // standard messages limit satellite count to 12
+	if numSV > 12 && !globalSettings.FLARMGGAAllSats { // standard messages limit satellite count to 12
 		numSV = 12
 	}
 
-	//hdop := float32(thisSituation.Accuracy / 4.0)
-	//if hdop < 0.7 {hdop = 0.7}
-	hdop := 1.0 // hard code for now (testing)
+	hdop := nmeaHDOP(thisSituation)
 
-	alt := thisSituation.GPSAltitudeMSL / 3.28084
-	geoidSep := thisSituation.GPSGeoidSep / 3.28084
+	// A 2D fix has no altitude; leave the fields empty rather than repeating whatever GPSAltitudeMSL last held. With a
+	// QNH set, the baro altitude stands in; its geoid separation stays empty since it isn't a GNSS altitude.
+	var alt, geoidSep string
+	if !fix2D {
+		alt = fmt.Sprintf("%.1f", thisSituation.GPSAltitudeMSL/3.28084)
+		geoidSep = fmt.Sprintf("%.1f", thisSituation.GPSGeoidSep/3.28084)
+	} else if baroAlt, ok := flarmBaroAltitudeMSL(); ok {
+		alt = fmt.Sprintf("%.1f", baroAlt/3.28084)
+	}
 
 	var msg string
 
-	if isGPSValid() {
-		msg = fmt.Sprintf("GPGGA,%02.f%02.f%05.2f,%010.5f,%s,%011.5f,%s,%d,%d,%.2f,%.1f,M,%.1f,M,,", hr, mins, sec, lat, ns, lng, ew, thisSituation.GPSFixQuality, numSV, hdop, alt, geoidSep)
+	if valid {
+		msg = fmt.Sprintf("GPGGA,%s,%s,%s,%s,%s,%d,%d,%.2f,%s,M,%s,M,,", fixTime, lat, ns, lng, ew, thisSituation.GPSFixQuality, numSV, hdop, alt, geoidSep)
+	} else if globalSettings.FLARMOutputProfile == FLARM_PROFILE_XCSOAR {
+		msg = "GPGGA,,,,,,0,00,,,M,,M,," // fix quality 0: XCSoar wants a GGA every cycle, fix or not
 	} else {
 		msg = fmt.Sprintf("GPTXT,No valid Stratux GPS position") // return text message type if no position
 	}
 
-	var checksum byte
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
-	}
-	msg = fmt.Sprintf("$%s*%X\r\n", msg, checksum)
-	return msg
+	return nmeaSentence(msg)
 
 }
 
@@ -512,36 +3053,293 @@ http://synflood.at/tmp/golang-slides/mrmcd2012.html#2
 ********/
 
 type tcpClient struct {
-	conn net.Conn
-	ch   chan string
+	conn    net.Conn
+	ch      chan string
+	replies chan string // answers to the client's own sentences; unlike ch never closed, as the reader sends on it
+	logged  bool        // connection and disconnection are logged; false for a client reconnecting within the log window
+	format  clientFormat
+}
+
+/*
+	Client formats. What a client gets is chosen by the port it connected to: the regular ports serve the NMEA stream
+		as set by FLARMOutputProfile, the PFLAA variant ports the same stream with the PFLAA forced to one form (see
+		sendFlarmPFLAAVariants()), and the GDL90 bridge port GDL90 (see sendFlarmGDL90()). A client that connects to a
+		regular port, the usual case, has made no choice and gets the global default.
+*/
+
+type clientFormat int
+
+const (
+	clientFormatDefault clientFormat = iota
+	clientFormatPFLAAPlain
+	clientFormatPFLAAExtended
+	clientFormatGDL90
+)
+
+// clientMessage is a message queued for the TCP server, for the clients taking the stream of its format.
+type clientMessage struct {
+	format clientFormat
+	msg    string
+}
+
+/*
+	Connection logging. Some apps reconnect every few seconds during a WiFi handoff; logging each connect and disconnect
+		would bury everything else. The first connection from a host in a window is logged normally, further ones from
+		the same host are only counted and reported in one summary line once the window has passed. Clients are grouped
+		by IP address since a reconnecting client gets a new source port, while a genuinely new client has its own address.
+*/
+
+const tcpClientLogWindow = time.Minute
+
+type clientLogEntry struct {
+	start      time.Time
+	reconnects int
+}
+
+type clientLogLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	hosts  map[string]*clientLogEntry
+}
+
+var tcpClientLog = newClientLogLimiter(tcpClientLogWindow)
+
+func newClientLogLimiter(window time.Duration) *clientLogLimiter {
+	return &clientLogLimiter{window: window, hosts: make(map[string]*clientLogEntry)}
+}
+
+// connected records a connection from addr and reports whether it should be logged.
+func (l *clientLogLimiter) connected(addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.hosts[host]; ok && stratuxClock.Since(e.start) < l.window {
+		e.reconnects++
+		return false
+	}
+	l.summarize(host)
+	l.hosts[host] = &clientLogEntry{start: stratuxClock.Time}
+	return true
+}
+
+// flush logs the summary for, and forgets, every host whose window has passed.
+func (l *clientLogLimiter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for host, e := range l.hosts {
+		if stratuxClock.Since(e.start) >= l.window {
+			l.summarize(host)
+			delete(l.hosts, host)
+		}
+	}
+}
+
+func (l *clientLogLimiter) summarize(host string) {
+	if e, ok := l.hosts[host]; ok && e.reconnects > 0 {
+		log.Printf("FLARM: client %s reconnected %d times in %.0f s, not logged individually\n", host, e.reconnects, stratuxClock.Since(e.start).Seconds())
+	}
+}
+
+// tcpClientStats tracks how many sentences a registered client accepted or dropped since the last load report.
+type tcpClientStats struct {
+	ch        chan<- string
+	conn      net.Conn
+	format    clientFormat
+	sent      uint32
+	dropped   uint32
+	fullSince time.Time // first drop since the client last took a message; zero while it keeps up
+	stalled   bool      // disconnected by FLARMStallTimeout, waiting for deregistration
+}
+
+const tcpClientBufferSize = 256 // sentences queued per client before further sentences are dropped for that client
+
+var msgchan chan clientMessage
+
+// TCP client load as last reported by handleMessages(). Protected by tcpClientMutex. The count and drop rate are the
+// NMEA clients' only: the GDL90 bridge clients don't change the NMEA throttling.
+var tcpClientMutex sync.Mutex
+var tcpClientCount int
+var tcpGDL90ClientCount int
+var tcpClientDropRate float64
+var tcpClientDroppedTotal uint64
+var tcpQueueDropped uint64
+var tcpPorts []int
+var tcpGDL90Port int
+
+func getTCPClientLoad() (clients int, dropRate float64) {
+	tcpClientMutex.Lock()
+	defer tcpClientMutex.Unlock()
+	return tcpClientCount, tcpClientDropRate
+}
+
+// getFlarmGDL90Clients returns the number of GDL90 bridge clients connected.
+func getFlarmGDL90Clients() int {
+	tcpClientMutex.Lock()
+	defer tcpClientMutex.Unlock()
+	return tcpGDL90ClientCount
+}
+
+// setTCPClientCount publishes a connect or disconnect right away, without waiting for the next load report.
+func setTCPClientCount(nmea, gdl90 int) {
+	tcpClientMutex.Lock()
+	tcpClientCount, tcpGDL90ClientCount = nmea, gdl90
+	tcpClientMutex.Unlock()
 }
 
-var msgchan chan string
+// countTCPClients splits the clients into NMEA clients (every PFLAA variant included) and GDL90 bridge clients.
+func countTCPClients(clients map[net.Conn]*tcpClientStats) (nmea, gdl90 int) {
+	for _, c := range clients {
+		if c.format == clientFormatGDL90 {
+			gdl90++
+		} else {
+			nmea++
+		}
+	}
+	return nmea, gdl90
+}
+
+const flarmTCPPortDefault = 2000 // AIR Connect
+
+/*
+	nmeaServer is the FLARM NMEA TCP server: the listeners, the broadcast loop (handleMessages()) and one goroutine pair
+		per client. shutdown() stops all of them.
+*/
+
+type nmeaServer struct {
+	msgchan   chan clientMessage
+	addchan   chan tcpClient
+	rmchan    chan tcpClient
+	quit      chan struct{}
+	listeners []net.Listener
+	wg        sync.WaitGroup // every goroutine started by the server
+	stopOnce  sync.Once
+}
+
+var tcpServer *nmeaServer
+
+func newNMEAServer(msgchan chan clientMessage) *nmeaServer {
+	s := &nmeaServer{
+		msgchan: msgchan,
+		addchan: make(chan tcpClient),
+		rmchan:  make(chan tcpClient),
+		quit:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.handleMessages()
+	return s
+}
+
+/*
+	tcpNMEAListener() starts the FLARM NMEA TCP server on each of globalSettings.FLARMTCPPorts (port 2000 if none are
+		set). All ports share one broadcast, so every client gets the same stream whichever port it connected to. A port
+		that can't be opened is logged and skipped.
+*/
 
 func tcpNMEAListener() {
-	ln, err := net.Listen("tcp", ":2000")
-	if err != nil {
-		fmt.Println(err)
-		return
+	msgchan = make(chan clientMessage, 1024) // buffered channel n = 1024
+	tcpServer = newNMEAServer(msgchan)
+
+	ports := globalSettings.FLARMTCPPorts
+	if len(ports) == 0 {
+		ports = []int{flarmTCPPortDefault}
+	}
+	if tcpServer.listen(ports) == 0 {
+		log.Printf("FLARM: no TCP port could be opened, TCP NMEA output disabled\n")
+	}
+	for _, p := range []struct {
+		port   int
+		format clientFormat
+	}{
+		{globalSettings.FLARMPlainPFLAAPort, clientFormatPFLAAPlain},
+		{globalSettings.FLARMExtPFLAAPort, clientFormatPFLAAExtended},
+		{globalSettings.FLARMGDL90Port, clientFormatGDL90},
+	} {
+		if p.port != 0 {
+			tcpServer.listenFormat(p.port, p.format)
+		}
+	}
+}
+
+// tcpNMEAShutdown stops the TCP server, if it was started, and disconnects all clients.
+func tcpNMEAShutdown() {
+	if tcpServer != nil {
+		tcpServer.shutdown()
 	}
+}
 
-	msgchan = make(chan string, 1024) // buffered channel n = 1024
-	addchan := make(chan tcpClient)
-	rmchan := make(chan tcpClient)
+// listen opens a listener on each port and returns how many could be opened.
+func (s *nmeaServer) listen(ports []int) int {
+	opened := 0
+	for _, port := range ports {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Printf("FLARM: can't listen on TCP port %d, skipping it: %s\n", port, err)
+			continue
+		}
+		s.listeners = append(s.listeners, ln)
+		opened++
+		tcpClientMutex.Lock()
+		tcpPorts = append(tcpPorts, ln.Addr().(*net.TCPAddr).Port)
+		tcpClientMutex.Unlock()
+		s.wg.Add(1)
+		go s.acceptClients(ln, clientFormatDefault)
+	}
+	return opened
+}
 
-	go handleMessages(msgchan, addchan, rmchan)
+// listenFormat opens a port serving the clients of one format. The listener is the last one in s.listeners.
+func (s *nmeaServer) listenFormat(port int, format clientFormat) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Printf("FLARM: can't listen on TCP port %d: %s\n", port, err)
+		return false
+	}
+	s.listeners = append(s.listeners, ln)
+	if format == clientFormatGDL90 {
+		tcpClientMutex.Lock()
+		tcpGDL90Port = ln.Addr().(*net.TCPAddr).Port
+		tcpClientMutex.Unlock()
+	}
+	s.wg.Add(1)
+	go s.acceptClients(ln, format)
+	return true
+}
 
+func (s *nmeaServer) acceptClients(ln net.Listener, format clientFormat) {
+	defer s.wg.Done()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println(err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("FLARM: TCP accept on %s: %s\n", ln.Addr(), err)
+				continue
+			}
+			return // listener closed
 		}
 
-		go handleConnection(conn, msgchan, addchan, rmchan)
+		s.wg.Add(1)
+		go s.handleConnection(conn, format)
 	}
 }
 
+/*
+	shutdown() closes the listeners and stops handleMessages(), which closes every client channel. That ends each
+		client's WriteLinesFrom(), and with it the connection. A connection accepted while shutting down is closed
+		instead of registered. Returns once all server goroutines have exited.
+*/
+
+func (s *nmeaServer) shutdown() {
+	s.stopOnce.Do(func() {
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+		close(s.quit)
+	})
+	s.wg.Wait()
+}
 
 /*
 func (c tcpClient) ReadLinesInto(ch chan<- string) {
@@ -556,15 +3354,146 @@ func (c tcpClient) ReadLinesInto(ch chan<- string) {
 }
 */
 
-func (c tcpClient) WriteLinesFrom(ch <-chan string) {
-	for msg := range ch {
-		_, err := io.WriteString(c.conn, msg)
-		if err != nil {
+// WriteLinesFrom writes the broadcast stream from ch and the replies to the client's own sentences until ch is closed
+// or the connection fails.
+func (c tcpClient) WriteLinesFrom(ch, replies <-chan string) {
+	for {
+		var msg string
+		var ok bool
+		select {
+		case msg, ok = <-ch:
+			if !ok {
+				return
+			}
+		case msg = <-replies:
+		}
+		if _, err := io.WriteString(c.conn, msg); err != nil {
+			return
+		}
+	}
+}
+
+
+/*
+	Inbound client NMEA. With FLARMReadClientNMEA set, sentences sent by the EFB are read and a few are used, e.g. the
+		heading from $GPHDT, or answered, like the device ID query $PFLAC,R,ID. Our own GPS always wins while it has a usable track; the EFB heading only fills in when we're
+		too slow for the GPS track to mean anything.
+*/
+
+const (
+	flarmClientLineMax        = 256             // longer lines aren't NMEA; stop reading from that client
+	flarmClientReplyQueue     = 8               // replies waiting to be written; more are dropped
+	flarmClientHeadingTimeout = 5 * time.Second // ignore an EFB heading older than this
+	flarmMinTrackSpeed        = 5               // knots; below this the GPS track is noise
+)
+
+var flarmClientMutex sync.Mutex
+var flarmClientHeading float32
+var flarmClientHeadingTime time.Time
+
+// readClientNMEA parses the client's lines until r ends. Replies, e.g. to a PFLAC query, go to replies; a client that
+// isn't reading its stream doesn't get one.
+func readClientNMEA(r io.Reader, replies chan<- string) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, flarmClientLineMax), flarmClientLineMax)
+	for scanner.Scan() {
+		if reply := parseClientNMEA(strings.TrimSpace(scanner.Text())); reply != "" {
+			select {
+			case replies <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// parseClientNMEA handles one inbound line and returns the sentence to answer it with, if any. Anything that isn't a
+// checksummed sentence we use is ignored.
+func parseClientNMEA(line string) (reply string) {
+	if !strings.HasPrefix(line, "$") {
+		return // e.g. the passcode answering "PASS?"
+	}
+	i := strings.LastIndex(line, "*")
+	if i < 0 || nmeaFrame(line[1:i]) != line+"\r\n" {
+		return
+	}
+	x := strings.Split(line[1:i], ",")
+	switch {
+	case len(x[0]) == 5 && x[0][2:] == "HDT": // $--HDT,<heading>,T
+		if len(x) < 3 || x[2] != "T" {
+			return
+		}
+		heading, err := strconv.ParseFloat(x[1], 32)
+		if err != nil || heading < 0 || heading >= 360 {
+			return
+		}
+		flarmClientMutex.Lock()
+		flarmClientHeading = float32(heading)
+		flarmClientHeadingTime = stratuxClock.Time
+		flarmClientMutex.Unlock()
+	case x[0] == "PFLAC": // $PFLAC,R,ID and $PFLAC,R,RANGE. Other configuration items aren't supported and get no answer.
+		if len(x) != 3 || x[1] != "R" {
 			return
 		}
+		switch x[2] {
+		case "ID":
+			return nmeaSentence("PFLAC,A,ID," + flarmIDString(flarmDeviceID()))
+		case "RANGE":
+			return nmeaSentence(fmt.Sprintf("PFLAC,A,RANGE,%d", int(flarmMaxRange())))
+		}
+	}
+	return
+}
+
+/*
+	Device ID, reported to an EFB asking "$PFLAC,R,ID" so it can tell this unit from a co-located real FLARM:
+		FLARMDeviceID if set, otherwise derived from the hardware serial so it stays the same across restarts, and the
+		ownship Mode S code on hardware without a readable serial.
+*/
+
+const flarmCPUInfo = "/proc/cpuinfo"
+
+func flarmDeviceID() uint32 {
+	if id, err := strconv.ParseUint(globalSettings.FLARMDeviceID, 16, 24); err == nil {
+		return uint32(id)
+	}
+	if cpuinfo, err := ioutil.ReadFile(flarmCPUInfo); err == nil {
+		if id, ok := flarmHardwareID(string(cpuinfo)); ok {
+			return id
+		}
+	}
+	id, _ := strconv.ParseUint(globalSettings.OwnshipModeS, 16, 24)
+	return uint32(id)
+}
+
+// flarmHardwareID takes the low 24 bits of the "Serial" line of /proc/cpuinfo (Raspberry Pi). An all-zero serial is
+// no serial.
+func flarmHardwareID(cpuinfo string) (uint32, bool) {
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "Serial" {
+			continue
+		}
+		serial, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 16, 64)
+		if err != nil || serial&0xFFFFFF == 0 {
+			return 0, false
+		}
+		return uint32(serial & 0xFFFFFF), true
 	}
+	return 0, false
 }
 
+// ownshipTrack returns our track in degrees true: the GPS track when moving, otherwise a recent EFB heading if there is one.
+func ownshipTrack() float32 {
+	if isGPSValid() && mySituation.GPSGroundSpeed >= flarmMinTrackSpeed {
+		return mySituation.GPSTrueCourse
+	}
+	flarmClientMutex.Lock()
+	defer flarmClientMutex.Unlock()
+	if !flarmClientHeadingTime.IsZero() && stratuxClock.Since(flarmClientHeadingTime) < flarmClientHeadingTimeout {
+		return flarmClientHeading
+	}
+	return mySituation.GPSTrueCourse
+}
 
 /*
 	func handleConnection().
@@ -574,17 +3503,31 @@ func (c tcpClient) WriteLinesFrom(ch <-chan string) {
 	 2. [Currently ignored since it isn't needed, and because this removes the need to conduct a read] Wait for the client to provide a valid 4-digit code
 	 3. Send acknowledgment "AOK" and add register this connection to send data
 	 4. Upon a client disconnect, deregister the client.
+
+	 With FLARMNoHandshake set, steps 1 and 3 are skipped and the NMEA stream starts right away, for plain NMEA clients
+	 that take "PASS?" / "AOK" for garbage.
 */
 
 
-func handleConnection(c net.Conn, msgchan chan<- string, addchan chan<- tcpClient, rmchan chan<- tcpClient) {
+func (s *nmeaServer) handleConnection(c net.Conn, format clientFormat) {
+	defer s.wg.Done()
 	//bufc := bufio.NewReader(c)
 	defer c.Close()
 	client := tcpClient{
-		conn: c,
-		ch:   make(chan string),
+		conn:    c,
+		ch:      make(chan string, tcpClientBufferSize),
+		replies: make(chan string, flarmClientReplyQueue),
+		logged:  tcpClientLog.connected(c.RemoteAddr()),
+		format:  format,
+	}
+	if format == clientFormatGDL90 {
+		s.serveClient(client) // binary stream: no AIR Connect handshake
+		return
+	}
+	handshake := !globalSettings.FLARMNoHandshake
+	if handshake {
+		io.WriteString(c, "PASS?")
 	}
-	io.WriteString(c, "PASS?")
 
 	// disabling passcode checks. RunwayHD and SkyDemon don't send CR / LF, and PIN check is something else that can go wrong.
 	//time.Sleep(100 * time.Millisecond)
@@ -605,38 +3548,183 @@ func handleConnection(c net.Conn, msgchan chan<- string, addchan chan<- tcpClien
 		log.Printf("Received passcode %s from client %s\n", passcode, c.RemoteAddr())
 	}
 	*/
-	io.WriteString(c, "AOK") // correct passcode received; continue to writes
-	log.Printf("Correct passcode on client %s. Unlocking.\n", c.RemoteAddr())
+	if handshake {
+		io.WriteString(c, "AOK") // correct passcode received; continue to writes
+	}
+	if globalSettings.FLARMConnectPosition {
+		// Ownship right away rather than at the next cycle; queued ahead of anything handleMessages() sends.
+		// Without a fix these are the no-fix forms.
+		client.ch <- makeGPRMCString()
+		client.ch <- makeGPGGAString()
+	}
+	if globalSettings.FLARMConnectReplay && format == clientFormatDefault {
+		for _, msg := range flarmReplaySentences(!globalSettings.FLARMConnectPosition) {
+			select {
+			case client.ch <- msg:
+			default: // more than the client buffer holds; the next cycle brings the rest
+			}
+		}
+	}
+	if client.logged && handshake {
+		log.Printf("Correct passcode on client %s. Unlocking.\n", c.RemoteAddr())
+	}
+	s.serveClient(client)
+}
+
+// serveClient registers the client with handleMessages() and writes its stream until the connection fails.
+func (s *nmeaServer) serveClient(client tcpClient) {
+	c := client.conn
 	// Register user
-	addchan <- client
+	select {
+	case s.addchan <- client:
+	case <-s.quit:
+		return // server is shutting down
+	}
 	defer func() {
-		log.Printf("Connection from %s closed.\n", c.RemoteAddr())
-		rmchan <- client
+		if client.logged {
+			log.Printf("Connection from %s closed.\n", c.RemoteAddr())
+		}
+		select {
+		case s.rmchan <- client:
+		case <-s.quit: // handleMessages() has already dropped all clients
+		}
 	}()
 
 	// I/O
 	//go client.ReadLinesInto(msgchan)  //treating the port as read-only once it's opened
-	client.WriteLinesFrom(client.ch)
+	if globalSettings.FLARMReadClientNMEA && client.format != clientFormatGDL90 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			readClientNMEA(c, client.replies) // ends when the connection is closed
+		}()
+	}
+	client.WriteLinesFrom(client.ch, client.replies)
+}
+
+/*
+	lowestDropRate() returns the drop rate of the best-performing NMEA client since the last call and resets the
+		counters. Using the best client means one stalled tablet can't reduce the output for everybody else. GDL90 bridge
+		clients don't count: the NMEA throttling can't help them, and they shouldn't change what the NMEA clients get.
+*/
+
+func lowestDropRate(clients map[net.Conn]*tcpClientStats) float64 {
+	lowest := 0.0
+	first := true
+	for _, c := range clients {
+		if c.format == clientFormatGDL90 {
+			c.sent, c.dropped = 0, 0
+			continue
+		}
+		rate := 0.0
+		if total := c.sent + c.dropped; total > 0 {
+			rate = float64(c.dropped) / float64(total)
+		}
+		if first || rate < lowest {
+			lowest = rate
+			first = false
+		}
+		c.sent, c.dropped = 0, 0
+	}
+	return lowest
+}
+
+// broadcast queues msg for every client taking it from the stream of the given format.
+func broadcast(clients map[net.Conn]*tcpClientStats, format clientFormat, msg string) {
+	for _, c := range clients {
+		if !c.takes(format, msg) {
+			continue
+		}
+		select {
+		case c.ch <- msg:
+			c.sent++
+			c.fullSince = time.Time{}
+		default:
+			c.dropped++ // client isn't keeping up; drop rather than hold up the others
+			if c.fullSince.IsZero() {
+				c.fullSince = stratuxClock.Time
+			}
+			disconnectIfStalled(c)
+		}
+	}
 }
 
-func handleMessages(msgchan <-chan string, addchan <-chan tcpClient, rmchan <-chan tcpClient) {
-	clients := make(map[net.Conn]chan<- string)
+// takes reports whether the client gets msg from the stream of the given format. The PFLAA variant clients get the
+// regular stream except its PFLAA, which they get from their own.
+func (c *tcpClientStats) takes(format clientFormat, msg string) bool {
+	if format != clientFormatDefault {
+		return c.format == format
+	}
+	switch c.format {
+	case clientFormatDefault:
+		return true
+	case clientFormatPFLAAPlain, clientFormatPFLAAExtended:
+		return !strings.HasPrefix(msg, "$PFLAA,")
+	}
+	return false
+}
+
+/*
+	Stalled clients. A client that connects but never reads keeps its queue full for good. With FLARMStallTimeout
+		set, a client whose queue has stayed full for that long, without taking a single message, is disconnected. A
+		slow client that still drains its queue now and then gets a message through each time, which restarts the clock.
+*/
+
+func disconnectIfStalled(c *tcpClientStats) {
+	timeout := time.Duration(globalSettings.FLARMStallTimeout) * time.Second
+	if timeout <= 0 || c.stalled || stratuxClock.Since(c.fullSince) < timeout {
+		return
+	}
+	log.Printf("FLARM: TCP client %s hasn't read anything for %s, disconnecting\n", c.conn.RemoteAddr(), timeout)
+	c.stalled = true
+	c.conn.Close() // ends the client's writer, which deregisters it
+}
+
+func (s *nmeaServer) handleMessages() {
+	defer s.wg.Done()
+	clients := make(map[net.Conn]*tcpClientStats)
+	loadTimer := time.NewTicker(5 * time.Second)
+	defer loadTimer.Stop()
 
 	for {
 		select {
-		case msg := <-msgchan:
+		case <-s.quit:
+			for conn, c := range clients {
+				close(c.ch)
+				conn.Close() // unblocks a WriteLinesFrom() stuck writing to a client that stopped reading
+				delete(clients, conn)
+			}
+			setTCPClientCount(countTCPClients(clients))
+			return
+		case m := <-s.msgchan:
 			if globalSettings.DEBUG {
-				log.Printf("New message: %s", msg)
+				log.Printf("New message: %s", m.msg)
 			}
-			for _, ch := range clients {
-				go func(mch chan<- string) { mch <- msg }(ch)
+			broadcast(clients, m.format, m.msg)
+		case client := <-s.addchan:
+			if client.logged {
+				log.Printf("New client: %v\n", client.conn)
+			}
+			clients[client.conn] = &tcpClientStats{ch: client.ch, conn: client.conn, format: client.format}
+			setTCPClientCount(countTCPClients(clients))
+		case client := <-s.rmchan:
+			if client.logged {
+				log.Printf("Client disconnects: %v\n", client.conn)
 			}
-		case client := <-addchan:
-			log.Printf("New client: %v\n", client.conn)
-			clients[client.conn] = client.ch
-		case client := <-rmchan:
-			log.Printf("Client disconnects: %v\n", client.conn)
 			delete(clients, client.conn)
+			setTCPClientCount(countTCPClients(clients))
+		case <-loadTimer.C:
+			var dropped uint64
+			for _, c := range clients {
+				dropped += uint64(c.dropped)
+			}
+			dropRate := lowestDropRate(clients)
+			tcpClientMutex.Lock()
+			tcpClientCount, tcpGDL90ClientCount = countTCPClients(clients)
+			tcpClientDropRate = dropRate
+			tcpClientDroppedTotal += dropped
+			tcpClientMutex.Unlock()
+			tcpClientLog.flush()
 		}
 	}
 }
@@ -0,0 +1,3978 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// A stopped clock keeps the GPS and traffic age checks deterministic. Tests advance it by hand.
+	stratuxClock = &monotonic{Time: time.Now()}
+	messageQueue = make(chan networkMessage, 4096)
+	msgchan = make(chan clientMessage, 4096)
+	globalSettings.FLARMEmitPFLAU = true // defaultSettings()
+	os.Exit(m.Run())
+}
+
+// saveFlarmTestState snapshots the globals the FLARM generators read and returns a function restoring them.
+func saveFlarmTestState() func() {
+	settings, status, situation, decoder, clock := globalSettings, globalStatus, mySituation, ognDecoderIsRunning, stratuxClock.Time
+	// Tests move ownship around freely on a stopped clock; start each one without a fix for the jump gate to compare with.
+	flarmLastOwnFix, flarmOwnFixRejected = flarmOwnFix{}, false
+	flarmStates = &flarmStateCache{ttl: flarmStateTTL}
+	flarmLastSentMutex.Lock()
+	flarmLastSent = make(map[string]time.Time) // the clock is rewound at the end of each test
+	flarmLastSentMutex.Unlock()
+	flarmBudget, flarmBudgetLast = 0, time.Time{}
+	flarmTestObjectsSetting, flarmTestObjectList = "", nil
+	flarmReplay = make(map[string]flarmReplayEntry)
+	return func() {
+		flarmLastOwnFix, flarmOwnFixRejected = flarmOwnFix{}, false
+		globalSettings, globalStatus, mySituation, ognDecoderIsRunning = settings, status, situation, decoder
+		stratuxClock.Time = clock
+	}
+}
+
+// setFlarmTestOwnship gives ownship a valid 3D GPS fix at the given position and altitude (feet MSL).
+func setFlarmTestOwnship(lat, lng, alt float32) {
+	globalStatus.GPS_connected = true
+	mySituation.GPSLatitude = lat
+	mySituation.GPSLongitude = lng
+	mySituation.GPSAltitudeMSL = alt
+	mySituation.GPSFixQuality = 1
+	mySituation.GPSSatellites = 8
+	mySituation.GPSLastFixLocalTime = stratuxClock.Time
+}
+
+// flarmTestTarget returns an ADS-B target at the given position and altitude (feet), tracking east at 100 kt.
+func flarmTestTarget(icao uint32, lat, lng float32, alt int32) TrafficInfo {
+	return TrafficInfo{
+		Icao_addr:        icao,
+		Tail:             "N12345",
+		Emitter_category: 1,
+		Position_valid:   true,
+		Lat:              lat,
+		Lng:              lng,
+		Alt:              alt,
+		Track:            90,
+		Speed:            100,
+		Speed_valid:      true,
+		Vvel:             500,
+		Last_source:      TRAFFIC_SOURCE_1090ES,
+	}
+}
+
+// drainFlarmTestOutput returns (and removes) everything queued for the TCP clients so far.
+func drainFlarmTestOutput() []string {
+	var out []string
+	for {
+		select {
+		case m := <-msgchan:
+			if m.format == clientFormatDefault {
+				out = append(out, m.msg)
+			}
+		default:
+			return out
+		}
+	}
+}
+
+// flarmRecorder collects the sentences passed to flarmSink. record is safe for concurrent use.
+type flarmRecorder struct {
+	mu  sync.Mutex
+	out []string
+}
+
+func (r *flarmRecorder) record(msg string) {
+	r.mu.Lock()
+	r.out = append(r.out, msg)
+	r.mu.Unlock()
+}
+
+func (r *flarmRecorder) sentences() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.out...)
+}
+
+// captureFlarmOutput routes all FLARM output to a recorder until the returned function restores the real sink.
+func captureFlarmOutput() (*flarmRecorder, func()) {
+	r := &flarmRecorder{}
+	sink := flarmSink
+	flarmSink = r.record
+	return r, func() { flarmSink = sink }
+}
+
+// nmeaFields splits a sentence into its comma-separated fields, without '$' and checksum.
+func nmeaFields(msg string) []string {
+	msg = strings.TrimPrefix(msg, "$")
+	if i := strings.LastIndex(msg, "*"); i >= 0 {
+		msg = msg[:i]
+	}
+	return strings.Split(msg, ",")
+}
+
+func TestFlarmTrafficDivisorGrowsWithClients(t *testing.T) {
+	if d := flarmTrafficDivisor(1, 0); d != 1 {
+		t.Errorf("single client: divisor %d, expected full rate", d)
+	}
+	if d := flarmTrafficDivisor(flarmThrottleClients, 0); d != 1 {
+		t.Errorf("%d clients: divisor %d, expected full rate", flarmThrottleClients, d)
+	}
+	if d := flarmTrafficDivisor(6, 0); d < 2 {
+		t.Errorf("6 clients: divisor %d, expected throttled output", d)
+	}
+
+	last := 1
+	for clients := 1; clients <= 20; clients++ {
+		d := flarmTrafficDivisor(clients, 0)
+		if d < last {
+			t.Errorf("%d clients: divisor %d dropped below %d", clients, d, last)
+		}
+		if d > flarmThrottleMaxDivisor {
+			t.Errorf("%d clients: divisor %d exceeds limit %d", clients, d, flarmThrottleMaxDivisor)
+		}
+		last = d
+	}
+
+	if flarmTrafficDivisor(2, 0.5) <= flarmTrafficDivisor(2, 0) {
+		t.Errorf("drop rate did not reduce the output rate")
+	}
+}
+
+func TestLowestDropRateIgnoresSlowClient(t *testing.T) {
+	fast, _ := net.Pipe()
+	slow, _ := net.Pipe()
+	clients := map[net.Conn]*tcpClientStats{
+		fast: {sent: 100},
+		slow: {sent: 10, dropped: 90},
+	}
+	if rate := lowestDropRate(clients); rate != 0 {
+		t.Errorf("drop rate %f, expected the fast client's 0", rate)
+	}
+	if clients[slow].dropped != 0 || clients[slow].sent != 0 {
+		t.Errorf("counters not reset")
+	}
+}
+
+func TestFlarmStatusString(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	globalSettings.ES_Enabled = true
+	globalSettings.UAT_Enabled = false
+	globalSettings.FLARM_Enabled = true
+	ognDecoderIsRunning = true
+	globalStatus.CPUTemp = 52.3
+	globalStatus.GPS_connected = true
+	globalStatus.ES_traffic_targets_tracking = 12
+	mySituation.GPSSatellites = 9
+	mySituation.GPSFixQuality = 1
+
+	if msg := makeFlarmStatusString(3); msg != "$PSTX,52.3,9,1,12,,3*2D\r\n" {
+		t.Errorf("unexpected status sentence %q", msg)
+	}
+
+	// Nothing known yet at startup: fields are empty, not zero.
+	globalStatus.CPUTemp = invalidCpuTemp
+	globalStatus.GPS_connected = false
+	globalStatus.ES_traffic_targets_tracking = 0
+	ognDecoderIsRunning = false
+
+	if msg := makeFlarmStatusString(0); msg != "$PSTX,,,,0,,*3F\r\n" {
+		t.Errorf("unexpected startup status sentence %q", msg)
+	}
+}
+
+func TestSelectFlarmTargetsKeepsClosest(t *testing.T) {
+	targets := []flarmTarget{
+		{icao: 0x000001, alarmLevel: 0, dist: 15000},
+		{icao: 0x000002, alarmLevel: 0, dist: 2000},
+		{icao: 0x000003, alarmLevel: 0, dist: 9000},
+		{icao: 0x000004, alarmLevel: 0, dist: 500},
+		{icao: 0x000005, alarmLevel: 0, dist: 30000},
+	}
+
+	selected := selectFlarmTargets(targets, 3)
+	if len(selected) != 3 {
+		t.Fatalf("selected %d targets, expected 3", len(selected))
+	}
+	for i, icao := range []uint32{0x000004, 0x000002, 0x000003} {
+		if selected[i].icao != icao {
+			t.Errorf("position %d: got %06X, expected %06X", i, selected[i].icao, icao)
+		}
+	}
+
+	if n := len(selectFlarmTargets(targets, 0)); n != len(targets) {
+		t.Errorf("no limit selected %d of %d targets", n, len(targets))
+	}
+}
+
+func TestSelectFlarmTargetsPrefersAlarm(t *testing.T) {
+	targets := []flarmTarget{
+		{icao: 0x000001, alarmLevel: 0, dist: 900},
+		{icao: 0x000002, alarmLevel: 2, dist: 7000},
+	}
+	if selected := selectFlarmTargets(targets, 1); selected[0].icao != 0x000002 {
+		t.Errorf("got %06X, expected the alarming target", selected[0].icao)
+	}
+}
+
+func TestFlarmPilotAwareProfile(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	ti := flarmTestTarget(0x0A1B2C, 48.05, 11.0, 3500)
+
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_PILOTAWARE
+	msg, _, _, valid := makeFlarmPFLAAString(ti)
+	if !valid {
+		t.Fatalf("target not emitted")
+	}
+
+	fields := nmeaFields(msg)
+	if len(fields) != 12 || fields[0] != "PFLAA" {
+		t.Fatalf("malformed sentence %q", msg)
+	}
+	expected := map[int]string{
+		5:  "1",      // IDType: ICAO
+		6:  "0A1B2C", // plain 6-digit ID, no callsign
+		7:  "90",     // track
+		8:  "",       // turn rate not available
+		9:  "51",     // 100 kt in m/s
+		10: "2.5",    // 500 fpm in m/s
+		11: "8",      // piston aircraft
+	}
+	for i, want := range expected {
+		if fields[i] != want {
+			t.Errorf("field %d: got %q, expected %q (%q)", i, fields[i], want, msg)
+		}
+	}
+
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_FLARM
+	msg, _, _, _ = makeFlarmPFLAAString(ti)
+	if fields := nmeaFields(msg); !strings.HasSuffix(fields[6], "!N12345") {
+		t.Errorf("FLARM profile ID field %q", fields[6])
+	}
+}
+
+func TestNmeaLatLngPrecision(t *testing.T) {
+	tests := []struct {
+		lat, lng  float64
+		precision int
+		latField  string
+		ns        string
+		lngField  string
+		ew        string
+	}{
+		{48.1173, 11.516666667, 3, "4807.038", "N", "01131.000", "E"},
+		{48.1173, 11.516666667, 5, "4807.03800", "N", "01131.00000", "E"},
+		{48.1173, 11.516666667, 0, "4807.03800", "N", "01131.00000", "E"},
+		{-33.8688, -151.2093, 3, "3352.128", "S", "15112.558", "W"},
+		{47.9999999, 7.9999999, 3, "4800.000", "N", "00800.000", "E"}, // minutes round up into the degrees
+	}
+	for _, test := range tests {
+		latField, ns, lngField, ew := nmeaLatLng(test.lat, test.lng, test.precision)
+		if latField != test.latField || ns != test.ns || lngField != test.lngField || ew != test.ew {
+			t.Errorf("%f,%f precision %d: got %s,%s,%s,%s, expected %s,%s,%s,%s", test.lat, test.lng, test.precision,
+				latField, ns, lngField, ew, test.latField, test.ns, test.lngField, test.ew)
+		}
+	}
+}
+
+func TestGPGGAEmptyAltitudeOn2DFix(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3281)
+	mySituation.GPSGeoidSep = 164
+
+	mySituation.GPSFix2D = true
+	fields := nmeaFields(makeGPGGAString())
+	if fields[0] != "GPGGA" || fields[9] != "" || fields[11] != "" {
+		t.Errorf("2D fix: altitude %q, geoid separation %q, expected empty", fields[9], fields[11])
+	}
+
+	// Transition to 3D takes effect with the next sentence.
+	mySituation.GPSFix2D = false
+	fields = nmeaFields(makeGPGGAString())
+	if fields[9] != "1000.0" || fields[11] != "50.0" {
+		t.Errorf("3D fix: altitude %q, geoid separation %q", fields[9], fields[11])
+	}
+
+	// Three satellites can't produce a 3D solution even if the receiver doesn't say so.
+	mySituation.GPSSatellites = 3
+	if fields = nmeaFields(makeGPGGAString()); fields[9] != "" {
+		t.Errorf("3 satellites: altitude %q, expected empty", fields[9])
+	}
+}
+
+func TestFlarmPseudoIDForAddresslessTargets(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_PILOTAWARE
+
+	idOf := func(ti TrafficInfo) string {
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if !valid {
+			t.Fatalf("target not emitted")
+		}
+		fields := nmeaFields(msg)
+		if fields[5] != "2" {
+			t.Errorf("IDType %q, expected 2", fields[5])
+		}
+		return fields[6]
+	}
+
+	// Two address-less targets about 100 m apart.
+	a := flarmTestTarget(0, 48.02, 11.0, 3500)
+	b := flarmTestTarget(0, 48.02, 11.0013, 3500)
+
+	flarmTrafficCycle++
+	idA, idB := idOf(a), idOf(b)
+	if idA == idB || idA == "000000" || idB == "000000" {
+		t.Fatalf("IDs %s and %s not distinct", idA, idB)
+	}
+
+	for i := 0; i < 5; i++ {
+		flarmTrafficCycle++
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		mySituation.GPSLastFixLocalTime = stratuxClock.Time
+		a.Lat += 0.0002 // ~20 m per cycle
+		b.Lat += 0.0002
+		if id := idOf(b); id != idB {
+			t.Errorf("cycle %d: target B changed ID from %s to %s", i, idB, id)
+		}
+		if id := idOf(a); id != idA {
+			t.Errorf("cycle %d: target A changed ID from %s to %s", i, idA, id)
+		}
+	}
+}
+
+func TestFlarmOwnshipTailSuppression(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	ti := TrafficInfo{Icao_addr: 0x3C4B21, Tail: "D-EABC "}
+	globalSettings.FLARMOwnshipTail = ""
+	if isFlarmOwnshipTail(ti) {
+		t.Errorf("suppressed with no ownship tail configured")
+	}
+
+	globalSettings.FLARMOwnshipTail = "d-eabc"
+	if !isFlarmOwnshipTail(ti) {
+		t.Errorf("target with ownship tail not suppressed")
+	}
+
+	ti.Tail = ""
+	if isFlarmOwnshipTail(ti) {
+		t.Errorf("target without tail suppressed")
+	}
+	ti.Tail = "D-EABD"
+	if isFlarmOwnshipTail(ti) {
+		t.Errorf("target with different tail suppressed")
+	}
+}
+
+func TestFlarmAlarmsDisabled(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	nearby := flarmTestTarget(0x4B1234, 48.003, 11.0, 3100) // ~330 m, 100 ft above: level 3 alarm
+
+	drainFlarmTestOutput()
+	msg, alarmLevel, _, _ := makeFlarmPFLAAString(nearby)
+	if alarmLevel != 3 || nmeaFields(msg)[1] != "3" {
+		t.Fatalf("close target alarm level %d, expected 3", alarmLevel)
+	}
+
+	globalSettings.FLARMAlarmsDisabled = true
+	msg, alarmLevel, _, valid := makeFlarmPFLAAString(nearby)
+	if !valid {
+		t.Fatalf("traffic no longer shown with alarms disabled")
+	}
+	if alarmLevel != 0 || nmeaFields(msg)[1] != "0" {
+		t.Errorf("PFLAA alarm level %d with alarms disabled", alarmLevel)
+	}
+	drainFlarmTestOutput()
+	sendFlarmTraffic([]TrafficInfo{nearby}, true)
+	pflau := 0
+	for _, out := range drainFlarmTestOutput() {
+		if fields := nmeaFields(out); fields[0] == "PFLAU" {
+			pflau++
+			if fields[5] != "0" {
+				t.Errorf("PFLAU alarm with alarms disabled: %q", out)
+			}
+		}
+	}
+	if pflau == 0 {
+		t.Errorf("no idle PFLAU sent")
+	}
+}
+
+func TestFlarmTailEncoding(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	body := "PFLAA,0,100,0,0,1,3C4B21!Müller,,,,,1"
+	var checksum byte
+	for i := 0; i < len(body); i++ {
+		checksum ^= body[i]
+	}
+	if s, expected := nmeaSentence(body), fmt.Sprintf("$%s*%02X\r\n", body, checksum); s != expected {
+		t.Errorf("nmeaSentence(%q) = %q, expected byte-wise checksum %q", body, s, expected)
+	}
+
+	ti := flarmTestTarget(0x3C4B21, 48.05, 11.0, 3500)
+	ti.Tail = "Müller"
+	msg, _, _, valid := makeFlarmPFLAAString(ti)
+	if !valid {
+		t.Fatalf("target with UTF-8 tail not output")
+	}
+	for i := 0; i < len(msg); i++ {
+		if msg[i] > 0x7E {
+			t.Fatalf("non-ASCII byte 0x%02X in %q", msg[i], msg)
+		}
+	}
+	if fields := nmeaFields(msg); !strings.HasSuffix(fields[6], "!Mller") {
+		t.Errorf("PFLAA ID %q, expected sanitized tail \"Mller\"", fields[6])
+	}
+	if body := msg[1:strings.Index(msg, "*")]; nmeaSentence(body) != msg {
+		t.Errorf("bad checksum in %q", msg)
+	}
+}
+
+func TestFlarmModeCBandHysteresis(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	modeC := TrafficInfo{Icao_addr: 0x3C4B22, Alt: 3000, SignalLevel: -3, Last_source: TRAFFIC_SOURCE_1090ES}
+
+	// Climbing target jittering around the 310 m edge: shown once inside, until clearly beyond the band.
+	steps := []struct {
+		altAbove int32 // feet above ownship
+		shown    bool
+	}{
+		{984, true},   // 299 m
+		{1050, true},  // 320 m, inside the hysteresis
+		{1001, true},  // 305 m
+		{1083, true},  // 330 m
+		{1132, false}, // 345 m, beyond band + hysteresis
+		{1050, false}, // 320 m, has to come back inside the band first
+		{1001, true},  // 305 m
+	}
+	for i, step := range steps {
+		modeC.Alt = 3000 + step.altAbove
+		drainFlarmTestOutput()
+		if _, _, _, valid := makeFlarmPFLAAString(modeC); valid != step.shown {
+			t.Errorf("step %d (%d ft above): shown %v, expected %v", i, step.altAbove, valid, step.shown)
+		}
+	}
+
+	globalSettings.FLARMModeCBand = 500
+	modeC.Alt = 3000 + 1312 // 400 m
+	if _, _, _, valid := makeFlarmPFLAAString(modeC); !valid {
+		t.Errorf("target 400 m above not shown with a 500 m band")
+	}
+	drainFlarmTestOutput()
+}
+
+func TestFlarmSkipWithoutConsumers(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	targets := []TrafficInfo{flarmTestTarget(0x3C4B23, 48.05, 11.0, 3500)}
+	setTCPClientCount(0, 0)
+	defer setTCPClientCount(0, 0)
+
+	globalSettings.FLARMSkipIdle = true
+	drainFlarmTestOutput()
+	cycle := flarmTrafficCycle
+	sendFlarmTrafficUpdates(targets)
+	if out := drainFlarmTestOutput(); len(out) > 0 || flarmTrafficCycle != cycle {
+		t.Errorf("output generated with no consumers: %q", out)
+	}
+
+	// A TCP client alone is a consumer.
+	setTCPClientCount(1, 0)
+	sendFlarmTrafficUpdates(targets)
+	if out := drainFlarmTestOutput(); len(out) == 0 {
+		t.Errorf("nothing generated with a TCP client connected")
+	}
+
+	// UDP alone is a consumer too, and gets the stream without any TCP client.
+	setTCPClientCount(0, 0)
+	globalSettings.NetworkFLARM = true
+	for len(messageQueue) > 0 {
+		<-messageQueue
+	}
+	sendFlarmTrafficUpdates(targets)
+	drainFlarmTestOutput()
+	udp := 0
+	for len(messageQueue) > 0 {
+		if m := <-messageQueue; m.msgType == NETWORK_FLARM_NMEA {
+			udp++
+		}
+	}
+	if udp == 0 {
+		t.Errorf("no UDP output with UDP enabled and no TCP clients")
+	}
+}
+
+func TestFlarmClimbRateSmoothing(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMClimbSmoothing = 3
+
+	// Vvel alternating +/-600 fpm (+/-3 m/s) once a second: the smoothed rate stays near zero.
+	var rate float32
+	for i := 0; i < 10; i++ {
+		vvel := float32(600)
+		if i%2 == 1 {
+			vvel = -600
+		}
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		rate = smoothFlarmClimbRate(0x3C4B24, vvel*0.3048/60)
+	}
+	if rate > 1.5 || rate < -1.5 {
+		t.Errorf("alternating climb rate smoothed to %.1f m/s, expected within +/-1.5", rate)
+	}
+
+	// A pull-up to 3000 fpm (15 m/s) comes through without lag.
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if rate = smoothFlarmClimbRate(0x3C4B24, 3000*0.3048/60); rate < 15 {
+		t.Errorf("rapid climb smoothed to %.1f m/s, expected ~15.2", rate)
+	}
+
+	globalSettings.FLARMClimbSmoothing = 0
+	if rate = smoothFlarmClimbRate(0x3C4B24, -2); rate != -2 {
+		t.Errorf("climb rate %.1f with smoothing off, expected -2", rate)
+	}
+}
+
+func TestFlarmGPSOnly(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	targets := []TrafficInfo{flarmTestTarget(0x3C4B25, 48.003, 11.0, 3100)}
+	globalSettings.FLARMGPSOnly = true
+
+	for _, idlePFLAU := range []bool{false, true} {
+		globalSettings.FLARMGPSOnlyPFLAU = idlePFLAU
+		drainFlarmTestOutput()
+		sendFlarmTrafficUpdates(targets)
+		sentences := make(map[string]int)
+		for _, out := range drainFlarmTestOutput() {
+			sentences[nmeaFields(out)[0]]++
+		}
+		if sentences["PFLAA"] > 0 {
+			t.Errorf("PFLAA sent in GPS-only mode")
+		}
+		if sentences["GPRMC"] != 1 || sentences["GPGGA"] != 1 {
+			t.Errorf("GPS sentences %v, expected one GPRMC and one GPGGA", sentences)
+		}
+		if expected := map[bool]int{false: 0, true: 1}[idlePFLAU]; sentences["PFLAU"] != expected {
+			t.Errorf("idle PFLAU option %v: %d PFLAU sent, expected %d", idlePFLAU, sentences["PFLAU"], expected)
+		}
+	}
+}
+
+func TestFlarmCollisionCourseAlarmType(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSTrueCourse = 0
+	mySituation.GPSGroundSpeed = 100
+
+	headOn := flarmTestTarget(0x3C4B26, 48.027, 11.0, 3100) // 3 km ahead, opposite direction
+	headOn.Track, headOn.Speed = 180, 100
+	overtaking := flarmTestTarget(0x3C4B27, 47.973, 11.0, 3100) // 3 km behind, 50 kt faster
+	overtaking.Track, overtaking.Speed = 0, 150
+	headOnAbove, overtakingAbove := headOn, overtaking // 1500 ft above: outside the alarm band
+	headOnAbove.Alt, overtakingAbove.Alt = 4500, 4500
+
+	tests := []struct {
+		name       string
+		ti         TrafficInfo
+		alarmLevel uint8
+		alarmType  string
+	}{
+		{"head-on", headOn, 3, "2"},
+		{"overtaking", overtaking, 3, "2"}, // inside the rings: the ring alarm, whatever the course
+		{"head-on, above", headOnAbove, 0, "4"},
+		{"overtaking, above", overtakingAbove, 0, ""},
+	}
+	for _, tt := range tests {
+		_, alarmLevel, _, pflau, _, _ := makeFlarmPFLAA(tt.ti)
+		if alarmLevel != tt.alarmLevel {
+			t.Errorf("%s: alarm level %d, expected %d", tt.name, alarmLevel, tt.alarmLevel)
+		}
+		if tt.alarmType == "" {
+			if pflau != "" {
+				t.Errorf("%s: PFLAU %q, expected none", tt.name, pflau)
+			}
+		} else if pflau == "" {
+			t.Errorf("%s: no PFLAU alarm", tt.name)
+		} else if fields := nmeaFields(pflau); fields[5] != strconv.Itoa(int(tt.alarmLevel)) || fields[7] != tt.alarmType {
+			t.Errorf("%s: PFLAU alarm level %s type %s, expected %d and %s: %q", tt.name, fields[5], fields[7], tt.alarmLevel, tt.alarmType, pflau)
+		}
+	}
+}
+
+func TestFlarmClientHeading(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSTrueCourse = 90
+	mySituation.GPSGroundSpeed = 2 // taxiing: GPS track unusable
+
+	input := "6000\r\n" + // passcode
+		"$GPHDT,bogus*00\r\n" +
+		"$GPHDT,123.4,T*00\r\n" + // bad checksum
+		"$GPHDT,,,,\r\n" +
+		strings.TrimSpace(nmeaSentence("GPHDT,271.5,T")) + "\r\n"
+	readClientNMEA(strings.NewReader(input), nil)
+	if track := ownshipTrack(); track != 271.5 {
+		t.Errorf("track %.1f at low speed, expected EFB heading 271.5", track)
+	}
+
+	// Malformed or oversize input never replaces the heading.
+	readClientNMEA(strings.NewReader("$GPHDT,400.0,T*00\r\n"+strings.Repeat("$", 1000)), nil)
+	if track := ownshipTrack(); track != 271.5 {
+		t.Errorf("track %.1f after malformed input, expected 271.5", track)
+	}
+
+	mySituation.GPSGroundSpeed = 90
+	if track := ownshipTrack(); track != 90 {
+		t.Errorf("track %.1f while moving, expected GPS track 90", track)
+	}
+
+	mySituation.GPSGroundSpeed = 2
+	stratuxClock.Time = stratuxClock.Time.Add(flarmClientHeadingTimeout)
+	if track := ownshipTrack(); track != 90 {
+		t.Errorf("track %.1f with stale EFB heading, expected GPS track 90", track)
+	}
+}
+
+func TestFlarmBearinglessDistanceNonNegative(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	for signal := 5.0; signal >= -30; signal -= 2.5 {
+		modeC := TrafficInfo{Icao_addr: 0x3C4B28, Alt: 3100, SignalLevel: signal, Last_source: TRAFFIC_SOURCE_1090ES}
+		msg, _, dist, valid := makeFlarmPFLAAString(modeC)
+		drainFlarmTestOutput()
+		if expected := flarmModeCDistance(signal); !valid || expected == 0 {
+			if valid != (expected > 0) {
+				t.Errorf("signal %.1f dB: valid %v, estimated distance %d", signal, valid, expected)
+			}
+			continue
+		}
+		fields := nmeaFields(msg)
+		if fields[3] != "" {
+			t.Errorf("signal %.1f dB: bearing-less target has RelativeEast %q", signal, fields[3])
+		}
+		if north, err := strconv.Atoi(fields[2]); err != nil || north <= 0 || float64(north) != dist {
+			t.Errorf("signal %.1f dB: RelativeNorth %q, expected distance %.0f", signal, fields[2], dist)
+		}
+	}
+}
+
+func TestFlarmSinkCapturesCycle(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	drainFlarmTestOutput()
+	sendFlarmTrafficUpdates([]TrafficInfo{
+		flarmTestTarget(0x3C4B29, 48.003, 11.0, 3100),
+		flarmTestTarget(0x3C4B2A, 48.05, 11.0, 3500),
+	})
+	if out := drainFlarmTestOutput(); len(out) > 0 {
+		t.Errorf("%d sentences reached the TCP channel with a capture sink installed", len(out))
+	}
+
+	var kinds []string
+	for _, out := range rec.sentences() {
+		kinds = append(kinds, nmeaFields(out)[0])
+	}
+	if expected := "GPRMC,GPGGA,PFLAU,PFLAA,PFLAA"; strings.Join(kinds, ",") != expected {
+		t.Errorf("cycle emitted %v, expected %s", kinds, expected)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendNetFLARM(nmeaSentence("PSTX,,,,,,"))
+		}()
+	}
+	wg.Wait()
+	if n := len(rec.sentences()); n != len(kinds)+8 {
+		t.Errorf("%d sentences recorded after concurrent sends, expected %d", n, len(kinds)+8)
+	}
+}
+
+func TestFlarmGroundSpeedRounding(t *testing.T) {
+	tests := []struct {
+		x        float64
+		expected int
+	}{
+		{2.49, 2},
+		{2.5, 3},
+		{-2.5, -3},
+		{0.514, 1}, // 1 kt: truncation would report a stationary target
+	}
+	for _, tt := range tests {
+		if r := nmeaRound(tt.x); r != tt.expected {
+			t.Errorf("nmeaRound(%v) = %d, expected %d", tt.x, r, tt.expected)
+		}
+	}
+
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	for knots, mps := range map[uint16]string{1: "1", 3: "2", 10: "5", 100: "51"} {
+		ti := flarmTestTarget(0x3C4B2B, 48.05, 11.0, 3500)
+		ti.Speed = knots
+		msg, _, _, _ := makeFlarmPFLAAString(ti)
+		drainFlarmTestOutput()
+		if gs := nmeaFields(msg)[9]; gs != mps {
+			t.Errorf("%d kt reported as %s m/s, expected %s", knots, gs, mps)
+		}
+	}
+}
+
+func TestFlarmMultipleTCPPorts(t *testing.T) {
+	// One port already taken: it's skipped, the others still serve the broadcast.
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	msgs := make(chan clientMessage, 16)
+	server := newNMEAServer(msgs)
+	defer server.shutdown()
+
+	if opened := server.listen([]int{0, busyPort, 0}); opened != 2 {
+		t.Fatalf("%d listeners started, expected 2", opened)
+	}
+	var clients []net.Conn
+	for _, ln := range server.listeners {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %s: %v", ln.Addr(), err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		handshake := make([]byte, len("PASS?AOK"))
+		if _, err := io.ReadFull(c, handshake); err != nil {
+			t.Fatalf("handshake on %s: %v", ln.Addr(), err)
+		}
+		clients = append(clients, c)
+	}
+
+	for i := 0; i < 200; i++ { // registration with handleMessages is asynchronous
+		if n, _ := getTCPClientLoad(); n == len(clients) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sentence := nmeaSentence("PSTX,,,,,,")
+	msgs <- clientMessage{msg: sentence}
+	for i, c := range clients {
+		got := make([]byte, len(sentence))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != sentence {
+			t.Errorf("listener %d: received %q (%v), expected %q", i, got, err, sentence)
+		}
+	}
+}
+
+func TestFlarmAirborneOnly(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(47.0, 10.0, 5000) // parked on a high field
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_PILOTAWARE
+	globalSettings.FLARMAirborneOnly = true
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	taxiing := flarmTestTarget(0x3C4B2C, 47.01, 10.0, 5000) // same field, looks airborne by MSL altitude
+	taxiing.Speed = 15
+	airborne := flarmTestTarget(0x3C4B2D, 47.02, 10.0, 5800)
+	flagged := flarmTestTarget(0x3C4B2E, 47.02, 10.01, 5800)
+	flagged.OnGround = true
+	stopped := flarmTestTarget(0x3C4B2F, 47.02, 10.02, 5800)
+	stopped.Speed = 0
+
+	sendFlarmTrafficUpdates([]TrafficInfo{taxiing, airborne, flagged, stopped})
+	var ids []string
+	for _, out := range rec.sentences() {
+		if fields := nmeaFields(out); fields[0] == "PFLAA" {
+			ids = append(ids, fields[6])
+		}
+	}
+	if len(ids) != 1 || ids[0] != "3C4B2D" {
+		t.Errorf("PFLAA for %v, expected only the airborne target 3C4B2D", ids)
+	}
+
+	// Once we're flying, our altitude says nothing about the field elevation: moving targets not flagged on ground are shown.
+	mySituation.GPSGroundSpeed = 90
+	if !isFlarmAirborne(taxiing) {
+		t.Errorf("moving target not flagged on ground filtered while airborne ourselves")
+	}
+}
+
+func TestGPGGAPrefersReceiverHDOP(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSHorizontalAccuracy = 12 // derived HDOP would be 1.5
+
+	mySituation.GPSHDOP = 0.9
+	if hdop := nmeaFields(makeGPGGAString())[8]; hdop != "0.90" {
+		t.Errorf("GPGGA HDOP %s, expected receiver HDOP 0.90", hdop)
+	}
+
+	mySituation.GPSHDOP = 0 // receiver reports accuracy only
+	if hdop := nmeaFields(makeGPGGAString())[8]; hdop != "1.50" {
+		t.Errorf("GPGGA HDOP %s, expected 1.50 derived from accuracy", hdop)
+	}
+}
+
+func TestNMEAServerShutdownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	server := newNMEAServer(make(chan clientMessage, 16))
+	if server.listen([]int{0}) != 1 {
+		t.Fatalf("listen failed")
+	}
+	addr := server.listeners[0].Addr().String()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	for i := 0; i < 200; i++ {
+		if n, _ := getTCPClientLoad(); n == len(conns) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A connection arriving while the server shuts down must not be left behind either.
+	go net.Dial("tcp", addr)
+	server.shutdown()
+
+	// The server closes its side; reading the handshake then hits EOF on every client.
+	for i, c := range conns {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.Copy(ioutil.Discard, c); err != nil {
+			t.Errorf("client %d not disconnected: %v", i, err)
+		}
+	}
+
+	var after int
+	for i := 0; i < 200; i++ {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%d goroutines before the server started, %d after shutdown", before, after)
+}
+
+func TestFlarmClimbRateSign(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	tests := []struct {
+		vvel     int16 // fpm
+		expected string
+		inverted string
+	}{
+		{1000, "5.1", "-5.1"},  // climbing
+		{-1000, "-5.1", "5.1"}, // descending
+		{0, "0.0", "0.0"},      // level, never "-0.0"
+		{-5, "0.0", "0.0"},
+	}
+	for _, invert := range []bool{false, true} {
+		globalSettings.FLARMInvertClimb = invert
+		for _, tt := range tests {
+			ti := flarmTestTarget(0x3C4B30, 48.05, 11.0, 3500)
+			ti.Vvel = tt.vvel
+			msg, _, _, _ := makeFlarmPFLAAString(ti)
+			drainFlarmTestOutput()
+			expected := tt.expected
+			if invert {
+				expected = tt.inverted
+			}
+			if climb := nmeaFields(msg)[10]; climb != expected {
+				t.Errorf("Vvel %d fpm (inverted %v): ClimbRate %s, expected %s", tt.vvel, invert, climb, expected)
+			}
+		}
+	}
+}
+
+func TestFlarmClimbDeadband(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMClimbDeadband = 0.3 // m/s, ~60 fpm
+
+	tests := []struct {
+		vvel     int16 // fpm
+		expected string
+	}{
+		{40, "0.0"},  // 0.2 m/s: noise
+		{-40, "0.0"}, // never "-0.0" either
+		{59, "0.0"},
+		{70, "0.4"},   // 0.36 m/s: a genuine slow climb
+		{-70, "-0.4"}, // and a slow sink
+		{1000, "5.1"},
+	}
+	for _, tt := range tests {
+		ti := flarmTestTarget(0x3C4B31, 48.05, 11.0, 3500)
+		ti.Vvel = tt.vvel
+		msg, _, _, _ := makeFlarmPFLAAString(ti)
+		drainFlarmTestOutput()
+		if climb := nmeaFields(msg)[10]; climb != tt.expected {
+			t.Errorf("Vvel %d fpm, deadband 0.3 m/s: ClimbRate %s, expected %s", tt.vvel, climb, tt.expected)
+		}
+	}
+}
+
+func TestFlarmStatusAfterCycle(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.NetworkFLARM = true
+	_, restore := captureFlarmOutput()
+	defer restore()
+
+	flarmLastSentMutex.Lock()
+	flarmLastSent = make(map[string]time.Time)
+	flarmLastSentMutex.Unlock()
+	if status := flarmStatus(); len(status.LastSent) != 0 || !status.UDPEnabled {
+		t.Errorf("status before any output: %+v", status)
+	}
+
+	sendFlarmTrafficUpdates([]TrafficInfo{flarmTestTarget(0x3C4B31, 48.003, 11.0, 3100)})
+	status := flarmStatus()
+	for _, talker := range []string{"GPRMC", "GPGGA", "PFLAU", "PFLAA"} {
+		if last, ok := status.LastSent[talker]; !ok || !last.Equal(stratuxClock.Time) {
+			t.Errorf("%s last sent %v, expected %v", talker, last, stratuxClock.Time)
+		}
+	}
+	if status.TrafficDivisor != 1 {
+		t.Errorf("traffic divisor %d, expected 1", status.TrafficDivisor)
+	}
+}
+
+func TestFlarmDeadReckoning(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMDeadReckoning = true
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	ti := flarmTestTarget(0x3C4B32, 48.02, 11.0, 3500)
+	ti.Track, ti.Speed = 0, 100 // north, 51.4 m/s
+
+	relativeNorth := func(age float64) int {
+		ti.Age = age
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{ti})
+		for _, out := range rec.sentences()[before:] {
+			if fields := nmeaFields(out); fields[0] == "PFLAA" {
+				north, _ := strconv.Atoi(fields[2])
+				return north
+			}
+		}
+		t.Fatalf("no PFLAA at age %.1f s", age)
+		return 0
+	}
+
+	reported := relativeNorth(0)
+	if between := relativeNorth(0.5); between-reported < 24 || between-reported > 28 {
+		t.Errorf("0.5 s after the report: %d m north, expected ~26 m beyond %d", between, reported)
+	}
+	limit := relativeNorth(flarmDeadReckoningLimit)
+	if stale := relativeNorth(flarmDeadReckoningLimit + 2); stale != limit {
+		t.Errorf("stale target moved on to %d m north, expected DR to stop at %d", stale, limit)
+	}
+}
+
+func TestFlarmImplausibleVelocity(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	fast := flarmTestTarget(0x3C4B33, 48.05, 11.0, 3500)
+	fast.Speed = 2000
+	if _, _, _, valid := makeFlarmPFLAAString(fast); valid {
+		t.Errorf("target at 2000 kt sent")
+	}
+	if !strings.Contains(logged.String(), "2000 kt is implausible") {
+		t.Errorf("no reason logged for 2000 kt: %q", logged.String())
+	}
+
+	globalSettings.FLARMMaxGroundSpeed = 2500
+	if _, _, _, valid := makeFlarmPFLAAString(fast); !valid {
+		t.Errorf("target at 2000 kt dropped with a 2500 kt ceiling")
+	}
+
+	logged.Reset()
+	climber := flarmTestTarget(0x3C4B34, 48.05, 11.0, 3500)
+	climber.Vvel = -20000
+	msg, _, _, valid := makeFlarmPFLAAString(climber)
+	if !valid || nmeaFields(msg)[10] != "" {
+		t.Errorf("target descending at 20000 fpm: valid %v, sentence %q; expected sent without climb rate", valid, msg)
+	}
+	if !strings.Contains(logged.String(), "-20000 fpm is implausible") {
+		t.Errorf("no reason logged for -20000 fpm: %q", logged.String())
+	}
+	drainFlarmTestOutput()
+}
+
+func TestFlarmPositionQuantization(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	ti := flarmTestTarget(0x3C4B35, 48.06835, 11.0013, 3100) // ~7600 m north, ~97 m east: alarm level 2 (< 8000 m)
+
+	globalSettings.FLARMPositionStep = 10
+	msg, alarmLevel, _, _ := makeFlarmPFLAAString(ti)
+	if fields := nmeaFields(msg); fields[2] != "7600" || fields[3] != "100" {
+		t.Errorf("10 m steps: RelativeNorth/East %s/%s, expected 7600/100", fields[2], fields[3])
+	}
+
+	// Quantized to 8000 m for display, the alarm still comes from the exact 7600 m.
+	globalSettings.FLARMPositionStep = 1000
+	msg, quantizedLevel, _, _ := makeFlarmPFLAAString(ti)
+	if fields := nmeaFields(msg); fields[2] != "8000" || fields[3] != "0" {
+		t.Errorf("1000 m steps: RelativeNorth/East %s/%s, expected 8000/0", fields[2], fields[3])
+	}
+	if alarmLevel != 2 || quantizedLevel != alarmLevel {
+		t.Errorf("alarm level %d quantized, %d exact; expected 2 for both", quantizedLevel, alarmLevel)
+	}
+	drainFlarmTestOutput()
+
+	if q := flarmQuantize(32767, 10); q != 32760 {
+		t.Errorf("flarmQuantize(32767, 10) = %d, expected 32760", q)
+	}
+}
+
+func TestFlarmXCSoarGPGGABeforePFLAA(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_XCSOAR
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	targets := []TrafficInfo{flarmTestTarget(0x3C4B36, 48.05, 11.0, 3500)}
+
+	sendFlarmTrafficUpdates(targets)
+	gga, pflaa := -1, -1
+	for i, out := range rec.sentences() {
+		switch nmeaFields(out)[0] {
+		case "GPGGA":
+			if gga < 0 {
+				gga = i
+			}
+		case "PFLAA":
+			if pflaa < 0 {
+				pflaa = i
+			}
+		}
+	}
+	if gga < 0 || pflaa < 0 || gga > pflaa {
+		t.Errorf("GPGGA at %d, PFLAA at %d: expected GPGGA first in %q", gga, pflaa, rec.sentences())
+	}
+
+	// No fix: the no-fix GPGGA still leads the cycle.
+	globalStatus.GPS_connected = false
+	before := len(rec.sentences())
+	sendFlarmTrafficUpdates(targets)
+	var first []string
+	for _, out := range rec.sentences()[before:] {
+		if fields := nmeaFields(out); fields[0] == "GPGGA" {
+			first = fields
+			break
+		}
+		if fields := nmeaFields(out); fields[0] == "PFLAA" || fields[0] == "PFLAU" {
+			t.Fatalf("%s before GPGGA without a fix", fields[0])
+		}
+	}
+	if first == nil || first[6] != "0" {
+		t.Errorf("no-fix GPGGA %q, expected fix quality 0", first)
+	}
+}
+
+func TestFlarmConvergingAlarmEscalation(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000) // level flight
+	globalSettings.FLARMConvergingAlarm = true
+
+	tests := []struct {
+		name     string
+		vvel     int16 // target, fpm
+		expected uint8
+	}{
+		{"descending toward us", -1000, 2}, // 500 ft above, closing at 5 m/s: escalated
+		{"level", 0, 1},
+		{"climbing away", 1000, 1}, // opening: not escalated
+	}
+	for _, tt := range tests {
+		ti := flarmTestTarget(0x3C4B37, 48.09, 11.0, 3500) // 10 km: alarm level 1
+		ti.Vvel = tt.vvel
+		if _, alarmLevel, _, _ := makeFlarmPFLAAString(ti); alarmLevel != tt.expected {
+			t.Errorf("%s: alarm level %d, expected %d", tt.name, alarmLevel, tt.expected)
+		}
+		drainFlarmTestOutput()
+	}
+
+	// The same geometry with us climbing toward a level target is converging too.
+	mySituation.GPSVerticalSpeed = 1000.0 / 60
+	ti := flarmTestTarget(0x3C4B37, 48.09, 11.0, 3500)
+	ti.Vvel = 0
+	if _, alarmLevel, _, _ := makeFlarmPFLAAString(ti); alarmLevel != 2 {
+		t.Errorf("climbing toward level target: alarm level %d, expected 2", alarmLevel)
+	}
+	drainFlarmTestOutput()
+}
+
+func TestFlarmFirstSeenAlarmSuppression(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMAlarmConfirm = true
+
+	newcomer := flarmTestTarget(0x3C4B38, 48.003, 11.0, 3100) // level 3 once trusted
+	for frame, expected := range []uint8{0, 3, 3} {
+		stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		newcomer.Last_seen = stratuxClock.Time
+		msg, alarmLevel, _, valid := makeFlarmPFLAAString(newcomer)
+		if !valid || alarmLevel != expected {
+			t.Errorf("frame %d: valid %v, alarm level %d (%q), expected shown with level %d", frame+1, valid, alarmLevel, msg, expected)
+		}
+		if frame == 0 {
+			// The fixed-rate output repeating the same report doesn't make it a second frame.
+			if _, alarmLevel, _, _ := makeFlarmPFLAAString(newcomer); alarmLevel != 0 {
+				t.Errorf("first report repeated: alarm level %d, expected 0", alarmLevel)
+			}
+		}
+	}
+
+	// A sudden close target whose second report is late is held back at most flarmFirstSeenMaxHold.
+	sudden := flarmTestTarget(0x3C4B39, 48.003, 11.0, 3100)
+	if _, alarmLevel, _, _ := makeFlarmPFLAAString(sudden); alarmLevel != 0 {
+		t.Errorf("first frame: alarm level %d, expected 0", alarmLevel)
+	}
+	stratuxClock.Time = stratuxClock.Time.Add(flarmFirstSeenMaxHold)
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	if _, alarmLevel, _, _ := makeFlarmPFLAAString(sudden); alarmLevel != 3 {
+		t.Errorf("after %v: alarm level %d, expected 3", flarmFirstSeenMaxHold, alarmLevel)
+	}
+	drainFlarmTestOutput()
+}
+
+func TestGPRMCNMEAVersionLayout(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	fields := nmeaFields(makeGPRMCString())
+	if len(fields) != 13 || fields[12] != "A" {
+		t.Errorf("NMEA 2.3 GPRMC has %d fields ending %q, expected 13 ending with mode A", len(fields), fields[len(fields)-1])
+	}
+
+	globalSettings.FLARMNMEA41 = true
+	fields = nmeaFields(makeGPRMCString())
+	if len(fields) != 14 || fields[12] != "A" || fields[13] != "V" {
+		t.Errorf("NMEA 4.1 GPRMC %q, expected mode A followed by navigational status V", fields)
+	}
+
+	globalStatus.GPS_connected = false
+	if fields = nmeaFields(makeGPRMCString()); len(fields) != 14 || fields[13] != "V" {
+		t.Errorf("NMEA 4.1 no-fix GPRMC %q, expected 14 fields ending with V", fields)
+	}
+}
+
+func TestFlarmDuplicatePFLAASuppression(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMSkipDuplicates = true
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	ti := flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500)
+
+	pflaa := func() int {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{ti})
+		n := 0
+		for _, out := range rec.sentences()[before:] {
+			if nmeaFields(out)[0] == "PFLAA" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := pflaa(); n != 1 {
+		t.Fatalf("first PFLAA not sent")
+	}
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if n := pflaa(); n != 0 {
+		t.Errorf("unchanged PFLAA resent after 1 s")
+	}
+	stratuxClock.Time = stratuxClock.Time.Add(flarmDuplicateRefresh - time.Second)
+	if n := pflaa(); n != 1 {
+		t.Errorf("unchanged PFLAA not refreshed after %v", flarmDuplicateRefresh)
+	}
+	ti.Alt += 100
+	if n := pflaa(); n != 1 {
+		t.Errorf("changed PFLAA suppressed")
+	}
+}
+
+func TestFlarmPFLAUPower(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMLowVoltage = 4.75
+
+	power := func(volts float32) string {
+		globalStatus.SupplyVoltage = volts
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500)})
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAU" {
+				return f[4]
+			}
+		}
+		t.Fatalf("no PFLAU at %.2f V", volts)
+		return ""
+	}
+
+	for _, tc := range []struct {
+		volts float32
+		want  string
+	}{
+		{0, "1"}, // no sensor
+		{5.1, "1"},
+		{4.6, "0"},
+	} {
+		if got := power(tc.volts); got != tc.want {
+			t.Errorf("Power at %.2f V = %s, want %s", tc.volts, got, tc.want)
+		}
+	}
+}
+
+func TestReadSupplyVoltage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power_supply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "*", "voltage_now")
+
+	if _, ok := readSupplyVoltage(pattern); ok {
+		t.Errorf("voltage read without a power supply driver")
+	}
+	for name, content := range map[string]string{"ac": "0\n", "battery": "4650000\n"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "voltage_now"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if volts, ok := readSupplyVoltage(pattern); !ok || math.Abs(float64(volts)-4.65) > 0.001 {
+		t.Errorf("supply voltage %.3f V (%v), want 4.65 V from the driver reporting one", volts, ok)
+	}
+}
+
+func TestValidateSentence(t *testing.T) {
+	long := nmeaFrame("PTEST," + strings.Repeat("9", 74)) // 86 characters
+	for _, tc := range []struct {
+		s  string
+		ok bool
+	}{
+		{nmeaSentence("PFLAU,1,1,2,1,0,,0,,,"), true},
+		{"$PFLAU,1,1,2,1,0,,0,,,*00\r\n", false},                        // wrong checksum
+		{"PFLAU,1,1,2,1,0,,0,,,*4F\r\n", false},                         // no '$'
+		{"$PFLAU,1,1,2,1,0,,0,,,4F*\r\n", false},                        // misplaced '*'
+		{nmeaFrame("PFLAA,0,1,2,3,1,ABCDEF!N1*23,90,,51,2.5,8"), false}, // '*' in a field
+		{nmeaFrame("PFLAA,0,1,2,3,1,ABCDEF!N1\r\n$PFLAU,90,,51,2.5,8"), false},
+		{nmeaSentence("PTEST," + strings.Repeat("9", 70)), true},
+		{long, false},
+	} {
+		if err := validateSentence(tc.s); (err == nil) != tc.ok {
+			t.Errorf("validateSentence(%q) = %v", tc.s, err)
+		}
+	}
+
+	defer saveFlarmTestState()()
+	globalSettings.FLARMLongSentences = "PFLAA, ptest"
+	if err := validateSentence(long); err != nil {
+		t.Errorf("over-length sentence with an override: %v", err)
+	}
+	if err := validateSentence(nmeaFrame("PTEST," + strings.Repeat("9", 75))); err == nil {
+		t.Errorf("87-character sentence accepted with an override")
+	}
+	if err := validateSentence(nmeaFrame("PFLAU," + strings.Repeat("9", 74))); err == nil {
+		t.Errorf("over-length sentence accepted without an override")
+	}
+}
+
+// Every sentence of a busy cycle, in each output profile, must be valid NMEA.
+func TestFlarmCycleSentencesValid(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMStatusSentence = true
+	globalStatus.CPUTemp = 55.5
+
+	modeC := TrafficInfo{Icao_addr: 0xA12345, Alt: 3100, SignalLevel: -20, Last_seen: stratuxClock.Time}
+	targets := []TrafficInfo{
+		flarmTestTarget(0x3C4B3A, 48.001, 11.001, 3050),
+		flarmTestTarget(0xABCDEF, 47.5, 10.5, -1000),
+		flarmTestTarget(0x000001, 48.2, 11.3, 45000),
+		modeC,
+	}
+	for _, profile := range []string{FLARM_PROFILE_FLARM, FLARM_PROFILE_PILOTAWARE, FLARM_PROFILE_XCSOAR} {
+		globalSettings.FLARMOutputProfile = profile
+		setFlarmTestOwnship(-48.0, -11.0, 3000)
+		sendFlarmTrafficUpdates(targets)
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		sendFlarmTrafficUpdates(targets)
+	}
+	if len(rec.sentences()) == 0 {
+		t.Fatalf("no output")
+	}
+	for _, s := range rec.sentences() {
+		if err := validateSentence(s); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+}
+
+func TestFlarmPFLAUMagneticBearing(t *testing.T) {
+	defer saveFlarmTestState()()
+	for _, tc := range []struct {
+		magnetic    bool
+		declination float64
+		bearing     float64
+		want        float64
+	}{
+		{false, 10, 45, 45},
+		{false, 0, 270, -90},
+		{true, 10, 45, 35},     // 10° E
+		{true, -15, 45, 60},    // 15° W
+		{true, 30, 10, -20},    // large easterly declination crosses north
+		{true, -30, 170, -160}, // and crosses south
+		{true, 0, 45, 45},      // no declination configured: stays true
+	} {
+		globalSettings.FLARMMagneticBearing = tc.magnetic
+		globalSettings.FLARMDeclination = tc.declination
+		if got := flarmPFLAUBearing(tc.bearing); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("bearing %.0f, magnetic %v, declination %.0f: got %.1f, want %.1f", tc.bearing, tc.magnetic, tc.declination, got, tc.want)
+		}
+	}
+
+	// End to end: traffic straight ahead on true north shows up 12° left in magnetic with 12° E declination.
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMMagneticBearing = true
+	globalSettings.FLARMDeclination = 12
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	ti := flarmTestTarget(0x3C4B3A, 48.004, 11.0, 3000)
+	ti.Bearing = 0
+	sendFlarmTrafficUpdates([]TrafficInfo{ti})
+	for _, out := range rec.sentences() {
+		if f := nmeaFields(out); f[0] == "PFLAU" {
+			if f[5] == "0" || f[6] != "-12" {
+				t.Errorf("PFLAU with 12° E declination: %q", out)
+			}
+			return
+		}
+	}
+	t.Errorf("no PFLAU")
+}
+
+func TestFlarmStationaryTarget(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMStationarySpeed = 3
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	parked := flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500)
+	parked.OnGround = true
+	parked.Speed = 0
+	parked.Vvel = 0
+	hover := flarmTestTarget(0x3C4B3B, 48.05, 11.0, 3500)
+	hover.Emitter_category = 7 // rotorcraft
+	hover.Speed = 0
+	hover.Vvel = 0
+
+	for _, tc := range []struct {
+		name      string
+		ti        TrafficInfo
+		gs, climb string
+	}{
+		{"stationary", parked, "", ""},
+		{"hover", hover, "0", "0.0"},
+	} {
+		msg, _, _, valid := makeFlarmPFLAAString(tc.ti)
+		f := nmeaFields(msg)
+		if !valid || f[9] != tc.gs || f[10] != tc.climb {
+			t.Errorf("%s: got speed %q climb %q, want %q %q: %q", tc.name, f[9], f[10], tc.gs, tc.climb, msg)
+		}
+	}
+}
+
+func TestFlarmClientReconnectLogging(t *testing.T) {
+	saved := tcpClientLog
+	tcpClientLog = newClientLogLimiter(tcpClientLogWindow)
+	defer func() { tcpClientLog = saved }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	server := newNMEAServer(make(chan clientMessage, 16))
+	defer server.shutdown()
+	if server.listen([]int{0}) != 1 {
+		t.Fatalf("listener not started")
+	}
+	addr := server.listeners[0].Addr().String()
+	for i := 0; i < 5; i++ { // one app flapping on and off
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(c, make([]byte, len("PASS?AOK"))); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		c.Close()
+	}
+	server.shutdown() // waits for the server's goroutines, so the log is complete
+
+	stratuxClock.Time = stratuxClock.Time.Add(tcpClientLogWindow)
+	tcpClientLog.flush()
+	out := logged.String()
+	if n := strings.Count(out, "New client"); n != 1 {
+		t.Errorf("%d \"New client\" lines for 5 connections from one host, want 1:\n%s", n, out)
+	}
+	if !strings.Contains(out, "reconnected 4 times") {
+		t.Errorf("no reconnect summary:\n%s", out)
+	}
+
+	// A different host within the window is a genuinely new client.
+	tcpClientLog.connected(&net.TCPAddr{IP: net.IPv4(192, 168, 10, 2), Port: 50000})
+	if !tcpClientLog.connected(&net.TCPAddr{IP: net.IPv4(192, 168, 10, 3), Port: 50000}) {
+		t.Errorf("connection from a second host not logged")
+	}
+	if tcpClientLog.connected(&net.TCPAddr{IP: net.IPv4(192, 168, 10, 2), Port: 50001}) {
+		t.Errorf("reconnection from the first host logged")
+	}
+}
+
+func TestFlarmFixedRateOutput(t *testing.T) {
+	defer saveFlarmTestState()()
+	savedTraffic, savedMutex := traffic, trafficMutex
+	traffic, trafficMutex = make(map[uint32]TrafficInfo), &sync.Mutex{}
+	defer func() { traffic, trafficMutex = savedTraffic, savedMutex }()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMFixedInterval = 500
+	globalSettings.FLARMStatusSentence = true
+	mySituation.BaroLastMeasurementTime = time.Time{} // GPS altitude reference
+
+	start := stratuxClock.Time
+	update := func(alt int32) {
+		ti := flarmTestTarget(0x3C4B3A, 48.05, 11.0, alt)
+		ti.Last_seen = stratuxClock.Time
+		ti.Last_alt = stratuxClock.Time
+		trafficMutex.Lock()
+		traffic[ti.Icao_addr] = ti
+		trafficMutex.Unlock()
+	}
+	updates := map[time.Duration]int32{ // irregular: two bursts, then silence
+		0:                       3100,
+		300 * time.Millisecond:  3200,
+		1700 * time.Millisecond: 3300,
+		1900 * time.Millisecond: 3400,
+	}
+
+	vertical := ""
+	status := 0
+	for step := time.Duration(0); step <= 9*time.Second; step += 100 * time.Millisecond {
+		stratuxClock.Time = start.Add(step)
+		if alt, ok := updates[step]; ok {
+			update(alt)
+			vertical = strconv.Itoa(int(int16(float32(alt)*0.3048 - float32(3000)*0.3048)))
+		}
+		if step%(time.Duration(globalSettings.FLARMFixedInterval)*time.Millisecond) != 0 {
+			continue
+		}
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(flarmTrafficSnapshot()) // one tick of flarmFixedRateSender()
+		var pflaa []string
+		for _, out := range rec.sentences()[before:] {
+			switch f := nmeaFields(out); f[0] {
+			case "PFLAA":
+				pflaa = append(pflaa, f[4])
+			case "PSTX":
+				status++
+			}
+		}
+		stale := step >= 1900*time.Millisecond+6*time.Second
+		switch {
+		case stale && len(pflaa) != 0:
+			t.Errorf("%v: stale target still emitted", step)
+		case !stale && (len(pflaa) != 1 || pflaa[0] != vertical):
+			t.Errorf("%v: PFLAA RelativeVertical %v, want one with %s", step, pflaa, vertical)
+		}
+	}
+	if want := int(9*time.Second/flarmStatusInterval) + 1; status != want {
+		t.Errorf("%d PSTX in 9 s of 500 ms ticks, want %d: one every %v", status, want, flarmStatusInterval)
+	}
+}
+
+func TestFlarmCyclesSerialized(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	// A fixed-rate tick and the traffic update at the same moment, as when FLARMFixedInterval is toggled.
+	targets := []TrafficInfo{flarmTestTarget(0x3C4B87, 48.005, 11.0, 3100), flarmTestTarget(0, 48.02, 11.0, 3500)}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendFlarmTrafficUpdates(targets)
+		}()
+	}
+	wg.Wait()
+
+	// One cycle after the other: each is complete, GPRMC first.
+	out := rec.sentences()
+	cycles := 0
+	for i, s := range out {
+		if strings.HasPrefix(s, "$GPRMC,") {
+			cycles++
+			if i+1 >= len(out) || !strings.HasPrefix(out[i+1], "$GPGGA,") {
+				t.Errorf("cycle %d interleaved with another: %q", cycles, out)
+			}
+		}
+	}
+	if cycles != 2 {
+		t.Errorf("%d cycles, want 2", cycles)
+	}
+}
+
+func TestFlarmICAOAllowlist(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	targets := []TrafficInfo{
+		flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500),
+		flarmTestTarget(0x3C4B3B, 48.06, 11.0, 3500),
+		flarmTestTarget(0x3C4B3C, 48.07, 11.0, 3500),
+	}
+
+	pflaaIDs := func() []string {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(targets)
+		var ids []string
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAA" {
+				ids = append(ids, strings.Split(f[6], "!")[0]) // drop the callsign extension
+			}
+		}
+		return ids
+	}
+
+	if ids := pflaaIDs(); len(ids) != 3 {
+		t.Errorf("empty allowlist: PFLAA for %v, want all 3 targets", ids)
+	}
+	globalSettings.FLARMICAOAllowlist = []uint32{0x3C4B3B}
+	if ids := pflaaIDs(); len(ids) != 1 || ids[0] != "3C4B3B" {
+		t.Errorf("allowlist 3C4B3B: PFLAA for %v", ids)
+	}
+}
+
+func TestFlarmTowPlaneType(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMTowPlanes = []uint32{0x3C4B3A}
+	globalSettings.FLARMDropPlanes = []uint32{0x3C4B3B}
+
+	tow := flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500) // Emitter_category 1: light aircraft
+	drop := flarmTestTarget(0x3C4B3B, 48.05, 11.0, 3500)
+	plain := flarmTestTarget(0x3C4B3C, 48.05, 11.0, 3500)
+	ogn := flarmTestTarget(0xDD1234, 48.05, 11.0, 3500)
+	ogn.Last_source = TRAFFIC_SOURCE_FLARM
+	ogn.Tail = "FTOWDD1234"
+	ogn.Emitter_category = 0
+
+	for _, tc := range []struct {
+		name string
+		ti   TrafficInfo
+		want string
+	}{
+		{"tagged tow plane", tow, "2"},
+		{"tagged drop plane", drop, "5"},
+		{"light aircraft", plain, "8"},
+		{"OGN tow plane", ogn, "2"},
+	} {
+		msg, _, _, valid := makeFlarmPFLAAString(tc.ti)
+		if f := nmeaFields(msg); !valid || f[11] != tc.want {
+			t.Errorf("%s: AcftType in %q, want %s", tc.name, msg, tc.want)
+		}
+	}
+}
+
+func TestFlarmUDPWithTCPQueueFull(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.NetworkFLARM = true
+	savedChan := msgchan
+	msgchan = make(chan clientMessage, 4) // nobody reads it: a stuck TCP server
+	defer func() { msgchan = savedChan }()
+	for len(messageQueue) > 0 {
+		<-messageQueue
+	}
+	droppedBefore := flarmStatus().TCPQueueDropped
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			sendFlarmTrafficUpdates([]TrafficInfo{flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3500)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("traffic generation blocked on a full TCP queue")
+	}
+
+	udp := 0
+	for len(messageQueue) > 0 {
+		if m := <-messageQueue; m.msgType == NETWORK_FLARM_NMEA {
+			udp++
+		}
+	}
+	if udp < 3*3 { // GPRMC, GPGGA and PFLAA at least, each cycle
+		t.Errorf("%d UDP sentences over 3 cycles with the TCP queue full", udp)
+	}
+	if flarmStatus().TCPQueueDropped == droppedBefore {
+		t.Errorf("TCP queue drops not counted")
+	}
+}
+
+func TestFlarmGeoidCorrection(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMGeoidCorrection = true
+	setFlarmTestOwnship(48.0, 11.0, 3000) // MSL
+	mySituation.GPSGeoidSep = 150         // HAE = MSL + 150 ft
+	mySituation.BaroPressureAltitude = 2800
+	mySituation.BaroLastMeasurementTime = stratuxClock.Time
+
+	// Both targets are 500 ft (152 m) above us: one reports pressure altitude, the other GNSS height above the ellipsoid.
+	baro := flarmTestTarget(0x3C4B3A, 48.05, 11.0, 3300)
+	gnss := flarmTestTarget(0x3C4B3B, 48.05, 11.0, 3650)
+	gnss.AltIsGNSS = true
+
+	for _, ti := range []TrafficInfo{baro, gnss} {
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if f := nmeaFields(msg); !valid || f[4] != "152" {
+			t.Errorf("%X (GNSS %v): RelativeVertical in %q, want 152", ti.Icao_addr, ti.AltIsGNSS, msg)
+		}
+	}
+
+	globalSettings.FLARMGeoidCorrection = false
+	if msg, _, _, _ := makeFlarmPFLAAString(gnss); nmeaFields(msg)[4] == "152" {
+		t.Errorf("HAE target matched without geoid correction: %q", msg)
+	}
+}
+
+func TestFlarmStateCacheSweep(t *testing.T) {
+	defer saveFlarmTestState()()
+	cache := &flarmStateCache{ttl: 10 * time.Second}
+	count := func() int {
+		n := 0
+		cache.states.Range(func(k, v interface{}) bool { n++; return true })
+		return n
+	}
+
+	for icao := uint32(1); icao <= 100; icao++ { // dense airspace
+		cache.get(icao)
+	}
+	stratuxClock.Time = stratuxClock.Time.Add(6 * time.Second)
+	cache.get(1) // still being reported
+	cache.sweep()
+	if n := count(); n != 100 {
+		t.Fatalf("%d entries after 6 s, expected all 100 kept", n)
+	}
+
+	stratuxClock.Time = stratuxClock.Time.Add(6 * time.Second)
+	cache.sweep()
+	if n := count(); n != 1 {
+		t.Errorf("%d entries after 12 s, expected only the target still reported", n)
+	}
+	if _, ok := cache.states.Load(uint32(1)); !ok {
+		t.Errorf("active target swept")
+	}
+}
+
+func TestFlarmIDCase(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_PILOTAWARE
+	ti := flarmTestTarget(0x0A1B2C, 48.05, 11.0, 3500)
+
+	for _, tc := range []struct {
+		lowercase bool
+		want      string
+	}{
+		{false, "0A1B2C"},
+		{true, "0a1b2c"},
+	} {
+		globalSettings.FLARMLowercaseID = tc.lowercase
+		msg, _, _, _ := makeFlarmPFLAAString(ti)
+		if id := nmeaFields(msg)[6]; id != tc.want {
+			t.Errorf("lowercase %v: ID %q, want %q", tc.lowercase, id, tc.want)
+		}
+	}
+}
+
+func TestGPGGABaroAltitudeFallback(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSFix2D = true // position, but no GPS altitude
+	mySituation.BaroPressureAltitude = 3000
+	mySituation.BaroLastMeasurementTime = stratuxClock.Time
+
+	// Pressure altitude only: not an MSL altitude, so GPGGA has none.
+	if f := nmeaFields(makeGPGGAString()); f[9] != "" {
+		t.Errorf("GPGGA altitude %q from pressure altitude without QNH", f[9])
+	}
+
+	// QNH 1023 hPa is ~10 hPa above standard, i.e. ~280 ft higher than pressure altitude.
+	globalSettings.FLARMQNH = 1023.25
+	f := nmeaFields(makeGPGGAString())
+	alt, err := strconv.ParseFloat(f[9], 64)
+	if err != nil || alt < 995 || alt > 1002 || f[10] != "M" {
+		t.Errorf("GPGGA altitude %q %s with QNH 1023.25, expected ~999 m", f[9], f[10])
+	}
+	if f[11] != "" {
+		t.Errorf("geoid separation %q with a baro altitude", f[11])
+	}
+
+	// Baro stale: nothing.
+	mySituation.BaroLastMeasurementTime = stratuxClock.Time.Add(-time.Minute)
+	if f := nmeaFields(makeGPGGAString()); f[9] != "" {
+		t.Errorf("GPGGA altitude %q from a stale baro reading", f[9])
+	}
+}
+
+func TestFlarmOverheadAlarm(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMOverheadSep = 150
+
+	for _, tc := range []struct {
+		name  string
+		alt   int32
+		level uint8
+	}{
+		{"overhead, 600 ft above", 3600, 1},
+		{"below, 600 ft", 2400, 1},
+		{"overhead, co-altitude", 3100, 3},
+	} {
+		ti := flarmTestTarget(0x3C4B3A, 48.001, 11.0, tc.alt) // ~110 m north
+		if _, level, _, _ := makeFlarmPFLAAString(ti); level != tc.level {
+			t.Errorf("%s: alarm level %d, want %d", tc.name, level, tc.level)
+		}
+	}
+
+	globalSettings.FLARMOverheadSep = 0
+	if _, level, _, _ := makeFlarmPFLAAString(flarmTestTarget(0x3C4B3A, 48.001, 11.0, 3600)); level != 3 {
+		t.Errorf("overhead with the option off: alarm level %d, want 3", level)
+	}
+}
+
+func TestFlarmSimulatedGPS(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalStatus.GPS_connected = false // no real fix
+	mySituation.GPSLatitude, mySituation.GPSLongitude = 0, 0
+	globalSettings.FLARMSimGPS = "48.0 11.0 90 120 1500" // east at 120 kt
+
+	// nmeaDegrees converts a GPRMC ddmm.mmmmm / dddmm.mmmmm field to degrees.
+	nmeaDegrees := func(field string, degreeDigits int) float64 {
+		deg, _ := strconv.ParseFloat(field[:degreeDigits], 64)
+		min, _ := strconv.ParseFloat(field[degreeDigits:], 64)
+		return deg + min/60
+	}
+	lastLng := 0.0
+	for i := 0; i < 4; i++ {
+		f := nmeaFields(makeGPRMCString())
+		if f[2] != "A" {
+			t.Fatalf("simulated GPRMC not active: %v", f)
+		}
+		lat, lng := nmeaDegrees(f[3], 2), nmeaDegrees(f[5], 3)
+		if math.Abs(lat-48.0) > 1e-4 {
+			t.Errorf("step %d: latitude %.5f drifted off an easterly track", i, lat)
+		}
+		if i == 0 && math.Abs(lng-11.0) > 1e-4 {
+			t.Errorf("simulation starts at %.5f, not 11.0", lng)
+		}
+		// 120 kt for 10 s is ~617 m, ~0.0083° of longitude at 48° N.
+		if i > 0 && math.Abs(lng-lastLng-0.0083) > 0.0002 {
+			t.Errorf("step %d: longitude advanced %.5f°, expected ~0.0083°", i, lng-lastLng)
+		}
+		lastLng = lng
+		stratuxClock.Time = stratuxClock.Time.Add(10 * time.Second)
+	}
+	if mySituation.GPSLatitude != 0 || mySituation.GPSLongitude != 0 || isGPSValid() {
+		t.Errorf("simulator changed the real situation")
+	}
+	if f := nmeaFields(makeGPGGAString()); f[6] != "1" || f[9] != "457.2" {
+		t.Errorf("simulated GPGGA: %v", f)
+	}
+}
+
+func TestFlarmRingHysteresis(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	// Exactly on the 8 km ring is inside it.
+	if level := flarmRingLevel(0, 8000); level != 2 {
+		t.Errorf("at exactly 8000 m: level %d, want 2", level)
+	}
+
+	// A target holding station at the 8 km ring, jittering +/-50 m, stays at level 2.
+	for i, dist := range []float64{7950, 8050, 7980, 8040, 8010, 7990, 8100} {
+		if level := flarmRingLevel(0x3C4B3A, dist); level != 2 {
+			t.Errorf("step %d at %.0f m: level %d, want 2", i, dist, level)
+		}
+	}
+	// Well beyond the ring plus hysteresis, it drops; coming back in raises it again at once.
+	if level := flarmRingLevel(0x3C4B3A, 8300); level != 1 {
+		t.Errorf("at 8300 m: level %d, want 1", level)
+	}
+	if level := flarmRingLevel(0x3C4B3A, 8100); level != 1 {
+		t.Errorf("back to 8100 m: level %d, want 1", level)
+	}
+	if level := flarmRingLevel(0x3C4B3A, 8000); level != 2 {
+		t.Errorf("back to 8000 m: level %d, want 2", level)
+	}
+}
+
+func TestFlarmIdlePFLAUWithAllTargetsFiltered(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMOwnshipTail = "N12345" // every test target has this tail
+	globalSettings.FLARMPFLAUInterval = 2000
+	targets := []TrafficInfo{
+		flarmTestTarget(0x3C4B3A, 48.001, 11.0, 3000),
+		flarmTestTarget(0x3C4B3B, 48.002, 11.0, 3000),
+	}
+
+	pflau := func() []string {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(targets)
+		var out []string
+		for _, msg := range rec.sentences()[before:] {
+			if nmeaFields(msg)[0] == "PFLAU" {
+				out = append(out, msg)
+			}
+		}
+		return out
+	}
+
+	sent := 0
+	for i := 0; i < 6; i++ { // 6 s of cycles, every target filtered
+		out := pflau()
+		for _, msg := range out {
+			if f := nmeaFields(msg); f[5] != "0" || f[3] != "2" {
+				t.Errorf("idle PFLAU %q", msg)
+			}
+		}
+		sent += len(out)
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	}
+	if sent != 3 {
+		t.Errorf("%d idle PFLAU in 6 s with a 2 s interval, want 3", sent)
+	}
+
+	// A cycle with a PFLAU of its own gets no extra idle one.
+	globalSettings.FLARMOwnshipTail = ""
+	globalSettings.FLARMPFLAUInterval = 0
+	if out := pflau(); len(out) != 1 {
+		t.Errorf("%d PFLAU for 2 targets: %v", len(out), out)
+	}
+}
+
+func TestFlarmPositionOnConnect(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMConnectPosition = true
+	globalStatus.GPS_connected = false // no fix: the no-fix forms
+
+	server := newNMEAServer(make(chan clientMessage, 16))
+	defer server.shutdown()
+	if server.listen([]int{0}) != 1 {
+		t.Fatalf("listener not started")
+	}
+	c, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(c)
+	if _, err := io.ReadFull(r, make([]byte, len("PASS?AOK"))); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	for _, want := range []string{"$GPRMC,", "$GPTXT,"} {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, want) {
+			t.Errorf("after the handshake: %q (%v), want %s...", line, err, want)
+		}
+	}
+}
+
+func TestFlarmUnknownOwnAltitude(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 0)
+	mySituation.GPSFix2D = true                       // no GPS altitude...
+	mySituation.BaroLastMeasurementTime = time.Time{} // ...and no pressure sensor
+
+	// A high airliner must not come out thousands of meters above, nor as a bogus alarm-free target.
+	ti := flarmTestTarget(0x3C4B3A, 48.001, 11.0, 35000)
+	msg, alarmLevel, _, valid := makeFlarmPFLAAString(ti)
+	if f := nmeaFields(msg); !valid || f[4] != "" {
+		t.Errorf("RelativeVertical with unknown own altitude: %q", msg)
+	}
+	if alarmLevel != 3 {
+		t.Errorf("close target with unknown vertical: alarm level %d, want 3 on horizontal distance", alarmLevel)
+	}
+
+	modeC := TrafficInfo{Icao_addr: 0xA12345, Alt: 3000, SignalLevel: -20, Last_seen: stratuxClock.Time}
+	if _, _, _, valid := makeFlarmPFLAAString(modeC); valid {
+		t.Errorf("Mode-C target shown without an own altitude")
+	}
+
+	// The altitude coming back restores the relative vertical.
+	mySituation.GPSFix2D = false
+	mySituation.GPSAltitudeMSL = 34000
+	if msg, _, _, _ := makeFlarmPFLAAString(ti); nmeaFields(msg)[4] != "304" {
+		t.Errorf("RelativeVertical after the own altitude came back: %q", msg)
+	}
+}
+
+// readGDL90Frames reads GDL90 frames from r until it has n of them, returning each with the flags and CRC removed.
+func readGDL90Frames(r *bufio.Reader, n int) ([][]byte, error) {
+	var frames [][]byte
+	var frame []byte
+	escaped := false
+	for len(frames) < n {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch {
+		case b == 0x7E:
+			if len(frame) > 2 {
+				frames = append(frames, frame[:len(frame)-2])
+			}
+			frame = nil
+		case b == 0x7D:
+			escaped = true
+		case escaped:
+			frame = append(frame, b^0x20)
+			escaped = false
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return frames, nil
+}
+
+func TestFlarmGDL90Bridge(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	server := newNMEAServer(make(chan clientMessage, 16))
+	defer server.shutdown()
+	if !server.listenFormat(0, clientFormatGDL90) {
+		t.Fatalf("GDL90 listener not started")
+	}
+	ch := msgchan
+	msgchan = server.msgchan
+	defer func() { msgchan = ch }()
+	globalSettings.FLARMGDL90Port = server.listeners[0].Addr().(*net.TCPAddr).Port
+
+	c, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	for i := 0; i < 200; i++ { // registration with handleMessages is asynchronous
+		if getFlarmGDL90Clients() == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, _ := getTCPClientLoad(); n != 0 || getFlarmGDL90Clients() != 1 {
+		t.Fatalf("%d NMEA clients, %d GDL90 clients; want the bridge client counted apart", n, getFlarmGDL90Clients())
+	}
+
+	near := flarmTestTarget(0x3C4B3B, 48.003, 11.0, 3100)
+	ring1 := flarmTestTarget(0x3C4B86, 48.09, 11.0, 3100) // 10 km: alarm level 1, no GDL90 alert
+	distant := flarmTestTarget(0x3C4B3C, 48.15, 11.0, 3100)
+	alarms := make(map[uint32]uint8)
+	for _, ti := range []TrafficInfo{near, ring1, distant} {
+		_, alarmLevel, _, valid := makeFlarmPFLAAString(ti)
+		if !valid {
+			t.Fatalf("target %X not shown as FLARM traffic", ti.Icao_addr)
+		}
+		alarms[ti.Icao_addr] = alarmLevel
+	}
+	if alarms[near.Icao_addr] != 3 || alarms[ring1.Icao_addr] != 1 || alarms[distant.Icao_addr] != 0 {
+		t.Fatalf("alarm levels %v, expected levels 3, 1 and a plain target", alarms)
+	}
+	sendFlarmTrafficUpdates([]TrafficInfo{near, ring1, distant})
+
+	pflaa := 0
+	for _, msg := range rec.sentences() {
+		if strings.HasPrefix(msg, "$PFLAA,") {
+			pflaa++
+		}
+	}
+	if pflaa != 3 {
+		t.Errorf("%d PFLAA for 3 targets", pflaa)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(c)
+	reports := make(map[uint32]bool) // ICAO address: alert bit
+	for len(reports) < 3 {
+		frames, err := readGDL90Frames(r, 1)
+		if err != nil {
+			t.Fatalf("reading GDL90: %v (traffic reports so far: %v)", err, reports)
+		}
+		if f := frames[0]; f[0] == 0x14 {
+			reports[uint32(f[2])<<16|uint32(f[3])<<8|uint32(f[4])] = f[1]&0x10 != 0
+		}
+	}
+	for icao, alarmLevel := range alarms {
+		alert, ok := reports[icao]
+		if !ok {
+			t.Errorf("no GDL90 traffic report for FLARM target %X", icao)
+		} else if alert != (alarmLevel >= 2) {
+			t.Errorf("target %X: GDL90 alert %v with FLARM alarm level %d", icao, alert, alarmLevel)
+		}
+	}
+}
+
+func TestFlarmClimbRateFormat(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	tests := []struct {
+		climb                        float32 // m/s
+		decimal, integer, noLeadZero string
+		integerNoLeadZero            string
+	}{
+		{5.08, "5.1", "5", "5.1", "5"},
+		{0, "0.0", "0", ".0", "0"},
+		{0.5, "0.5", "1", ".5", "1"},
+		{-0.5, "-0.5", "-1", "-.5", "-1"},
+		{-0.3, "-0.3", "0", "-.3", "0"}, // never "-0"
+		{-0.04, "0.0", "0", ".0", "0"},  // never "-0.0" or "-.0"
+		{-0.96, "-1.0", "-1", "-1.0", "-1"},
+		{-12.3, "-12.3", "-12", "-12.3", "-12"},
+	}
+	for _, tt := range tests {
+		for _, v := range []struct {
+			integer, noLeadZero bool
+			expected            string
+		}{
+			{false, false, tt.decimal},
+			{true, false, tt.integer},
+			{false, true, tt.noLeadZero},
+			{true, true, tt.integerNoLeadZero},
+		} {
+			globalSettings.FLARMClimbInteger = v.integer
+			globalSettings.FLARMClimbNoLeadZero = v.noLeadZero
+			if s := formatFlarmClimbRate(tt.climb); s != v.expected {
+				t.Errorf("%.2f m/s (integer %v, no leading zero %v): %q, expected %q", tt.climb, v.integer, v.noLeadZero, s, v.expected)
+			}
+		}
+	}
+}
+
+func TestFlarmSingleAlarmPFLAU(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	alarm := func(targets ...TrafficInfo) []string {
+		before := len(rec.sentences())
+		sendFlarmTraffic(targets, true)
+		var pflau []string
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAU" {
+				pflau = append(pflau, out)
+			}
+		}
+		if len(pflau) != 1 {
+			t.Fatalf("%d PFLAU for %d targets: %v", len(pflau), len(targets), pflau)
+		}
+		return nmeaFields(pflau[0])
+	}
+
+	// Same alarm level: an airliner 2.5 km out and a glider from OGN at 3.3 km.
+	airliner := flarmTestTarget(0x4CA123, 48.0225, 11.0, 3100)
+	airliner.Emitter_category = 3
+	glider := flarmTestTarget(0x3D1234, 48.03, 11.0, 3100)
+	glider.Last_source = TRAFFIC_SOURCE_FLARM
+	glider.Emitter_category = 9
+	if f := alarm(airliner, glider); f[5] != "3" || !strings.HasPrefix(f[10], "4CA123") {
+		t.Errorf("without glider priority: %v, want the closer airliner", f)
+	}
+	globalSettings.FLARMGliderPriority = true
+	if f := alarm(airliner, glider); f[5] != "3" || !strings.HasPrefix(f[10], "3D1234") {
+		t.Errorf("with glider priority: %v, want the glider at comparable danger", f)
+	}
+
+	// Same alarm level, but the airliner is 500 m out and the glider 3.3 km: the airliner keeps the alarm.
+	near := flarmTestTarget(0x4CA123, 48.0045, 11.0, 3100)
+	near.Emitter_category = 3
+	if f := alarm(near, glider); f[5] != "3" || !strings.HasPrefix(f[10], "4CA123") {
+		t.Errorf("glider priority hid an airliner 2.8 km closer at the same alarm level: %v", f)
+	}
+
+	// The airliner crossing much closer is the more urgent threat and keeps the alarm.
+	glider = flarmTestTarget(0x3D1234, 48.06, 11.0, 3100) // 6.7 km: level 2
+	glider.Last_source = TRAFFIC_SOURCE_FLARM
+	if f := alarm(airliner, glider); f[5] != "3" || !strings.HasPrefix(f[10], "4CA123") {
+		t.Errorf("airliner at a higher alarm level lost the PFLAU to a glider: %v", f)
+	}
+}
+
+func TestFlarmRelativeOnlyTarget(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	// 5 km to the southwest, 100 m above, no lat/lng.
+	ti := flarmTestTarget(0x3C4B3D, 0, 0, 3328)
+	ti.Position_valid = false
+	ti.BearingDist_valid = true
+	ti.Bearing = 225
+	ti.Distance = 5000
+
+	// Without the source's flag this is just a target whose position went stale, with a bearing from a past fix.
+	if msg, _, _, valid := makeFlarmPFLAAString(ti); valid && nmeaFields(msg)[3] != "" {
+		t.Errorf("stale target positioned from its old bearing / distance: %q", msg)
+	}
+
+	ti.RelativeOnly = true
+	msg, alarmLevel, dist, valid := makeFlarmPFLAAString(ti)
+	f := nmeaFields(msg)
+	if !valid || f[2] != "-3535" || f[3] != "-3535" || f[4] != "99" {
+		t.Errorf("relative-only target: %q (valid %v)", msg, valid)
+	}
+	if dist != 5000 || alarmLevel != 2 {
+		t.Errorf("relative-only target: distance %.0f m, alarm level %d, want 5000 m and level 2", dist, alarmLevel)
+	}
+	if f[7] != "90" || f[9] != "51" {
+		t.Errorf("relative-only target lost its velocity: %q", msg)
+	}
+
+	// A bearing without a distance: bearing-less form, distance estimated from the signal.
+	ti.Distance = 0
+	ti.SignalLevel = -20
+	msg, _, _, valid = makeFlarmPFLAAString(ti)
+	f = nmeaFields(msg)
+	if !valid || f[3] != "" || f[2] != strconv.Itoa(int(flarmModeCDistance(-20))) {
+		t.Errorf("bearing without a distance: %q (valid %v), want the estimated-distance form", msg, valid)
+	}
+}
+
+func TestFlarmStalledClientDisconnected(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMStallTimeout = 1
+
+	stalledConn, stalledPeer := net.Pipe()
+	defer stalledPeer.Close()
+	readerConn, readerPeer := net.Pipe()
+	defer readerConn.Close()
+	defer readerPeer.Close()
+	stalledCh, readerCh := make(chan string, 4), make(chan string, 4)
+	stalled := &tcpClientStats{ch: stalledCh, conn: stalledConn} // never reads
+	reader := &tcpClientStats{ch: readerCh, conn: readerConn}    // reads everything, if slowly
+	clients := map[net.Conn]*tcpClientStats{stalledConn: stalled, readerConn: reader}
+
+	// Keep the stream going on the stratux clock until the stalled client's queue has been full for the timeout.
+	sentence := nmeaFrame("PSTX," + strings.Repeat("0", 1000))
+	for i := 0; i < 30; i++ {
+		broadcast(clients, clientFormatDefault, sentence)
+		broadcast(clients, clientFormatDefault, sentence)
+		<-readerCh
+		<-readerCh
+		if i == 10 && stalled.stalled {
+			t.Fatalf("stalled client disconnected after %v", time.Duration(i)*100*time.Millisecond)
+		}
+		stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+	}
+
+	if !stalled.stalled {
+		t.Fatalf("stalled client still connected")
+	}
+	stalledPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, stalledPeer); err != nil {
+		t.Errorf("stalled client's connection not closed: %v", err)
+	}
+	if reader.stalled || reader.dropped != 0 {
+		t.Errorf("reading client dropped along with the stalled one: %d sentences dropped", reader.dropped)
+	}
+}
+
+func TestFlarmPFLAAVariantPerClient(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_PILOTAWARE // the default for clients that make no choice
+
+	msgs := make(chan clientMessage, 16)
+	server := newNMEAServer(msgs)
+	defer server.shutdown()
+	if server.listen([]int{0}) != 1 || !server.listenFormat(0, clientFormatPFLAAPlain) || !server.listenFormat(0, clientFormatPFLAAExtended) {
+		t.Fatalf("listeners not started")
+	}
+	mc := msgchan
+	msgchan = msgs
+	defer func() { msgchan = mc }()
+	port := func(i int) int { return server.listeners[i].Addr().(*net.TCPAddr).Port }
+	globalSettings.FLARMPlainPFLAAPort, globalSettings.FLARMExtPFLAAPort = port(1), port(2)
+
+	var readers []*bufio.Reader
+	for _, ln := range server.listeners {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(c)
+		if _, err := io.ReadFull(r, make([]byte, len("PASS?AOK"))); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		readers = append(readers, r)
+	}
+	for i := 0; i < 200; i++ {
+		if n, _ := getTCPClientLoad(); n == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ti := flarmTestTarget(0x3C4B3E, 48.05, 11.0, 3500)
+	ti.Tail = "D-KA,B" // a comma in the callsign is dropped rather than shifting the fields
+	sendFlarmTrafficUpdates([]TrafficInfo{ti})
+
+	for i, want := range []string{"3C4B3E", "3C4B3E", "3C4B3E!D-KAB"} {
+		var pflaa []string
+		for {
+			line, err := readers[i].ReadString('\n')
+			if err != nil {
+				t.Fatalf("client %d: %v", i, err)
+			}
+			if strings.HasPrefix(line, "$PFLAA,") {
+				pflaa = append(pflaa, line)
+			}
+			if strings.HasPrefix(line, "$PFLAU,") {
+				break // sent before the PFLAA; the PFLAA follows
+			}
+		}
+		line, err := readers[i].ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "$PFLAA,") {
+			t.Fatalf("client %d: %q (%v), expected the PFLAA", i, line, err)
+		}
+		if err := validateSentence(line); err != nil {
+			t.Errorf("client %d: %v", i, err)
+		}
+		f := strings.Split(strings.TrimPrefix(line[:strings.LastIndex(line, "*")], "$"), ",")
+		if id := strings.Join(f[6:len(f)-5], ","); id != want || f[len(f)-1] != "8" {
+			t.Errorf("client %d: PFLAA %q, expected ID %s", i, line, want)
+		}
+		if len(pflaa) != 0 {
+			t.Errorf("client %d: PFLAA ahead of the PFLAU: %v", i, pflaa)
+		}
+	}
+}
+
+func TestFlarmTimeField(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	for _, tc := range []struct {
+		seconds           float64
+		centiseconds, hms string
+	}{
+		{0, "000000.00", "000000"},
+		{12*3600 + 34*60 + 56.78, "123456.78", "123456"},
+		{12*3600 + 34*60 + 59.996, "123500.00", "123500"}, // rounding carries into the minute
+		{9*3600 + 59*60 + 59.5, "095959.50", "095959"},
+		{86399.999, "000000.00", "000000"},
+	} {
+		globalSettings.FLARMWholeSeconds = false
+		if got := nmeaTime(tc.seconds); got != tc.centiseconds {
+			t.Errorf("%.3f s: %q, want %q", tc.seconds, got, tc.centiseconds)
+		}
+		globalSettings.FLARMWholeSeconds = true
+		if got := nmeaTime(tc.seconds); got != tc.hms {
+			t.Errorf("%.3f s, whole seconds: %q, want %q", tc.seconds, got, tc.hms)
+		}
+	}
+
+	// Both sentences of a cycle carry the same time in the same format.
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSLastFixSinceMidnightUTC = 12*3600 + 34*60 + 56.5
+	for _, whole := range []bool{false, true} {
+		globalSettings.FLARMWholeSeconds = whole
+		want := map[bool]string{false: "123456.50", true: "123456"}[whole]
+		if rmc, gga := nmeaFields(makeGPRMCString())[1], nmeaFields(makeGPGGAString())[1]; rmc != want || gga != want {
+			t.Errorf("whole seconds %v: GPRMC time %q, GPGGA time %q, want %q", whole, rmc, gga, want)
+		}
+	}
+}
+
+func TestFlarmTrafficCountSentence(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMTrafficSentence = true
+
+	counts := func(targets []TrafficInfo) string {
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(targets)
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PSTXT" {
+				return strings.Join(f[1:], ",")
+			}
+		}
+		t.Fatalf("no PSTXT with %d targets", len(targets))
+		return ""
+	}
+
+	if got := counts(nil); got != "0,0,0,0,0,0" {
+		t.Errorf("no traffic: PSTXT %s, want all zeros", got)
+	}
+
+	uat := flarmTestTarget(0x3C4B40, 48.02, 11.0, 3200)
+	uat.Last_source = TRAFFIC_SOURCE_UAT
+	glider := flarmTestTarget(0x3D4B41, 48.03, 11.0, 3200)
+	glider.Last_source = TRAFFIC_SOURCE_FLARM
+	modeC := TrafficInfo{Icao_addr: 0xA12346, Alt: 3100, SignalLevel: -20, Last_seen: stratuxClock.Time, Last_source: TRAFFIC_SOURCE_1090ES}
+	targets := []TrafficInfo{
+		flarmTestTarget(0x3C4B42, 48.01, 11.0, 3200),
+		flarmTestTarget(0x3C4B43, 48.04, 11.0, 3200),
+		uat, glider, modeC,
+	}
+	globalSettings.FLARMMaxTargets = 2
+	if got := counts(targets); got != "2,1,1,1,2,3" {
+		t.Errorf("2 ES, 1 UAT, 1 Mode-C, 1 FLARM, at most 2 sent: PSTXT %s, want 2,1,1,1,2,3", got)
+	}
+}
+
+func TestFlarmTrackFromHeading(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	for _, tc := range []struct {
+		name      string
+		trackType uint8
+		track     uint16
+		speed     uint16
+		want      string
+	}{
+		{"ground track", TRACK_TYPE_TRUE_TRACK, 90, 60, "90"},
+		{"true heading, fast", TRACK_TYPE_TRUE_HEADING, 90, 250, "90"},
+		{"magnetic heading, fast", TRACK_TYPE_MAG_HEADING, 358, 250, "2"},
+		// A 60 kt motor glider into a 40 kt crosswind: its track is some 40° off the heading.
+		{"true heading, slow", TRACK_TYPE_TRUE_HEADING, 90, 60, ""},
+		{"magnetic heading, slow", TRACK_TYPE_MAG_HEADING, 90, 60, ""},
+		{"magnetic heading, no declination", TRACK_TYPE_MAG_HEADING, 358, 250, ""},
+		{"no track", TRACK_TYPE_NONE, 0, 250, ""}, // UAT ground vehicle, tt "not available"
+	} {
+		ti := flarmTestTarget(0x3C4B44, 48.05, 11.0, 3500)
+		ti.TrackType, ti.Track, ti.Speed = tc.trackType, tc.track, tc.speed
+		globalSettings.FLARMDeclination = 4
+		if strings.HasSuffix(tc.name, "no declination") {
+			globalSettings.FLARMDeclination = 0
+		}
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if f := nmeaFields(msg); !valid || f[7] != tc.want {
+			t.Errorf("%s: Track %q, want %q: %q", tc.name, f[7], tc.want, msg)
+		}
+	}
+}
+
+func TestFlarmOwnFixJumpGate(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	target := flarmTestTarget(0x3C4B45, 48.01, 11.0, 3200)
+	cycle := func(lat float32, step time.Duration) (rmcStatus string, pflaa int) {
+		stratuxClock.Time = stratuxClock.Time.Add(step)
+		setFlarmTestOwnship(lat, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{target})
+		for _, out := range rec.sentences()[before:] {
+			switch f := nmeaFields(out); f[0] {
+			case "GPRMC":
+				rmcStatus = f[2]
+			case "PFLAA":
+				pflaa++
+			}
+		}
+		return rmcStatus, pflaa
+	}
+
+	if status, pflaa := cycle(48.0, time.Second); status != "A" || pflaa != 1 {
+		t.Fatalf("first fix: GPRMC status %q with %d PFLAA, want A with 1", status, pflaa)
+	}
+	// 330 km in a second.
+	if status, pflaa := cycle(45.0, time.Second); status != "V" || pflaa != 0 {
+		t.Errorf("impossible jump: GPRMC status %q with %d PFLAA, want V (no fix) with none", status, pflaa)
+	}
+	// Back where we were, 50 m on: compared with the last accepted fix, not the rejected one.
+	if status, pflaa := cycle(48.0005, time.Second); status != "A" || pflaa != 1 {
+		t.Errorf("after a rejected fix: GPRMC status %q with %d PFLAA, want A with 1", status, pflaa)
+	}
+	// The same distance after a long dropout is accepted.
+	if status, _ := cycle(45.0, flarmOwnFixGap); status != "A" {
+		t.Errorf("jump after a %v dropout: GPRMC status %q, want A", flarmOwnFixGap, status)
+	}
+}
+
+func TestFlarmPFLAUIDMatchesPFLAA(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	ids := func(ti TrafficInfo) (pflaa, pflau string) {
+		before := len(rec.sentences())
+		sendFlarmTraffic([]TrafficInfo{ti}, true)
+		for _, out := range rec.sentences()[before:] {
+			switch f := nmeaFields(out); f[0] {
+			case "PFLAA":
+				pflaa = f[6]
+			case "PFLAU":
+				pflau = f[10]
+			}
+		}
+		return pflaa, pflau
+	}
+
+	// 1.1 km out at the same altitude: an alarm.
+	adsb := flarmTestTarget(0x3C4B46, 48.01, 11.0, 3000)
+	noAddress := flarmTestTarget(0, 48.01, 11.0, 3000)
+	for _, full := range []bool{false, true} {
+		globalSettings.FLARMPFLAUFullID = full
+		for _, ti := range []TrafficInfo{adsb, noAddress} {
+			pflaa, pflau := ids(ti)
+			want := pflaa
+			if !full {
+				want = strings.SplitN(pflaa, "!", 2)[0]
+			}
+			if pflau == "" || pflau != want {
+				t.Errorf("address %06X, FLARMPFLAUFullID %v: PFLAU ID %q, want %q (PFLAA ID %q)", ti.Icao_addr, full, pflau, want, pflaa)
+			}
+		}
+	}
+}
+
+func TestFlarmMinBearingDistance(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMMinBearingDist = 200
+
+	// 110 m north at our altitude: too close for a bearing, still the most urgent alarm.
+	near := flarmTestTarget(0x3C4B47, 48.001, 11.0, 3000)
+	_, _, _, pflau, _, valid := makeFlarmPFLAA(near)
+	if f := nmeaFields(pflau); !valid || len(f) < 11 || f[5] != "3" || f[6] != "" {
+		t.Errorf("target at 110 m: PFLAU %q, want alarm level 3 with an empty bearing", pflau)
+	}
+
+	far := flarmTestTarget(0x3C4B47, 48.01, 11.0, 3000)
+	_, _, _, pflau, _, _ = makeFlarmPFLAA(far)
+	if f := nmeaFields(pflau); len(f) < 11 || f[6] != "0" {
+		t.Errorf("target at 1.1 km: PFLAU %q, want bearing 0", pflau)
+	}
+}
+
+func TestFlarmAllClear(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMClearSentence = true
+
+	threat := flarmTestTarget(0x3C4B48, 48.01, 11.0, 3000) // 1.1 km at our altitude: level 3
+	distant := flarmTestTarget(0x3C4B49, 48.3, 11.0, 3000) // 33 km: no alarm
+	var clears []string
+	cycle := func(ti TrafficInfo) {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTraffic([]TrafficInfo{ti}, true)
+		for _, out := range rec.sentences()[before:] {
+			if nmeaFields(out)[0] == "PSTXC" {
+				clears = append(clears, out)
+			}
+		}
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	}
+
+	// Alarm, then flapping in and out of it, then clear for good.
+	for _, ti := range []TrafficInfo{threat, threat, distant, threat, distant, distant, threat} {
+		cycle(ti)
+	}
+	if len(clears) != 0 {
+		t.Fatalf("clear event while the alarm was flapping: %v", clears)
+	}
+	for i := 0; i < 10; i++ {
+		cycle(distant)
+	}
+	if len(clears) != 1 || nmeaFields(clears[0])[1] != "3" {
+		t.Errorf("after the alarm ended: %v, want a single PSTXC with peak level 3", clears)
+	}
+}
+
+func TestFlarmAltitudeUnits(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	// The same aircraft at 3500 ft reported by a feed that switches from feet to meters and back.
+	for _, tc := range []struct {
+		alt    int
+		meters bool
+	}{
+		{3500, false},
+		{1067, true},
+		{3500, false},
+	} {
+		alt := tc.alt
+		ti := flarmTestTarget(0x3C4B4A, 48.05, 11.0, 0)
+		ti.Alt = dump1090Altitude(&dump1090Data{Alt: &alt, AltIsMeters: tc.meters})
+		if ti.Alt < 3499 || ti.Alt > 3501 {
+			t.Errorf("%d (meters %v): TrafficInfo.Alt %d ft, want 3500", tc.alt, tc.meters, ti.Alt)
+		}
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if f := nmeaFields(msg); !valid || f[4] != "152" {
+			t.Errorf("%d (meters %v): PFLAA %q, want RelativeVertical 152 m", tc.alt, tc.meters, msg)
+		}
+	}
+}
+
+func TestFlarmMalformedSentenceSuppressed(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// A tail that got past sanitizing with a '*' in it.
+	msg := nmeaSentence("PFLAA,0,1000,0,152,1,3C4B4B!N1*34,90,,51,2.5,1")
+	if msg != "" {
+		t.Errorf("malformed PFLAA built as %q, want it refused", msg)
+	}
+	sendNetFLARM(msg)
+	if out := rec.sentences(); len(out) != 0 {
+		t.Errorf("sent %q", out)
+	}
+	if !strings.Contains(logged.String(), "N1*34") {
+		t.Errorf("log %q doesn't show the offending sentence", logged.String())
+	}
+}
+
+func TestFlarmStaleFixSuppressesTraffic(t *testing.T) {
+	defer saveFlarmTestState()()
+	target := flarmTestTarget(0x3C4B4C, 48.01, 11.0, 3000)
+
+	for _, tc := range []struct {
+		age     time.Duration
+		setting int
+		want    bool
+	}{
+		{500 * time.Millisecond, 0, true}, // a brief lag
+		{2500 * time.Millisecond, 0, false},
+		{2500 * time.Millisecond, 3000, true},
+	} {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSLastFixLocalTime = stratuxClock.Time.Add(-tc.age)
+		globalSettings.FLARMMaxFixAge = tc.setting
+		if !isGPSValid() {
+			t.Fatalf("fix %v old isn't valid at all", tc.age)
+		}
+		_, _, _, pflau, _, valid := makeFlarmPFLAA(target)
+		if valid != tc.want || (pflau != "") != tc.want {
+			t.Errorf("fix %v old, FLARMMaxFixAge %d: PFLAA valid %v, PFLAU %q; want traffic %v", tc.age, tc.setting, valid, pflau, tc.want)
+		}
+	}
+}
+
+func TestFlarmUDPBatching(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.NetworkFLARM = true
+	targets := []TrafficInfo{
+		flarmTestTarget(0x3C4B4D, 48.05, 11.0, 3500),
+		flarmTestTarget(0x3C4B4E, 48.06, 11.0, 3500),
+	}
+
+	datagrams := func() []string {
+		for len(messageQueue) > 0 {
+			<-messageQueue
+		}
+		sendFlarmTrafficUpdates(targets)
+		drainFlarmTestOutput()
+		var out []string
+		for len(messageQueue) > 0 {
+			if m := <-messageQueue; m.msgType == NETWORK_FLARM_NMEA {
+				out = append(out, string(m.msg))
+			}
+		}
+		return out
+	}
+
+	if out := datagrams(); len(out) < 5 {
+		t.Errorf("batching off: %d datagrams, want one per sentence", len(out))
+	}
+
+	globalSettings.FLARMUDPBatch = true
+	out := datagrams()
+	if len(out) != 1 {
+		t.Fatalf("batching on: %d datagrams, want 1: %q", len(out), out)
+	}
+	var kinds []string
+	for _, line := range strings.SplitAfter(out[0], "\r\n") {
+		if line == "" {
+			continue
+		}
+		if err := validateSentence(line); err != nil {
+			t.Errorf("%v", err)
+		}
+		kinds = append(kinds, nmeaFields(line)[0])
+	}
+	if got := strings.Join(kinds, ","); got != "GPRMC,GPGGA,PFLAU,PFLAA,PFLAA" {
+		t.Errorf("datagram holds %s, want GPRMC,GPGGA,PFLAU,PFLAA,PFLAA", got)
+	}
+
+	// A busy cycle is split, every datagram within the limit.
+	targets = nil
+	for i := 0; i < 40; i++ {
+		targets = append(targets, flarmTestTarget(0x3C4C00+uint32(i), 48.05+float32(i)*0.001, 11.0, 3500))
+	}
+	out = datagrams()
+	if len(out) < 2 {
+		t.Errorf("40 targets in %d datagram(s), want them split", len(out))
+	}
+	for _, d := range out {
+		if len(d) > flarmUDPBatchSize || !strings.HasSuffix(d, "\r\n") {
+			t.Errorf("datagram of %d bytes, or ending mid-sentence: %q", len(d), d)
+		}
+	}
+
+	// Outside a cycle, e.g. a PFLAC reply, a sentence isn't held back until the next one.
+	for len(messageQueue) > 0 {
+		<-messageQueue
+	}
+	reply := nmeaSentence("PFLAC,A,RANGE,25000")
+	sendNetFLARM(reply)
+	drainFlarmTestOutput()
+	if len(messageQueue) != 1 {
+		t.Fatalf("sentence outside a cycle: %d datagrams queued, want 1", len(messageQueue))
+	}
+	if m := <-messageQueue; string(m.msg) != reply {
+		t.Errorf("sentence outside a cycle sent as %q, want %q", m.msg, reply)
+	}
+}
+
+func TestFlarmNoHandshake(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMNoHandshake = true
+
+	msgs := make(chan clientMessage, 16)
+	server := newNMEAServer(msgs)
+	defer server.shutdown()
+	if server.listen([]int{0}) != 1 {
+		t.Fatalf("listener not started")
+	}
+	c, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	for i := 0; i < 200; i++ { // registration with handleMessages is asynchronous
+		if n, _ := getTCPClientLoad(); n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msgs <- clientMessage{msg: nmeaSentence("PFLAU,0,1,2,1,0,,0,,,")}
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "$PFLAU,") {
+		t.Errorf("first data on connect: %q (%v), want the NMEA stream without PASS?/AOK", line, err)
+	}
+}
+
+func TestFlarmStationaryOwnship(t *testing.T) {
+	defer saveFlarmTestState()()
+	// A glider on the ground: valid position, no speed, and a course the receiver can't tell.
+	setFlarmTestOwnship(48.0, 11.0, 1500)
+	mySituation.GPSGroundSpeed = 0
+	mySituation.GPSTrueCourse = float32(math.NaN())
+
+	// Circuit traffic 1.1 km north, 300 ft above, flying south towards us.
+	ti := flarmTestTarget(0x3C4B4F, 48.01, 11.0, 1800)
+	ti.Track = 180
+	msg, alarmLevel, _, pflau, _, valid := makeFlarmPFLAA(ti)
+	if f := nmeaFields(msg); !valid || f[2] != "1111" || f[3] != "0" {
+		t.Fatalf("stationary ownship: PFLAA %q, want the target 1111 m north", msg)
+	}
+	if f := nmeaFields(pflau); alarmLevel == 0 || len(f) < 11 || f[6] != "0" || f[7] != "2" {
+		t.Errorf("stationary ownship, target heading for us: level %d, PFLAU %q, want an aircraft alarm bearing 0", alarmLevel, pflau)
+	}
+}
+
+func TestFlarmPFLAUDistanceClamped(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rings := flarmAlarmRings
+	defer func() { flarmAlarmRings = rings }()
+	flarmAlarmRings = append(flarmAlarmRings[:0:0], flarmAlarmRings...)
+	flarmAlarmRings[len(flarmAlarmRings)-1].radius = 50000 // let a distant target reach the PFLAU path
+
+	ti := flarmTestTarget(0x3C4B50, 48.36, 11.0, 3000) // 40 km north
+	ti.Track = 180
+	for _, tc := range []struct {
+		max  int
+		want string
+	}{
+		{0, "32767"},
+		{20000, "20000"},
+	} {
+		globalSettings.FLARMPFLAUMaxDist = tc.max
+		_, _, _, pflau, _, _ := makeFlarmPFLAA(ti)
+		if f := nmeaFields(pflau); len(f) < 11 || f[9] != tc.want || validateSentence(pflau) != nil {
+			t.Errorf("40 km threat, FLARMPFLAUMaxDist %d: PFLAU %q, want RelativeDistance %s", tc.max, pflau, tc.want)
+		}
+	}
+	if v := flarmClampInt16(-40000); v != math.MinInt16 {
+		t.Errorf("flarmClampInt16(-40000) = %d", v)
+	}
+}
+
+func TestFlarmDeviceID(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMDeviceID = "A1B2C3"
+
+	replies := make(chan string, 4)
+	query := strings.TrimSpace(nmeaSentence("PFLAC,R,ID")) + "\r\n"
+	readClientNMEA(strings.NewReader("6000\r\n"+query+"$PFLAC,R,ID*00\r\n"), replies)
+	if len(replies) != 1 {
+		t.Fatalf("%d replies to one valid PFLAC query, want 1", len(replies))
+	}
+	if got, want := <-replies, nmeaSentence("PFLAC,A,ID,A1B2C3"); got != want {
+		t.Errorf("reply %q, want %q", got, want)
+	}
+
+	// Unset: the low 24 bits of the hardware serial.
+	cpuinfo := "processor\t: 0\nHardware\t: BCM2835\nSerial\t\t: 10000000d1e2f3a4\nModel\t\t: Raspberry Pi\n"
+	if id, ok := flarmHardwareID(cpuinfo); !ok || id != 0xE2F3A4 {
+		t.Errorf("hardware ID %06X (%v), want E2F3A4", id, ok)
+	}
+	if _, ok := flarmHardwareID("Serial\t\t: 0000000000000000\n"); ok {
+		t.Errorf("all-zero serial taken as a hardware ID")
+	}
+}
+
+func TestFlarmClientReplyAfterDisconnect(t *testing.T) {
+	defer saveFlarmTestState()()
+	globalSettings.FLARMDeviceID = "A1B2C3"
+	server, conn := net.Pipe()
+	defer conn.Close()
+	client := tcpClient{conn: server, ch: make(chan string, 4), replies: make(chan string, flarmClientReplyQueue)}
+	done := make(chan struct{})
+	go func() {
+		client.WriteLinesFrom(client.ch, client.replies)
+		close(done)
+	}()
+
+	query := strings.TrimSpace(nmeaSentence("PFLAC,R,ID")) + "\r\n"
+	go readClientNMEA(strings.NewReader(query), client.replies)
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != nmeaSentence("PFLAC,A,ID,A1B2C3") {
+		t.Errorf("reply %q (%v), want the device ID", line, err)
+	}
+
+	// handleMessages() closes ch when the client goes; a query read after that is answered into the void, no panic.
+	close(client.ch)
+	<-done
+	readClientNMEA(strings.NewReader(query), client.replies)
+}
+
+func TestFlarmPerOutputFormats(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.NetworkFLARM = true
+	globalSettings.FLARMSerialOutput = true
+	globalSettings.FLARMSerialSentences = "GPRMC, gpgga" // a panel display wanting GPS only
+	globalSettings.FLARMSerialLineEnd = "LF"
+
+	for len(messageQueue) > 0 {
+		<-messageQueue
+	}
+	sendFlarmTrafficUpdates([]TrafficInfo{flarmTestTarget(0x3C4B51, 48.05, 11.0, 3500)})
+	drainFlarmTestOutput()
+	var udp, serial []string
+	for len(messageQueue) > 0 {
+		m := <-messageQueue
+		switch m.msgType {
+		case NETWORK_FLARM_NMEA:
+			udp = append(udp, string(m.msg))
+		case NETWORK_FLARM_SERIAL:
+			serial = append(serial, string(m.msg))
+		}
+	}
+
+	kinds := func(out []string, lineEnd string) string {
+		var k []string
+		for _, s := range out {
+			if !strings.HasSuffix(s, lineEnd) || (lineEnd == "\n" && strings.HasSuffix(s, "\r\n")) {
+				t.Errorf("%q doesn't end in %q", s, lineEnd)
+			}
+			k = append(k, nmeaFields(strings.TrimSpace(s))[0])
+		}
+		return strings.Join(k, ",")
+	}
+	if got := kinds(udp, "\r\n"); got != "GPRMC,GPGGA,PFLAU,PFLAA" {
+		t.Errorf("UDP got %s, want everything", got)
+	}
+	if got := kinds(serial, "\n"); got != "GPRMC,GPGGA" {
+		t.Errorf("serial got %s, want GPRMC,GPGGA", got)
+	}
+}
+
+func TestFlarmSignalSentence(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMSignalSentence = true
+
+	es := flarmTestTarget(0x3C4B52, 48.05, 11.0, 3500)
+	es.SignalLevel = -27.34
+	glider := flarmTestTarget(0x3D4B53, 48.06, 11.0, 3500)
+	glider.Last_source = TRAFFIC_SOURCE_FLARM // no signal info
+	sendFlarmTraffic([]TrafficInfo{es, glider}, true)
+
+	var got []string
+	for i, out := range rec.sentences() {
+		if f := nmeaFields(out); f[0] == "PSTXS" {
+			if prev := nmeaFields(rec.sentences()[i-1]); prev[0] != "PFLAA" || !strings.HasPrefix(prev[6], f[1]) {
+				t.Errorf("%q doesn't follow its PFLAA", out)
+			}
+			got = append(got, strings.Join(f[1:], ","))
+		}
+	}
+	if want := "3C4B52,-27.3,ES 3D4B53,,FLARM"; strings.Join(got, " ") != want {
+		t.Errorf("PSTXS %v, want %s", got, want)
+	}
+
+	// Off by default, and never part of PFLAA.
+	globalSettings.FLARMSignalSentence = false
+	before := len(rec.sentences())
+	sendFlarmTraffic([]TrafficInfo{es}, true)
+	for _, out := range rec.sentences()[before:] {
+		if f := nmeaFields(out); f[0] == "PSTXS" || (f[0] == "PFLAA" && len(f) != 12) {
+			t.Errorf("with FLARMSignalSentence off: %q", out)
+		}
+	}
+}
+
+func TestFlarmDuplicateICAO(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	// One address, two aircraft: 5.6 km and 2.2 km north, 3.3 km apart. The traffic entry takes the position of
+	// whichever was heard last.
+	far := flarmTestTarget(0x3C4B54, 48.05, 11.0, 3500)
+	near := flarmTestTarget(0x3C4B54, 48.02, 11.0, 3500)
+	other := flarmTestTarget(0x3C4B55, 48.06, 11.0, 3500)
+	cycle := func(ti TrafficInfo) string {
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		ti.Last_seen = stratuxClock.Time
+		before := len(rec.sentences())
+		sendFlarmTraffic([]TrafficInfo{other, ti}, true)
+		north := ""
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAA" && strings.HasPrefix(f[6], "3C4B54") {
+				if north != "" {
+					t.Errorf("two PFLAA for one address in a cycle")
+				}
+				north = f[2]
+			}
+		}
+		return north
+	}
+
+	// Alternating: the icon stays on the track it started with.
+	for i, ti := range []TrafficInfo{far, near, far, near, far} {
+		if got := cycle(ti); got != "5559" && !(i%2 == 1 && got == "") {
+			t.Errorf("cycle %d: PFLAA RelativeNorth %q, want 5559 or nothing", i, got)
+		}
+	}
+	// FLARMDupKeepClosest: the closer one at once, and then it stays.
+	globalSettings.FLARMDupKeepClosest = true
+	for i, ti := range []TrafficInfo{near, far, near, far} {
+		if got := cycle(ti); got != "2223" && !(i%2 == 1 && got == "") {
+			t.Errorf("FLARMDupKeepClosest, cycle %d: PFLAA RelativeNorth %q, want 2223 or nothing", i, got)
+		}
+	}
+	// A jump that persists is real.
+	globalSettings.FLARMDupKeepClosest = false
+	got := ""
+	for i := 0; i <= int(flarmJumpHold/time.Second); i++ {
+		got = cycle(far)
+	}
+	if got != "5559" {
+		t.Errorf("after %v at the new position: PFLAA RelativeNorth %q, want 5559", flarmJumpHold, got)
+	}
+	// A relay repeating the address from nearly the same place passes.
+	relayed := far
+	relayed.Lat += 0.001
+	if got := cycle(relayed); got != "5670" {
+		t.Errorf("relayed copy: PFLAA RelativeNorth %q, want 5670", got)
+	}
+}
+
+func TestFlarmEstimatedFix(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	// Good fix, a brief dead-reckoning stretch, good fix again.
+	for _, tc := range []struct {
+		quality uint8
+		mode    string
+	}{
+		{1, "A"},
+		{6, "E"},
+		{6, "E"},
+		{2, "D"},
+	} {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSFixQuality = tc.quality
+		rmc, gga := nmeaFields(makeGPRMCString()), nmeaFields(makeGPGGAString())
+		if rmc[2] != "A" || rmc[12] != tc.mode {
+			t.Errorf("fix quality %d: GPRMC status %s mode %s, want A and %s", tc.quality, rmc[2], rmc[12], tc.mode)
+		}
+		if gga[0] != "GPGGA" || gga[6] != strconv.Itoa(int(tc.quality)) {
+			t.Errorf("fix quality %d: %v, want GPGGA with quality %d", tc.quality, gga, tc.quality)
+		}
+	}
+}
+
+func TestFlarmVerticalSpeedConsistent(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	gdl90Vvel := func(framed []byte) int16 {
+		// Strip the flag byte and undo the control-escape stuffing to get the raw report.
+		var msg []byte
+		for i := 1; i < len(framed)-1; i++ {
+			if framed[i] == 0x7D {
+				i++
+				msg = append(msg, framed[i]^0x20)
+			} else {
+				msg = append(msg, framed[i])
+			}
+		}
+		return int16(msg[15]&0x0F)<<8 | int16(msg[16])
+	}
+	for _, tt := range []struct {
+		vvel   int16
+		invert bool
+		climb  string
+		gdl90  int16
+	}{
+		{640, false, "3.3", 10},
+		{640, true, "-3.3", 0xFF6},
+		{VVEL_UNAVAILABLE, false, "", 0x800},
+		{VVEL_UNAVAILABLE, true, "", 0x800},
+		{30000, false, "", 0x800}, // implausible
+	} {
+		globalSettings.FLARMInvertClimb = tt.invert
+		ti := flarmTestTarget(0x3C4B31, 48.05, 11.0, 3500)
+		ti.Vvel = tt.vvel
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if f := nmeaFields(msg); !valid || f[10] != tt.climb {
+			t.Errorf("vvel %d invert %v: PFLAA %q, want climb %q", tt.vvel, tt.invert, msg, tt.climb)
+		}
+		if v := gdl90Vvel(makeFlarmGDL90Traffic(flarmTarget{ti: ti})); v != tt.gdl90 {
+			t.Errorf("vvel %d invert %v: GDL90 bridge vertical velocity %#x, want %#x", tt.vvel, tt.invert, v, tt.gdl90)
+		}
+	}
+
+	// The main GDL90 feed ignores the FLARM settings.
+	globalSettings.FLARMInvertClimb = true
+	ti := flarmTestTarget(0x3C4B31, 48.05, 11.0, 3500)
+	ti.Vvel = 640
+	if v := gdl90Vvel(makeTrafficReportMsg(ti)); v != 10 {
+		t.Errorf("FLARMInvertClimb changed the GDL90 traffic report: vertical velocity %#x, want 0xa", v)
+	}
+	drainFlarmTestOutput()
+}
+
+func TestFlarmCallsignCache(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	id := func(tail string) string {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		ti := flarmTestTarget(0x3C4B56, 48.05, 11.0, 3500)
+		ti.Tail = tail
+		before := len(rec.sentences())
+		sendFlarmTraffic([]TrafficInfo{ti}, true)
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAA" {
+				return f[6]
+			}
+		}
+		return ""
+	}
+
+	for i, tt := range []struct {
+		tail     string
+		expected string
+	}{
+		{"DLH4AB", "3C4B56!DLH4AB"},
+		{"", "3C4B56!DLH4AB"}, // partial decode
+		{"DLH4AB", "3C4B56!DLH4AB"},
+		{"", "3C4B56!DLH4AB"},
+		{"DLH9XY", "3C4B56!DLH9XY"}, // a new callsign replaces the cached one
+		{"", "3C4B56!DLH9XY"},
+	} {
+		if got := id(tt.tail); got != tt.expected {
+			t.Errorf("frame %d, tail %q: PFLAA ID %q, want %q", i, tt.tail, got, tt.expected)
+		}
+	}
+
+	stratuxClock.Time = stratuxClock.Time.Add(flarmCallsignHold)
+	if got := id(""); got != "3C4B56!" {
+		t.Errorf("tail empty for %v: PFLAA ID %q, want the cached callsign expired", flarmCallsignHold, got)
+	}
+}
+
+func TestFlarmBearinglessShape(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	// A fully populated ADS-B target first, then bearing-less ones: Mode-C only, and a relative bearing without a
+	// distance that still reports a velocity.
+	adsb := flarmTestTarget(0x3C4B57, 48.01, 11.01, 3200)
+	modeC := TrafficInfo{Icao_addr: 0x3C4B58, Alt: 3100, SignalLevel: -3, Last_source: TRAFFIC_SOURCE_1090ES}
+	bearingOnly := flarmTestTarget(0x3C4B59, 0, 0, 3100)
+	bearingOnly.Position_valid = false
+	bearingOnly.BearingDist_valid, bearingOnly.RelativeOnly = true, true
+	bearingOnly.SignalLevel = -3
+	sendFlarmTraffic([]TrafficInfo{adsb, modeC, bearingOnly}, true)
+
+	got := make(map[string][]string)
+	for _, out := range rec.sentences() {
+		if f := nmeaFields(out); f[0] == "PFLAA" {
+			got[f[6][:6]] = f
+		}
+	}
+	if f := got["3C4B57"]; f == nil || f[3] == "" || f[7] == "" || f[9] == "" || f[10] == "" {
+		t.Fatalf("ADS-B target: PFLAA %v, want East, track, speed and climb", f)
+	}
+	for _, id := range []string{"3C4B58", "3C4B59"} {
+		f := got[id]
+		if len(f) != 12 {
+			t.Errorf("bearing-less %s: PFLAA %v, want 12 fields", id, f)
+			continue
+		}
+		if n, err := strconv.Atoi(f[2]); err != nil || n <= 0 {
+			t.Errorf("bearing-less %s: RelativeNorth %q, want the positive estimated distance", id, f[2])
+		}
+		for i, name := range map[int]string{3: "RelativeEast", 7: "Track", 8: "TurnRate", 9: "GroundSpeed", 10: "ClimbRate"} {
+			if f[i] != "" {
+				t.Errorf("bearing-less %s: %s %q, want empty", id, name, f[i])
+			}
+		}
+	}
+}
+
+func TestFlarmPFLAANoFieldCarryOver(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	globalSettings.FLARMStationarySpeed = 5
+
+	adsb := flarmTestTarget(0x3C4B5A, 48.2, 11.2, 3500)
+	modeC := TrafficInfo{Icao_addr: 0x3C4B5B, Alt: 3100, SignalLevel: -20, Last_source: TRAFFIC_SOURCE_1090ES}
+	relative := flarmTestTarget(0x3C4B5C, 0, 0, 3600)
+	relative.Position_valid = false
+	relative.BearingDist_valid, relative.RelativeOnly = true, true
+	relative.Distance, relative.Bearing = 15000, 250
+	parked := flarmTestTarget(0x3C4B5D, 47.85, 10.9, 1500)
+	parked.Speed, parked.OnGround = 0, true
+	noClimb := flarmTestTarget(0x3C4B5E, 48.1, 10.8, 4000)
+	noClimb.Vvel = VVEL_UNAVAILABLE
+	targets := []TrafficInfo{adsb, modeC, relative, parked, noClimb}
+
+	build := func(order []int) map[uint32]string {
+		out := make(map[uint32]string)
+		for _, i := range order {
+			msg, _, _, _ := makeFlarmPFLAAString(targets[i])
+			out[targets[i].Icao_addr] = msg
+		}
+		return out
+	}
+
+	// Once each to settle the per-target state, then in two orders where every target follows a different type.
+	build([]int{0, 1, 2, 3, 4})
+	expected := build([]int{0, 1, 2, 3, 4})
+	got := build([]int{4, 2, 0, 3, 1, 3, 0, 4, 1, 2})
+	for icao, msg := range expected {
+		if msg == "" {
+			t.Errorf("target %06X: no PFLAA", icao)
+		}
+		if got[icao] != msg {
+			t.Errorf("target %06X: PFLAA %q after another target type, want %q", icao, got[icao], msg)
+		}
+	}
+	if f := nmeaFields(expected[0x3C4B5B]); f[3] != "" || f[7] != "" || f[9] != "" || f[10] != "" {
+		t.Errorf("Mode-C PFLAA %v, want no East, track or velocity", f)
+	}
+	if f := nmeaFields(expected[0x3C4B5D]); f[9] != "" || f[10] != "" {
+		t.Errorf("parked aircraft PFLAA %v, want no velocity", f)
+	}
+	if f := nmeaFields(expected[0x3C4B5E]); f[9] == "" || f[10] != "" {
+		t.Errorf("target without a climb rate: PFLAA %v, want a speed but no climb", f)
+	}
+}
+
+func TestFlarmIdleBackoff(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	defer setTCPClientCount(0, 0)
+	setTCPClientCount(0, 0)
+	globalSettings.NetworkFLARM = false
+	globalSettings.FLARMSerialOutput = false
+	globalSettings.FLARMIdleInterval = 5
+
+	cycle := func() bool {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(nil)
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		return len(rec.sentences()) > before
+	}
+
+	ran := 0
+	for i := 0; i < 10; i++ {
+		if cycle() {
+			ran++
+		}
+	}
+	if ran != 2 {
+		t.Errorf("no consumers: %d cycles in 10 s, want 2", ran)
+	}
+
+	// A client connects in the middle of the backoff.
+	setTCPClientCount(1, 0)
+	for i := 0; i < 3; i++ {
+		if !cycle() {
+			t.Errorf("client connected: cycle %d skipped, want full rate", i)
+		}
+	}
+
+	setTCPClientCount(0, 0)
+	globalSettings.NetworkFLARM = true
+	for i := 0; i < 3; i++ {
+		if !cycle() {
+			t.Errorf("UDP enabled: cycle %d skipped, want full rate", i)
+		}
+	}
+}
+
+func TestFlarmAlarmTypeTaxonomy(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSTrueCourse = 0
+	mySituation.GPSGroundSpeed = 100
+
+	headOn := flarmTestTarget(0x3C4B60, 48.027, 11.0, 3100) // 3 km ahead, opposite direction
+	headOn.Track, headOn.Speed = 180, 100
+	passingAbove := flarmTestTarget(0x3C4B61, 48.027, 11.0, 4500) // 3 km ahead, head-on, 1500 ft above
+	passingAbove.Track, passingAbove.Speed = 180, 100
+	mast := flarmTestTarget(0x3C4B62, 48.02, 11.0, 3100) // 2.2 km ahead, reaching up to our altitude
+	mast.Emitter_category, mast.Speed, mast.Track = 20, 0, 0
+	unknownCourse := flarmTestTarget(0x3C4B63, 0, 0, 3100) // bearing and distance only, no velocity
+	unknownCourse.Position_valid, unknownCourse.Speed_valid = false, false
+	unknownCourse.BearingDist_valid, unknownCourse.RelativeOnly = true, true
+	unknownCourse.Distance, unknownCourse.Bearing = 1500, 30
+	far := flarmTestTarget(0x3C4B64, 48.3, 11.0, 3100)
+
+	tests := []struct {
+		name      string
+		ti        TrafficInfo
+		disabled  bool
+		alarmType uint8
+	}{
+		{"aircraft on a collision course", headOn, false, flarmAlarmTypeAircraft},
+		{"aircraft passing above", passingAbove, false, flarmAlarmTypeAdvisory},
+		{"obstacle", mast, false, flarmAlarmTypeObstacle},
+		{"aircraft, course unknown", unknownCourse, false, flarmAlarmTypeAircraft},
+		{"no alarm", far, false, flarmAlarmTypeNone},
+		{"alarms disabled", headOn, true, flarmAlarmTypeNone},
+		{"alarms disabled, passing above", passingAbove, true, flarmAlarmTypeNone},
+	}
+	for _, tt := range tests {
+		globalSettings.FLARMAlarmsDisabled = tt.disabled
+		_, alarmLevel, _, pflau, _, valid := makeFlarmPFLAA(tt.ti)
+		if !valid {
+			t.Errorf("%s: no PFLAA", tt.name)
+			continue
+		}
+		if tt.alarmType == flarmAlarmTypeNone {
+			if alarmLevel != 0 || pflau != "" {
+				t.Errorf("%s: alarm level %d, PFLAU %q, want no alarm", tt.name, alarmLevel, pflau)
+			}
+			continue
+		}
+		f := nmeaFields(pflau)
+		if len(f) < 8 || f[7] != strconv.Itoa(int(tt.alarmType)) {
+			t.Errorf("%s: PFLAU %q, want alarm type %d", tt.name, pflau, tt.alarmType)
+			continue
+		}
+		// An advisory never carries an alarm level, anything else always does.
+		if advisory := tt.alarmType == flarmAlarmTypeAdvisory; advisory != (alarmLevel == 0) || f[5] != strconv.Itoa(int(alarmLevel)) {
+			t.Errorf("%s: alarm level %d, PFLAU %q: level and type don't match", tt.name, alarmLevel, pflau)
+		}
+	}
+}
+
+func TestFlarmNoFixRMCMode(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	mySituation.GPSFixQuality = 2
+	if f := nmeaFields(makeGPRMCString()); f[2] != "A" || f[12] != "D" {
+		t.Fatalf("DGPS fix: GPRMC status %s mode %s, want A and D", f[2], f[12])
+	}
+
+	// The first frame after losing the fix: the fix has gone stale, but the quality isn't zeroed yet.
+	stratuxClock.Time = stratuxClock.Time.Add(5 * time.Second)
+	if f := nmeaFields(makeGPRMCString()); f[2] != "V" || f[12] != "N" {
+		t.Errorf("fix lost, quality still 2: GPRMC status %s mode %s, want V and N", f[2], f[12])
+	}
+	mySituation.GPSFixQuality = 0
+	if f := nmeaFields(makeGPRMCString()); f[2] != "V" || f[12] != "N" {
+		t.Errorf("no fix: GPRMC status %s mode %s, want V and N", f[2], f[12])
+	}
+}
+
+func TestFlarmVerticalAGL(t *testing.T) {
+	defer saveFlarmTestState()()
+	defer func(terrain func(lat, lng float64) (float32, bool)) { flarmTerrain = terrain }(flarmTerrain)
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	// We fly 2000 ft above a 1000 ft plain; the target is 500 ft higher, but only 1500 ft above a 2000 ft ridge.
+	flarmTerrain = func(lat, lng float64) (float32, bool) {
+		switch {
+		case lat < 48.01:
+			return 1000, true
+		case lat < 48.1:
+			return 2000, true
+		}
+		return 0, false // beyond the terrain data
+	}
+	overRidge := flarmTestTarget(0x3C4B65, 48.05, 11.0, 3500)
+	noTerrain := flarmTestTarget(0x3C4B66, 48.15, 11.0, 3500)
+
+	tests := []struct {
+		agl      bool
+		ti       TrafficInfo
+		expected string
+	}{
+		{false, overRidge, "152"},
+		{true, overRidge, "-152"},
+		{true, noTerrain, "152"}, // falls back to the altitude difference
+	}
+	for _, tt := range tests {
+		globalSettings.FLARMVerticalAGL = tt.agl
+		msg, _, _, valid := makeFlarmPFLAAString(tt.ti)
+		if f := nmeaFields(msg); !valid || f[4] != tt.expected {
+			t.Errorf("FLARMVerticalAGL %v, target %06X: PFLAA %q, want RelativeVertical %s", tt.agl, tt.ti.Icao_addr, msg, tt.expected)
+		}
+	}
+}
+
+func TestFlarmPFLAUGPSField(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	tests := []struct {
+		name     string
+		setFix   func()
+		expected string
+	}{
+		{"3D fix", func() {}, "2"},
+		{"2D fix", func() { mySituation.GPSFix2D = true }, "1"},
+		{"2D fix, 3 satellites", func() { mySituation.GPSSatellites = 3 }, "1"},
+		{"no fix", func() { mySituation.GPSFixQuality = 0 }, "0"},
+	}
+	for _, tt := range tests {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSFix2D = false
+		tt.setFix()
+		if f := nmeaFields(makeFlarmIdlePFLAU()); f[3] != tt.expected {
+			t.Errorf("%s: idle PFLAU GPS field %s, want %s", tt.name, f[3], tt.expected)
+		}
+		if tt.expected == "0" {
+			continue // no fix, no traffic geometry and no alarm
+		}
+		_, _, _, pflau, _, _ := makeFlarmPFLAA(flarmTestTarget(0x3C4B67, 48.005, 11.0, 3100))
+		if f := nmeaFields(pflau); len(f) < 4 || f[3] != tt.expected {
+			t.Errorf("%s: alarm PFLAU %q, want GPS field %s", tt.name, pflau, tt.expected)
+		}
+	}
+}
+
+func TestFlarmNonWGS84Datum(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	for _, tt := range []struct {
+		datum string
+		shown bool
+	}{
+		{"", true},
+		{"WGS84", true},
+		{"w84", true},
+		{"ED50", false}, // legacy European datum, ~100 m off in places
+		{"NAD27", false},
+	} {
+		ti := flarmTestTarget(0x3C4B68, 48.05, 11.0, 3500)
+		ti.Datum = tt.datum
+		if _, _, _, valid := makeFlarmPFLAAString(ti); valid != tt.shown {
+			t.Errorf("datum %q: PFLAA sent %v, want %v", tt.datum, valid, tt.shown)
+		}
+	}
+}
+
+func TestFlarmOutputBudget(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	near := flarmTestTarget(0x3C4B70, 48.003, 11.0, 3100) // 330 m, alarm
+	targets := []TrafficInfo{near}
+	for i := 0; i < 5; i++ { // 17-26 km, beyond the alarm rings
+		targets = append(targets, flarmTestTarget(0x3C4B71+uint32(i), 48.15+0.02*float32(i), 11.0, 3500))
+	}
+
+	cycle := func() (ids []string) {
+		before := len(rec.sentences())
+		sendFlarmTraffic(targets, true)
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAA" {
+				ids = append(ids, f[6][:6])
+			}
+		}
+		return ids
+	}
+
+	// PFLAU and the alarm take about 100 bytes; of the distant targets only the closest fit in what's left.
+	globalSettings.FLARMMaxBytesPerSec = 250
+	for i := 0; i < 3; i++ {
+		if got := cycle(); len(got) < 2 || len(got) > 4 || got[0] != "3C4B70" || got[1] != "3C4B71" {
+			t.Errorf("cycle %d, 250 bytes/s: PFLAA %v, want the alarm and the closest of the distant targets", i, got)
+		}
+	}
+
+	// Far too little for anything: the alarm still goes out.
+	globalSettings.FLARMMaxBytesPerSec = 1
+	if got := cycle(); len(got) != 1 || got[0] != "3C4B70" {
+		t.Errorf("1 byte/s: PFLAA %v, want the alarm only", got)
+	}
+
+	// With duplicates skipped, a PFLAA shed for the budget was never sent, so it goes out once the budget is back.
+	globalSettings.FLARMSkipDuplicates = true
+	cycle()
+	globalSettings.FLARMMaxBytesPerSec = 0
+	if got := cycle(); len(got) != len(targets)-1 || got[0] != "3C4B71" {
+		t.Errorf("budget back: PFLAA %v, want every distant target (the unchanged alarm is a duplicate)", got)
+	}
+	globalSettings.FLARMSkipDuplicates = false
+
+	globalSettings.FLARMMaxBytesPerSec = 0
+	if got := cycle(); len(got) != len(targets) {
+		t.Errorf("no budget: %d PFLAA, want all %d", len(got), len(targets))
+	}
+}
+
+func TestFlarmRangeQuery(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	query := strings.TrimSpace(nmeaSentence("PFLAC,R,RANGE"))
+
+	at15km := flarmTestTarget(0x3C4B76, 48.135, 11.0, 3500)
+	at20km := flarmTestTarget(0x3C4B77, 48.18, 11.0, 3500)
+	at40km := flarmTestTarget(0x3C4B78, 48.36, 11.0, 3500)
+	for _, tt := range []struct {
+		rangeNM float64
+		meters  string
+		shown   []TrafficInfo
+		hidden  []TrafficInfo
+	}{
+		{0, "32767", []TrafficInfo{at15km, at20km, at40km}, nil}, // unlimited: the PFLAA distance limit
+		{10, "18520", []TrafficInfo{at15km}, []TrafficInfo{at20km, at40km}},
+		{50, "32767", []TrafficInfo{at15km, at20km}, nil},
+	} {
+		globalSettings.FLARMMaxRangeNM = tt.rangeNM
+		if f := nmeaFields(parseClientNMEA(query)); len(f) != 4 || f[1] != "A" || f[2] != "RANGE" || f[3] != tt.meters {
+			t.Errorf("FLARMMaxRangeNM %v: RANGE reply %v, want %s m", tt.rangeNM, f, tt.meters)
+		}
+		for _, ti := range tt.shown {
+			if _, _, _, valid := makeFlarmPFLAAString(ti); !valid {
+				t.Errorf("FLARMMaxRangeNM %v: target %06X not sent, want it within range", tt.rangeNM, ti.Icao_addr)
+			}
+		}
+		for _, ti := range tt.hidden {
+			if _, _, _, valid := makeFlarmPFLAAString(ti); valid {
+				t.Errorf("FLARMMaxRangeNM %v: target %06X sent, want it filtered", tt.rangeNM, ti.Icao_addr)
+			}
+		}
+	}
+
+	// Beyond the field's limit a target is clamped to it rather than wrapping around.
+	globalSettings.FLARMMaxRangeNM = 0
+	if msg, _, _, _ := makeFlarmPFLAAString(at40km); nmeaFields(msg)[2] != "32767" {
+		t.Errorf("40 km north: PFLAA %q, want RelativeNorth clamped to 32767", msg)
+	}
+}
+
+func TestFlarmStableIDType(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	pflaa := func(ti TrafficInfo) (idType, id string) {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if !valid {
+			t.Fatalf("target %06X: no PFLAA", ti.Icao_addr)
+		}
+		f := nmeaFields(msg)
+		return f[5], f[6][:6]
+	}
+
+	// First received by ADS-B, then also as a FLARM beacon reporting the address as a FLARM ID.
+	adsb := flarmTestTarget(0x3C4B79, 48.05, 11.0, 3500)
+	beacon := adsb
+	beacon.Last_source, beacon.FlarmIDType = TRAFFIC_SOURCE_FLARM, 2
+	for i, ti := range []TrafficInfo{adsb, beacon, adsb, beacon} {
+		if idType, id := pflaa(ti); idType != "1" || id != "3C4B79" {
+			t.Errorf("report %d: IDType %s ID %s, want 1 3C4B79 throughout", i, idType, id)
+		}
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	}
+
+	// The address gone for a while, then back on a different aircraft.
+	stratuxClock.Time = stratuxClock.Time.Add(flarmStateTTL)
+	if idType, _ := pflaa(beacon); idType != "2" {
+		t.Errorf("recycled address: IDType %s, want 2 as reported", idType)
+	}
+
+	stealth := flarmTestTarget(0x3C4B7A, 48.06, 11.0, 3500)
+	stealth.Last_source, stealth.FlarmIDType = TRAFFIC_SOURCE_FLARM, 3
+	if idType, _ := pflaa(stealth); idType != "3" {
+		t.Errorf("anonymous FLARM: IDType %s, want 3", idType)
+	}
+
+	random := flarmTestTarget(0x3C4B88, 48.07, 11.0, 3500)
+	random.Last_source, random.FlarmIDType = TRAFFIC_SOURCE_FLARM, 0
+	for i := 0; i < 2; i++ {
+		if idType, _ := pflaa(random); idType != "0" {
+			t.Errorf("report %d: random FLARM ID: IDType %s, want 0", i, idType)
+		}
+	}
+
+	for _, tc := range []struct {
+		addressType byte
+		stealth     bool
+		want        uint8
+	}{
+		{0, false, 0}, // random
+		{1, false, 1}, // ICAO
+		{2, false, 2}, // FLARM
+		{3, false, 2}, // OGN tracker
+		{1, true, 3},  // stealth
+		{0, true, 3},
+	} {
+		if got := flarmAddressIDType(tc.addressType, tc.stealth); got != tc.want {
+			t.Errorf("OGN address type %d, stealth %v: IDType %d, want %d", tc.addressType, tc.stealth, got, tc.want)
+		}
+	}
+}
+
+func TestFlarmTrafficAtDGPSFix(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.NetworkFLARM = true
+
+	for _, tt := range []struct {
+		quality    uint8
+		satellites uint16
+		vertical   string
+	}{
+		{1, 8, "30"},
+		{2, 8, "30"},
+		{2, 3, ""}, // 2D: no GPS altitude to compare with, but the target is still shown
+	} {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSFixQuality, mySituation.GPSSatellites = tt.quality, tt.satellites
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{flarmTestTarget(0x3C4B7B, 48.005, 11.0, 3100)})
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+
+		got := make(map[string][]string)
+		for _, out := range rec.sentences()[before:] {
+			f := nmeaFields(out)
+			got[f[0]] = f
+		}
+		if f := got["GPGGA"]; f == nil || f[6] != strconv.Itoa(int(tt.quality)) {
+			t.Errorf("quality %d, %d satellites: GPGGA %v", tt.quality, tt.satellites, f)
+		}
+		if f := got["PFLAA"]; f == nil || f[4] != tt.vertical {
+			t.Errorf("quality %d, %d satellites: PFLAA %v, want the target with RelativeVertical %q", tt.quality, tt.satellites, f, tt.vertical)
+		}
+		if f := got["PFLAU"]; f == nil || f[5] == "0" {
+			t.Errorf("quality %d, %d satellites: PFLAU %v, want an alarm", tt.quality, tt.satellites, f)
+		}
+	}
+}
+
+func TestFlarmTestObjects(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMTestObjects = "48.02 11.0 3000; 47.5 10.5 1500"
+
+	cycle := func(lat float32) (pflaa, pflau []string) {
+		setFlarmTestOwnship(lat, 11.0, 3000)
+		before := len(rec.sentences())
+		sendFlarmTrafficUpdates(nil)
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		for _, out := range rec.sentences()[before:] {
+			switch f := nmeaFields(out); {
+			case f[0] == "PFLAA" && strings.HasPrefix(f[6], "FFFFF0"):
+				pflaa = f
+			case f[0] == "PFLAU":
+				pflau = f
+			}
+		}
+		return pflaa, pflau
+	}
+
+	// Parked right next to the object: shown, but no alarm.
+	for i := 0; i < 3; i++ {
+		pflaa, pflau := cycle(48.0201)
+		if pflaa == nil || pflaa[1] != "0" || pflaa[11] != "F" {
+			t.Errorf("co-located, cycle %d: PFLAA %v, want a static object without alarm", i, pflaa)
+		}
+		if pflau == nil || pflau[5] != "0" {
+			t.Errorf("co-located, cycle %d: PFLAU %v, want no alarm", i, pflau)
+		}
+	}
+
+	// Away, then back towards it.
+	cycle(48.0)
+	var pflau []string
+	for i := 0; i < 3; i++ {
+		_, pflau = cycle(48.015)
+	}
+	if pflau == nil || pflau[5] == "0" || pflau[7] != "3" || !strings.HasPrefix(pflau[10], "FFFFF0") {
+		t.Errorf("approaching the object: PFLAU %v, want an obstacle alarm (type 3) for FFFFF0", pflau)
+	}
+
+	// The height is MSL: with a baro sensor reading 300 ft high for the QNH, an object at our GPS altitude is level.
+	mySituation.BaroLastMeasurementTime = stratuxClock.Time
+	mySituation.BaroPressureAltitude = 3300
+	if pflaa, _ := cycle(48.015); pflaa == nil || pflaa[4] != "0" {
+		t.Errorf("object at our MSL altitude, pressure altitude 300 ft higher: PFLAA %v, want RelativeVertical 0", pflaa)
+	}
+	mySituation.BaroLastMeasurementTime = time.Time{}
+
+	// A real aircraft with an address in the test object range isn't silenced with them.
+	globalSettings.FLARMTestObjects = "48.0201 11.0 3000"
+	stratuxClock.Time = stratuxClock.Time.Add(flarmOwnFixGap) // moving there at once would trip the ownship jump gate
+	cycle(48.0201)
+	setFlarmTestOwnship(48.0201, 11.0, 3000)
+	real := flarmTestTarget(flarmTestObjectID, 48.023, 11.0, 3100)
+	if _, alarmLevel, _, _ := makeFlarmPFLAAString(real); alarmLevel == 0 {
+		t.Errorf("aircraft with address %06X: no alarm while a test object is quiet", flarmTestObjectID)
+	}
+	drainFlarmTestOutput()
+
+	for _, bad := range []string{"48.02 11.0", "95 11 3000", "48 11 3000; x"} {
+		if _, err := parseFlarmTestObjects(bad); err == nil {
+			t.Errorf("test objects %q accepted", bad)
+		}
+	}
+}
+
+func TestFlarmRearArc(t *testing.T) {
+	defer saveFlarmTestState()()
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	behind := flarmTestTarget(0x3C4B7C, 47.82, 11.0, 3100) // 20 km astern, beyond the alarm rings
+	behind.Track = 0
+	ahead := flarmTestTarget(0x3C4B7D, 48.18, 11.0, 3100)
+	overtaking := flarmTestTarget(0x3C4B7E, 47.973, 11.0, 3100) // 3 km astern, 100 kt faster
+	overtaking.Track, overtaking.Speed = 0, 200
+
+	shown := func(ownSpeed float64) map[string]bool {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSTrueCourse, mySituation.GPSGroundSpeed = 0, ownSpeed
+		var before int
+		for i := 0; i < 3; i++ { // past the first-seen alarm hold
+			before = len(rec.sentences())
+			sendFlarmTraffic([]TrafficInfo{behind, ahead, overtaking}, true)
+			stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+			setFlarmTestOwnship(48.0, 11.0, 3000)
+		}
+		ids := make(map[string]bool)
+		for _, out := range rec.sentences()[before:] {
+			if f := nmeaFields(out); f[0] == "PFLAA" {
+				ids[f[6][:6]] = true
+			}
+		}
+		return ids
+	}
+
+	for _, tt := range []struct {
+		arc      int
+		ownSpeed float64
+		behind   bool
+	}{
+		{0, 100, true},
+		{60, 100, false},
+		{60, 0, true}, // parked: no track, so nothing is behind
+	} {
+		globalSettings.FLARMRearArc = tt.arc
+		ids := shown(tt.ownSpeed)
+		if ids["3C4B7C"] != tt.behind || !ids["3C4B7D"] || !ids["3C4B7E"] {
+			t.Errorf("rear arc %d°, own speed %.0f kt: PFLAA for %v, want astern %v, ahead and overtaking shown", tt.arc, tt.ownSpeed, ids, tt.behind)
+		}
+	}
+}
+
+func TestFlarmConnectReplay(t *testing.T) {
+	defer saveFlarmTestState()()
+	_, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMConnectReplay = true
+
+	// Two targets, then one of them goes quiet for longer than the replay window.
+	gone := flarmTestTarget(0x3C4B7F, 48.05, 11.0, 3500)
+	stays := flarmTestTarget(0x3C4B80, 48.06, 11.0, 3500)
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	sendFlarmTrafficUpdates([]TrafficInfo{gone, stays})
+	for i := 0; i < 4; i++ {
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		sendFlarmTrafficUpdates([]TrafficInfo{stays})
+	}
+
+	server := newNMEAServer(make(chan clientMessage, 16))
+	defer server.shutdown()
+	if server.listen([]int{0}) != 1 {
+		t.Fatalf("listener not started")
+	}
+	c, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(c)
+	if _, err := io.ReadFull(r, make([]byte, len("PASS?AOK"))); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	for _, want := range []string{"$GPRMC,", "$GPGGA,", "$PFLAA,"} {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, want) || want == "$PFLAA," && nmeaFields(line)[6] != "3C4B80!N12345" {
+			t.Errorf("replay: %q (%v), want %s... (PFLAA of 3C4B80)", line, err, want)
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("replay: %q after the snapshot, want nothing (stale target 3C4B7F)", line)
+	}
+}
+
+func TestFlarmGGASatelliteCount(t *testing.T) {
+	defer saveFlarmTestState()()
+	for _, tt := range []struct {
+		satellites uint16
+		all        bool
+		expected   string
+	}{
+		{8, false, "8"},
+		{12, false, "12"},
+		{23, false, "12"}, // NMEA 0183 caps the field at 12
+		{8, true, "8"},
+		{23, true, "23"},
+	} {
+		setFlarmTestOwnship(48.0, 11.0, 3000)
+		mySituation.GPSSatellites = tt.satellites
+		globalSettings.FLARMGGAAllSats = tt.all
+		if f := nmeaFields(makeGPGGAString()); f[7] != tt.expected {
+			t.Errorf("%d satellites, FLARMGGAAllSats %v: GPGGA numSV %s, want %s", tt.satellites, tt.all, f[7], tt.expected)
+		}
+	}
+}
+
+func TestFlarmFieldEscapingFuzz(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+
+	check := func(tail []byte) bool {
+		ti := flarmTestTarget(0x3C4B81, 48.05, 11.0, 3500)
+		ti.Tail = string(tail)
+		msg, _, _, valid := makeFlarmPFLAAString(ti)
+		if !valid || msg == "" {
+			t.Logf("tail %q: no PFLAA", tail)
+			return false
+		}
+		sentences := []string{
+			msg,
+			flarmPFLAAVariant(msg, ti.Tail, false),
+			flarmPFLAAVariant(msg, ti.Tail, true),
+			makeFlarmSignalString(msg, ti),
+		}
+		for _, s := range sentences {
+			if err := validateSentence(s); err != nil {
+				t.Logf("tail %q: %v", tail, err)
+				return false
+			}
+		}
+		for _, s := range sentences[:3] {
+			fields := nmeaFields(s)
+			if len(fields) != 12 {
+				t.Logf("tail %q: %d PFLAA fields in %q", tail, len(fields), s)
+				return false
+			}
+			if i := strings.IndexByte(fields[6], '!'); i >= 0 && strings.ContainsAny(fields[6][i+1:], nmeaReserved) {
+				t.Logf("tail %q: reserved character in callsign %q", tail, fields[6])
+				return false
+			}
+		}
+		return true
+	}
+
+	// Control characters and high bytes as a garbled decode would produce them, then random tails.
+	corpus := []string{
+		"", " ", "N1*23", "D-$ABC", "A,B,C", "X\r\nY", "ONE!TWO", "\\^~", "Müller", "\x00\x01\x1b[0m", "\x7f\x80\xff\xfe",
+		"\xc3\x28", "$GPRMC,*00\r\n", strings.Repeat("W", 64), strings.Repeat("*", 64),
+	}
+	for _, tail := range corpus {
+		if !check([]byte(tail)) {
+			t.Errorf("tail %q produced a malformed sentence", tail)
+		}
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlarmAlarmTieBreak(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+
+	// Two threats about 3 km north and south, trading which is 20-odd meters closer every cycle.
+	cycle := func(north, south float32) (level, id string) {
+		n := len(rec.sentences())
+		sendFlarmTrafficUpdates([]TrafficInfo{
+			flarmTestTarget(0x3C4B83, 48.0+north, 11.0, 3500),
+			flarmTestTarget(0x3C4B82, 48.0-south, 11.0, 3500),
+		})
+		for _, s := range rec.sentences()[n:] {
+			if strings.HasPrefix(s, "$PFLAU,") {
+				f := nmeaFields(s)
+				return f[5], f[10]
+			}
+		}
+		t.Fatalf("no PFLAU")
+		return "", ""
+	}
+
+	first := ""
+	for i := 0; i < 6; i++ {
+		noise := float32(0.0002) // ~22 m
+		if i%2 == 1 {
+			noise = -noise
+		}
+		level, id := cycle(0.027+noise, 0.027-noise)
+		if level == "0" {
+			t.Fatalf("cycle %d: no alarm", i)
+		}
+		if first == "" {
+			first = id
+		} else if id != first {
+			t.Errorf("cycle %d: PFLAU alarm moved from %s to %s on position noise", i, first, id)
+		}
+	}
+	if _, id := cycle(0.027, 0.027); id != first {
+		t.Errorf("exact tie: PFLAU alarm moved from %s to %s", first, id)
+	}
+
+	// The other threat clearly closer: the alarm follows it.
+	other := "3C4B82"
+	north, south := float32(0.027), float32(0.024) // ~330 m
+	if first == "3C4B82" {
+		other = "3C4B83"
+		north, south = south, north
+	}
+	if _, id := cycle(north, south); id != other {
+		t.Errorf("PFLAU alarm stayed on %s with %s 330 m closer", id, other)
+	}
+
+	// A negative margin always picks the closest; an exact tie goes to the lower address.
+	globalSettings.FLARMAlarmTieMargin = -1
+	if _, id := cycle(0.0272, 0.0268); id != "3C4B82" {
+		t.Errorf("margin off: PFLAU alarm on %s, expected the closest 3C4B82", id)
+	}
+	if _, id := cycle(0.0268, 0.0272); id != "3C4B83" {
+		t.Errorf("margin off: PFLAU alarm on %s, expected the closest 3C4B83", id)
+	}
+	flarmStates.alarmValid = false
+	if _, id := cycle(0.027, 0.027); id != "3C4B82" {
+		t.Errorf("exact tie: PFLAU alarm on %s, expected the lower address 3C4B82", id)
+	}
+}
+
+func TestFlarmAlarmTieBreakPseudoID(t *testing.T) {
+	defer saveFlarmTestState()()
+
+	// Address-less targets all have address 0; the previous alarm target is recognized by its pseudo ID.
+	alarms := func(a, b float64) []flarmTarget {
+		return []flarmTarget{
+			{id: 0x00A001, alarmLevel: 3, dist: a, pflau: "A"},
+			{id: 0x00B002, alarmLevel: 3, dist: b, pflau: "B"},
+		}
+	}
+	if alarm, _ := selectFlarmAlarm(alarms(3020, 3000)); alarm.id != 0x00B002 {
+		t.Fatalf("PFLAU alarm on %06X, expected the closest 00B002", alarm.id)
+	}
+	if alarm, _ := selectFlarmAlarm(alarms(3000, 3020)); alarm.id != 0x00B002 {
+		t.Errorf("PFLAU alarm moved from 00B002 to %06X on position noise", alarm.id)
+	}
+	if alarm, _ := selectFlarmAlarm(alarms(2500, 3000)); alarm.id != 0x00A001 {
+		t.Errorf("PFLAU alarm stayed on %06X with 00A001 500 m closer", alarm.id)
+	}
+
+	flarmStates.alarmValid = false
+	if alarm, _ := selectFlarmAlarm(alarms(3000, 3000)); alarm.id != 0x00A001 {
+		t.Errorf("exact tie: PFLAU alarm on %06X, expected the lower ID 00A001", alarm.id)
+	}
+	if alarm, _ := selectFlarmAlarm([]flarmTarget{{id: 0x00B002, alarmLevel: 3, dist: 3000}, {id: 0x00A001, alarmLevel: 3, dist: 3000}}); alarm.id != 0x00A001 {
+		t.Errorf("exact tie, reversed order: PFLAU alarm on %06X, expected the lower ID 00A001", alarm.id)
+	}
+}
+
+func TestFlarmEmitPFLAUOff(t *testing.T) {
+	defer saveFlarmTestState()()
+	setFlarmTestOwnship(48.0, 11.0, 3000)
+	rec, restore := captureFlarmOutput()
+	defer restore()
+	globalSettings.FLARMEmitPFLAU = false
+	globalSettings.FLARMPFLAUInterval = 0
+
+	threat := flarmTestTarget(0x3C4B84, 48.02, 11.0, 3200)
+	distant := flarmTestTarget(0x3C4B85, 48.2, 11.0, 3500)
+	cycle := func(targets []TrafficInfo) (pflau, pflaa []string) {
+		n := len(rec.sentences())
+		sendFlarmTrafficUpdates(targets)
+		for _, s := range rec.sentences()[n:] {
+			switch {
+			case strings.HasPrefix(s, "$PFLAU,"):
+				pflau = append(pflau, s)
+			case strings.HasPrefix(s, "$PFLAA,"):
+				pflaa = append(pflaa, s)
+			}
+		}
+		return pflau, pflaa
+	}
+
+	pflau, pflaa := cycle([]TrafficInfo{threat, distant})
+	if len(pflau) != 0 {
+		t.Errorf("FLARMEmitPFLAU off: PFLAU sent: %q", pflau)
+	}
+	if len(pflaa) != 2 {
+		t.Errorf("FLARMEmitPFLAU off: %d PFLAA, expected 2", len(pflaa))
+	} else if f := nmeaFields(pflaa[0]); f[1] == "0" {
+		t.Errorf("no alarm level in the PFLAA %q", pflaa[0])
+	}
+	if pflau, _ := cycle(nil); len(pflau) != 0 {
+		t.Errorf("FLARMEmitPFLAU off: idle PFLAU sent: %q", pflau)
+	}
+	globalSettings.FLARMGPSOnly, globalSettings.FLARMGPSOnlyPFLAU = true, true
+	if pflau, _ := cycle(nil); len(pflau) != 0 {
+		t.Errorf("FLARMEmitPFLAU off: GPS-only PFLAU sent: %q", pflau)
+	}
+	globalSettings.FLARMGPSOnly, globalSettings.FLARMGPSOnlyPFLAU = false, false
+
+	// The heartbeat brings back the idle PFLAU only, never an alarm.
+	globalSettings.FLARMPFLAUHeartbeat = true
+	pflau, pflaa = cycle([]TrafficInfo{threat, distant})
+	if len(pflau) != 1 || len(pflaa) != 2 {
+		t.Fatalf("heartbeat: %d PFLAU, %d PFLAA, expected 1 and 2", len(pflau), len(pflaa))
+	}
+	if pflau[0] != makeFlarmIdlePFLAU() {
+		t.Errorf("heartbeat: PFLAU %q, expected the idle %q", pflau[0], makeFlarmIdlePFLAU())
+	}
+}
@@ -284,10 +284,18 @@ func isDetectedOwnshipValid() bool {
 }
 
 func makeOwnshipReport() bool {
+	msg, ok := makeOwnshipReportMsg()
+	if ok {
+		sendGDL90(msg, false)
+	}
+	return ok
+}
+
+func makeOwnshipReportMsg() ([]byte, bool) {
 	gpsValid := isGPSValid()
 	selfOwnshipValid := isDetectedOwnshipValid()
 	if !gpsValid && !selfOwnshipValid {
-		return false
+		return nil, false
 	}
 	curOwnship := OwnshipTrafficInfo
 
@@ -435,13 +443,20 @@ func makeOwnshipReport() bool {
 		msg[19+i] = myReg[i]
 	}
 
-	sendGDL90(prepareMessage(msg), false)
-	return true
+	return prepareMessage(msg), true
 }
 
 func makeOwnshipGeometricAltitudeReport() bool {
+	msg, ok := makeOwnshipGeometricAltitudeMsg()
+	if ok {
+		sendGDL90(msg, false)
+	}
+	return ok
+}
+
+func makeOwnshipGeometricAltitudeMsg() ([]byte, bool) {
 	if !isGPSValid() {
-		return false
+		return nil, false
 	}
 	msg := make([]byte, 5)
 	// See p.28.
@@ -461,8 +476,7 @@ func makeOwnshipGeometricAltitudeReport() bool {
 	msg[3] = 0x00
 	msg[4] = 0x0A
 
-	sendGDL90(prepareMessage(msg), false)
-	return true
+	return prepareMessage(msg), true
 }
 
 /*
@@ -1136,6 +1150,84 @@ type settings struct {
 	WiFiSecurityEnabled  bool
 	WiFiPassphrase       string
 	GDL90MSLAlt_Enabled  bool
+	NetworkFLARM         bool     // Send FLARM NMEA over UDP (port 10110) in addition to the TCP server.
+	FLARMStatusSentence  bool     // Send the proprietary $PSTX Stratux status sentence with the FLARM NMEA output.
+	FLARMMaxTargets      int      // Maximum number of PFLAA targets per cycle, most relevant first. 0 = no limit.
+	FLARMOutputProfile   string   // FLARM_PROFILE_FLARM, FLARM_PROFILE_PILOTAWARE or FLARM_PROFILE_XCSOAR.
+	FLARMLatLngPrecision int      // Decimal places on the GPGGA/GPRMC latitude/longitude minutes, 3-6. 0 = default (5).
+	FLARMOwnshipTail     string   // Suppress FLARM traffic with this tail, in addition to the OwnshipModeS check. Empty = off.
+	FLARMAlarmsDisabled  bool     // Formation / airshow mode: all FLARM alarm levels forced to 0, traffic still shown.
+	FLARMModeCBand       int      // Vertical band (meters, +/-) within which Mode-C targets are shown. 0 = default (310).
+	FLARMSkipIdle        bool     // Don't generate FLARM NMEA while UDP and serial output are off and no TCP client is connected.
+	FLARMClimbSmoothing  int      // Time constant (seconds) for smoothing target climb rates in PFLAA. 0 = off.
+	FLARMGPSOnly         bool     // Send only the GPS sentences (GPRMC/GPGGA) on the FLARM NMEA output, no PFLAA/PFLAU traffic.
+	FLARMGPSOnlyPFLAU    bool     // With FLARMGPSOnly, still send an idle "no traffic" PFLAU heartbeat.
+	FLARMReadClientNMEA  bool     // Read NMEA sent by TCP clients, e.g. $GPHDT heading from the EFB while we're too slow for a GPS track.
+	FLARMTCPPorts        []int    // TCP ports serving the FLARM NMEA stream. Empty = 2000 (AIR Connect). Applied at startup.
+	FLARMAirborneOnly    bool     // Only send airborne FLARM traffic: moving, not on the ground, and above us while we're on the ground.
+	FLARMInvertClimb     bool     // Invert the sign of target climb rates, for a traffic source reporting descent as positive.
+	FLARMDeadReckoning   bool     // Extrapolate target positions between reports (up to 3 s) for smoother FLARM traffic.
+	FLARMMaxGroundSpeed  int      // Targets reporting a higher ground speed (knots) are treated as decode errors. 0 = default (1000).
+	FLARMPositionStep    int      // Round PFLAA RelativeNorth/East to this many meters. 0 or 1 = full 1 m resolution.
+	FLARMConvergingAlarm bool     // Raise the FLARM alarm level by one for traffic converging on us vertically.
+	FLARMAlarmConfirm    bool     // A new target can't raise a FLARM alarm before its second report, held back 500 ms at most.
+	FLARMNMEA41          bool     // NMEA 4.1 GPRMC layout, with the navigational status field after the mode indicator.
+	FLARMSkipDuplicates  bool     // Don't resend an unchanged PFLAA for a target, except every 2 s to keep it from timing out.
+	FLARMLowVoltage      float64  // Supply voltage below which PFLAU reports <Power> 0. 0 = never.
+	FLARMMagneticBearing bool     // Reference the PFLAU relative bearing to magnetic instead of true north.
+	FLARMDeclination     float64  // Local magnetic declination for FLARMMagneticBearing, degrees, east positive. 0 = not set, no magnetic conversion.
+	FLARMStationarySpeed int      // Ground speed (knots) below which grounded targets and obstacles get empty PFLAA velocity fields. 0 = off.
+	FLARMFixedInterval   int      // Emit FLARM NMEA every this many ms from the latest traffic state, not with the 1 s traffic update. 0 = off.
+	FLARMICAOAllowlist   []uint32 // Only these ICAO addresses are sent as PFLAA traffic. Empty = all.
+	FLARMTowPlanes       []uint32 // ICAO addresses sent with FLARM aircraft type 2 (tow / tug plane).
+	FLARMDropPlanes      []uint32 // ICAO addresses sent with FLARM aircraft type 5 (skydiver drop plane).
+	FLARMGeoidCorrection bool     // Convert GNSS (HAE) target altitudes to MSL and compare with GPS MSL for the relative vertical.
+	FLARMLowercaseID     bool     // Send PFLAA/PFLAU IDs as lowercase hex, for receivers matching IDs case-sensitively.
+	FLARMQNH             float64  // QNH (hPa) for a baro altitude in GPGGA when the GPS has no altitude. 0 = unknown, no fallback.
+	FLARMOverheadSep     int      // Vertical separation (m) at which traffic within 300 m horizontally only raises alarm level 1. 0 = off.
+	FLARMSimGPS          string   // Debug: simulated GPRMC/GPGGA fix, "<lat> <lng> <track> <knots> <feet MSL>". Empty = real GPS.
+	FLARMRingHysteresis  int      // Meters beyond an alarm ring a target must move before its alarm level drops. 0 = default (200).
+	FLARMPFLAUInterval   int      // Longest time (ms) without a PFLAU before an idle one is sent. 0 = every cycle without one.
+	FLARMConnectPosition bool     // Send GPRMC/GPGGA to a new TCP client right after the handshake.
+	FLARMClimbDeadband   float64  // PFLAA climb rates (m/s) smaller than this in magnitude are sent as level, 0.0. 0 = off.
+	FLARMGDL90Port       int      // TCP port serving GDL90 built from the FLARM traffic, for a GDL90-over-TCP app next to a FLARM app. 0 = off. Applied at startup.
+	FLARMClimbInteger    bool     // Send the PFLAA climb rate in whole m/s, without a decimal.
+	FLARMClimbNoLeadZero bool     // Send PFLAA climb rates between -1 and 1 without the leading zero, e.g. ".5" and "-.5".
+	FLARMGliderPriority  bool     // At equal alarm level, the PFLAU alarm goes to a glider / FLARM target before ADS-B traffic.
+	FLARMStallTimeout    int      // Seconds a TCP client's queue may stay full without progress before it is disconnected. 0 = never.
+	FLARMPlainPFLAAPort  int      // TCP port serving the FLARM NMEA stream with plain PFLAA IDs, whatever the profile. 0 = off. Applied at startup.
+	FLARMExtPFLAAPort    int      // TCP port serving the FLARM NMEA stream with "!CALLSIGN" PFLAA IDs, whatever the profile. 0 = off. Applied at startup.
+	FLARMWholeSeconds    bool     // GPRMC/GPGGA time as hhmmss, without the hundredths of a second.
+	FLARMTrafficSentence bool     // Send the proprietary $PSTXT sentence with traffic counts by source and PFLAA sent/filtered, every cycle.
+	FLARMMaxOwnSpeed     int      // A GPS fix implying a higher ownship speed (knots) since the last accepted one is treated as no fix. 0 = default (1000).
+	FLARMPFLAUFullID     bool     // PFLAU <ID> exactly as in the target's PFLAA, with the "!CALLSIGN" suffix of the extended profile.
+	FLARMMinBearingDist  int      // Meters; a closer PFLAU alarm is sent with an empty relative bearing, as position noise makes it meaningless. 0 = off.
+	FLARMClearSentence   bool     // Send the proprietary $PSTXC sentence when the traffic alarm has cleared.
+	FLARMMaxFixAge       int      // Milliseconds; no traffic is sent while the own GPS fix is older. 0 = default (2000).
+	FLARMUDPBatch        bool     // Pack each cycle's UDP FLARM output into as few datagrams as fit (1400 bytes), not one per sentence.
+	FLARMNoHandshake     bool     // Skip the AIR Connect "PASS?" / "AOK" handshake: TCP clients get NMEA right away.
+	FLARMPFLAUMaxDist    int      // Meters; cap on the PFLAU relative distance. 0 = the field's limit (32767).
+	FLARMDeviceID        string   // 6 hex digits reported as our FLARM ID to "$PFLAC,R,ID". Empty = derived from the hardware serial.
+	FLARMUDPSentences    string   // Sentence types sent over UDP, comma separated, e.g. "GPRMC,GPGGA,PFLAU,PFLAA". Empty = all.
+	FLARMUDPLineEnd      string   // "LF" ends UDP sentences with a bare line feed instead of CR/LF.
+	FLARMSerialOutput    bool     // Send the FLARM NMEA stream to the serial output instead of GDL90.
+	FLARMSerialSentences string   // Sentence types sent to the serial output, comma separated. Empty = all.
+	FLARMSerialLineEnd   string   // "LF" ends serial sentences with a bare line feed instead of CR/LF.
+	FLARMSignalSentence  bool     // Send the proprietary $PSTXS sentence with the signal level after each PFLAA.
+	FLARMDupKeepClosest  bool     // Of two aircraft sharing an ICAO address, follow the closer one rather than the one followed so far.
+	FLARMGDL90NoClimb    bool     // GDL90 bridge traffic reports without vertical speed ("no information"), for apps mis-drawing trends.
+	FLARMIdleInterval    int      // Seconds between FLARM cycles while UDP and serial output are off and no TCP client is connected. 0 = off.
+	FLARMVerticalAGL     bool     // PFLAA RelativeVertical as target height above its terrain minus ours, where terrain is known.
+	FLARMMaxBytesPerSec  int      // Cap on the FLARM NMEA stream, bytes per second; distant traffic is shed first, alarms never. 0 = off.
+	FLARMMaxRangeNM      float64  // Send only traffic within this many NM, also reported to PFLAC RANGE queries. 0 = the PFLAA limit (32767 m).
+	FLARMTestObjects     string   // Static obstacles for testing alarms, "<lat> <lng> <feet MSL>" separated by ";". Empty = none.
+	FLARMRearArc         int      // Degrees; non-alarming traffic in this arc centered behind us is left out of PFLAA. 0 = off.
+	FLARMConnectReplay   bool     // Replay the last GPRMC/GPGGA and each target's recent PFLAA to a new TCP client.
+	FLARMGGAAllSats      bool     // GPGGA reports every satellite in use, not at most 12, for apps that show the real count.
+	FLARMAlarmTieMargin  int      // Meters; the PFLAU alarm stays on its target until another at the same level is closer by more than this. 0 = default (100), negative = always the closest.
+	FLARMEmitPFLAU       bool     // Send PFLAU (alarms and status). Off = traffic list (PFLAA) only, for alarms handled by a separate FLARM. Default true.
+	FLARMPFLAUHeartbeat  bool     // With FLARMEmitPFLAU off, still send the idle "no traffic" PFLAU for EFBs that time out without one.
+	FLARMLongSentences   string   // Sentence types allowed up to 86 characters for tolerant parsers, comma separated, e.g. "PFLAA". Empty = NMEA's 82 for all.
 }
 
 type status struct {
@@ -1165,6 +1257,7 @@ type status struct {
 	CPUTemp                                    float32
 	CPUTempMin                                 float32
 	CPUTempMax                                 float32
+	SupplyVoltage                              float32 // Volts, from a power supply driver (supplyVoltageMonitor()). 0 = no sensor.
 	NetworkDataMessagesSent                    uint64
 	NetworkDataMessagesSentNonqueueable        uint64
 	NetworkDataBytesSent                       uint64
@@ -1201,6 +1294,7 @@ func defaultSettings() {
 	//FIXME: Need to change format below.
 	globalSettings.NetworkOutputs = []networkConnection{
 		{Conn: nil, Ip: "", Port: 4000, Capability: NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90},
+		{Conn: nil, Ip: "", Port: 10110, Capability: NETWORK_FLARM_NMEA},
 		//		{Conn: nil, Ip: "", Port: 49002, Capability: NETWORK_AHRS_FFSIM},
 	}
 	globalSettings.DEBUG = false
@@ -1212,6 +1306,9 @@ func defaultSettings() {
 	globalSettings.DeveloperMode = true
 	globalSettings.StaticIps = make([]string, 0)
 	globalSettings.GDL90MSLAlt_Enabled = true
+	globalSettings.NetworkFLARM = false
+	globalSettings.FLARMOutputProfile = FLARM_PROFILE_FLARM
+	globalSettings.FLARMEmitPFLAU = true
 }
 
 func readSettings() {
@@ -1230,6 +1327,7 @@ func readSettings() {
 		return
 	}
 	var newSettings settings
+	newSettings.FLARMEmitPFLAU = true // default for settings files from before the option existed
 	err = json.Unmarshal(buf[0:count], &newSettings)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
@@ -1469,6 +1567,9 @@ func gracefulShutdown() {
 	sdrKill()
 	pingKill()
 
+	// Disconnect FLARM NMEA TCP clients.
+	tcpNMEAShutdown()
+
 	// Shut down data logging.
 	if dataLogStarted {
 		closeDataLog()
@@ -1664,6 +1765,10 @@ func main() {
 	// Initialize the (out) network handler.
 	initNetwork()
 
+	// Start the FLARM NMEA TCP server (AIR Connect compatible).
+	go tcpNMEAListener()
+	go flarmFixedRateSender()
+
 	// Start printing stats periodically to the logfiles.
 	go printStats()
 
@@ -1680,6 +1785,11 @@ func main() {
 		}
 	})
 
+	// Monitor the supply voltage, where a power supply driver reports it.
+	go supplyVoltageMonitor(func(volts float32) {
+		globalStatus.SupplyVoltage = volts
+	})
+
 	// Start reading from serial UAT radio.
 	initUATRadioSerial()
 
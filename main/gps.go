@@ -57,12 +57,15 @@ type SituationData struct {
 	GPSLatitude                 float32
 	GPSLongitude                float32
 	GPSFixQuality               uint8
+	GPSFix2D                    bool    // receiver reports a 2D solution (no usable altitude)
 	GPSHeightAboveEllipsoid     float32 // GPS height above WGS84 ellipsoid, ft. This is specified by the GDL90 protocol, but most EFBs use MSL altitude instead. HAE is about 70-100 ft below GPS MSL altitude over most of the US.
 	GPSGeoidSep                 float32 // geoid separation, ft, MSL minus HAE (used in altitude calculation)
 	GPSSatellites               uint16  // satellites used in solution
 	GPSSatellitesTracked        uint16  // satellites tracked (almanac data received)
 	GPSSatellitesSeen           uint16  // satellites seen (signal received)
 	GPSHorizontalAccuracy       float32 // 95% confidence for horizontal position, meters.
+	GPSHDOP                     float32 // horizontal dilution of precision as reported by the receiver. 0 = not reported.
+	GPSVDOP                     float32 // vertical dilution of precision as reported by the receiver. 0 = not reported.
 	GPSNACp                     uint8   // NACp categories are defined in AC 20-165A
 	GPSAltitudeMSL              float32 // Feet MSL
 	GPSVerticalAccuracy         float32 // 95% confidence for vertical position, meters
@@ -923,6 +926,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			// Do the accuracy / quality fields first to prevent invalid position etc. from being sent downstream
 			// field 8 = nav status
 			// DR = dead reckoning, G2= 2D GPS, G3 = 3D GPS, D2= 2D diff, D3 = 3D diff, RK = GPS+DR, TT = time only
+			tmpSituation.GPSFix2D = (x[8] == "G2" || x[8] == "D2")
 			if x[8] == "D2" || x[8] == "D3" {
 				tmpSituation.GPSFixQuality = 2
 			} else if x[8] == "G2" || x[8] == "G3" {
@@ -1062,6 +1066,14 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 			// field 14 = age of diff corrections
 
+			// field 15 = HDOP, field 16 = VDOP
+			if hdop, err := strconv.ParseFloat(x[15], 32); err == nil {
+				tmpSituation.GPSHDOP = float32(hdop)
+			}
+			if vdop, err := strconv.ParseFloat(x[16], 32); err == nil {
+				tmpSituation.GPSVDOP = float32(vdop)
+			}
+
 			// field 18 = number of satellites
 			sat, err1 := strconv.Atoi(x[18])
 			if err1 != nil {
@@ -1329,6 +1341,11 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		}
 		tmpSituation.GPSFixQuality = uint8(q) // 1 = 3D GPS; 2 = DGPS (SBAS /WAAS)
 
+		// HDOP. Optional; some receivers leave it empty.
+		if hdop, err := strconv.ParseFloat(x[8], 32); err == nil {
+			tmpSituation.GPSHDOP = float32(hdop)
+		}
+
 		// Timestamp.
 		if len(x[1]) < 7 {
 			return false
@@ -1594,6 +1611,8 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			return false
 		}
 
+		tmpSituation.GPSFix2D = (x[2] == "2")
+
 		// fields 3-14: satellites in solution
 		var svStr string
 		var svType uint8
@@ -1667,6 +1686,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if err1 != nil {
 			return false
 		}
+		tmpSituation.GPSHDOP = float32(hdop)
 		if tmpSituation.GPSFixQuality == 2 {
 			tmpSituation.GPSHorizontalAccuracy = float32(hdop * 4.0) // Rough 95% confidence estimate for WAAS / DGPS solution
 		} else {
@@ -1682,6 +1702,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if err1 != nil {
 			return false
 		}
+		tmpSituation.GPSVDOP = float32(vdop)
 		tmpSituation.GPSVerticalAccuracy = float32(vdop * 5) // rough estimate for 95% confidence
 
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
@@ -2101,6 +2122,8 @@ func isGPSValid() bool {
 		mySituation.GPSHorizontalAccuracy = 999999
 		mySituation.GPSVerticalAccuracy = 999999
 		mySituation.GPSNACp = 0
+		mySituation.GPSHDOP = 0
+		mySituation.GPSVDOP = 0
 	}
 	return isValid
 }
@@ -2125,6 +2148,16 @@ func isAHRSValid() bool {
 	return (globalSettings.DeveloperMode || isGPSValid()) && stratuxClock.Since(mySituation.AHRSLastAttitudeTime) < 1*time.Second
 }
 
+/*
+isGPSFix2D returns true if the current fix has no usable altitude: either the receiver reports a 2D solution,
+or fewer than four satellites are in the solution. It is evaluated on every call, so a 2D->3D transition is
+picked up with the next sentence.
+*/
+
+func isGPSFix2D() bool {
+	return mySituation.GPSFix2D || (mySituation.GPSSatellites > 0 && mySituation.GPSSatellites < 4)
+}
+
 func isTempPressValid() bool {
 	return stratuxClock.Since(mySituation.BaroLastMeasurementTime) < 15*time.Second
 }
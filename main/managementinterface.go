@@ -24,6 +24,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
@@ -205,6 +206,14 @@ func handleSituationRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", situationJSON)
 }
 
+// AJAX call - /getFLARMStatus. Responds with the health of the FLARM NMEA output.
+func handleFLARMStatusRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, _ := json.Marshal(flarmStatus())
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
 // AJAX call - /getTowers. Responds with all ADS-B ground towers that have sent messages that we were able to parse, along with its stats.
 func handleTowersRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
@@ -243,6 +252,21 @@ func handleSettingsGetRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", settingsJSON)
 }
 
+// parseICAOList parses a space-separated list of hex ICAO addresses, e.g. "A1B2C3 3C4B3A".
+func parseICAOList(codesStr string) ([]uint32, string) {
+	codes := make([]uint32, 0)
+	err := ""
+	for _, c := range strings.Fields(codesStr) {
+		code, cerr := strconv.ParseUint(c, 16, 24)
+		if cerr != nil {
+			err = err + "Invalid ICAO address: " + c + ". "
+			continue
+		}
+		codes = append(codes, uint32(code))
+	}
+	return codes, err
+}
+
 // AJAX call - /setSettings. receives via POST command, any/all stratux.conf data.
 func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 	// define header in support of cross-domain AJAX
@@ -382,6 +406,214 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						resetWiFi = true
 					case "GDL90MSLAlt_Enabled":
 						globalSettings.GDL90MSLAlt_Enabled = val.(bool)
+					case "NetworkFLARM":
+						globalSettings.NetworkFLARM = val.(bool)
+					case "FLARMStatusSentence":
+						globalSettings.FLARMStatusSentence = val.(bool)
+					case "FLARMMaxTargets":
+						globalSettings.FLARMMaxTargets = int(val.(float64))
+					case "FLARMOutputProfile":
+						globalSettings.FLARMOutputProfile = val.(string)
+					case "FLARMLatLngPrecision":
+						globalSettings.FLARMLatLngPrecision = int(val.(float64))
+					case "FLARMOwnshipTail":
+						globalSettings.FLARMOwnshipTail = val.(string)
+					case "FLARMModeCBand":
+						globalSettings.FLARMModeCBand = int(val.(float64))
+					case "FLARMSkipIdle":
+						globalSettings.FLARMSkipIdle = val.(bool)
+					case "FLARMClimbSmoothing":
+						globalSettings.FLARMClimbSmoothing = int(val.(float64))
+					case "FLARMGPSOnly":
+						globalSettings.FLARMGPSOnly = val.(bool)
+					case "FLARMGPSOnlyPFLAU":
+						globalSettings.FLARMGPSOnlyPFLAU = val.(bool)
+					case "FLARMReadClientNMEA":
+						globalSettings.FLARMReadClientNMEA = val.(bool)
+					case "FLARMTCPPorts":
+						portsStr := strings.TrimSpace(val.(string))
+						ports := make([]int, 0)
+						err := ""
+						if portsStr != "" {
+							for _, p := range strings.Fields(portsStr) {
+								port, perr := strconv.Atoi(p)
+								if perr != nil || port < 1 || port > 65535 {
+									err = err + "Invalid port: " + p + ". "
+									continue
+								}
+								ports = append(ports, port)
+							}
+						}
+						if err != "" {
+							log.Printf("handleSettingsSetRequest:FLARMTCPPorts: %s\n", err)
+							continue
+						}
+						globalSettings.FLARMTCPPorts = ports
+					case "FLARMAirborneOnly":
+						globalSettings.FLARMAirborneOnly = val.(bool)
+					case "FLARMInvertClimb":
+						globalSettings.FLARMInvertClimb = val.(bool)
+					case "FLARMDeadReckoning":
+						globalSettings.FLARMDeadReckoning = val.(bool)
+					case "FLARMMaxGroundSpeed":
+						globalSettings.FLARMMaxGroundSpeed = int(val.(float64))
+					case "FLARMPositionStep":
+						globalSettings.FLARMPositionStep = int(val.(float64))
+					case "FLARMConvergingAlarm":
+						globalSettings.FLARMConvergingAlarm = val.(bool)
+					case "FLARMAlarmConfirm":
+						globalSettings.FLARMAlarmConfirm = val.(bool)
+					case "FLARMNMEA41":
+						globalSettings.FLARMNMEA41 = val.(bool)
+					case "FLARMSkipDuplicates":
+						globalSettings.FLARMSkipDuplicates = val.(bool)
+					case "FLARMLowVoltage":
+						globalSettings.FLARMLowVoltage = val.(float64)
+					case "FLARMMagneticBearing":
+						globalSettings.FLARMMagneticBearing = val.(bool)
+					case "FLARMDeclination":
+						globalSettings.FLARMDeclination = val.(float64)
+					case "FLARMStationarySpeed":
+						globalSettings.FLARMStationarySpeed = int(val.(float64))
+					case "FLARMFixedInterval":
+						globalSettings.FLARMFixedInterval = int(val.(float64))
+					case "FLARMICAOAllowlist":
+						codes, err := parseICAOList(val.(string))
+						if err != "" {
+							log.Printf("handleSettingsSetRequest:FLARMICAOAllowlist: %s\n", err)
+							continue
+						}
+						globalSettings.FLARMICAOAllowlist = codes
+					case "FLARMTowPlanes":
+						codes, err := parseICAOList(val.(string))
+						if err != "" {
+							log.Printf("handleSettingsSetRequest:FLARMTowPlanes: %s\n", err)
+							continue
+						}
+						globalSettings.FLARMTowPlanes = codes
+					case "FLARMDropPlanes":
+						codes, err := parseICAOList(val.(string))
+						if err != "" {
+							log.Printf("handleSettingsSetRequest:FLARMDropPlanes: %s\n", err)
+							continue
+						}
+						globalSettings.FLARMDropPlanes = codes
+					case "FLARMGeoidCorrection":
+						globalSettings.FLARMGeoidCorrection = val.(bool)
+					case "FLARMLowercaseID":
+						globalSettings.FLARMLowercaseID = val.(bool)
+					case "FLARMQNH":
+						globalSettings.FLARMQNH = val.(float64)
+					case "FLARMOverheadSep":
+						globalSettings.FLARMOverheadSep = int(val.(float64))
+					case "FLARMSimGPS":
+						sim := strings.TrimSpace(val.(string))
+						if sim != "" {
+							if _, err := parseFlarmSimGPS(sim); err != nil {
+								log.Printf("handleSettingsSetRequest:FLARMSimGPS: %s\n", err)
+								continue
+							}
+						}
+						globalSettings.FLARMSimGPS = sim
+					case "FLARMRingHysteresis":
+						globalSettings.FLARMRingHysteresis = int(val.(float64))
+					case "FLARMPFLAUInterval":
+						globalSettings.FLARMPFLAUInterval = int(val.(float64))
+					case "FLARMConnectPosition":
+						globalSettings.FLARMConnectPosition = val.(bool)
+					case "FLARMClimbDeadband":
+						globalSettings.FLARMClimbDeadband = val.(float64)
+					case "FLARMGDL90Port":
+						globalSettings.FLARMGDL90Port = int(val.(float64))
+					case "FLARMClimbInteger":
+						globalSettings.FLARMClimbInteger = val.(bool)
+					case "FLARMClimbNoLeadZero":
+						globalSettings.FLARMClimbNoLeadZero = val.(bool)
+					case "FLARMGliderPriority":
+						globalSettings.FLARMGliderPriority = val.(bool)
+					case "FLARMStallTimeout":
+						globalSettings.FLARMStallTimeout = int(val.(float64))
+					case "FLARMPlainPFLAAPort":
+						globalSettings.FLARMPlainPFLAAPort = int(val.(float64))
+					case "FLARMExtPFLAAPort":
+						globalSettings.FLARMExtPFLAAPort = int(val.(float64))
+					case "FLARMWholeSeconds":
+						globalSettings.FLARMWholeSeconds = val.(bool)
+					case "FLARMTrafficSentence":
+						globalSettings.FLARMTrafficSentence = val.(bool)
+					case "FLARMMaxOwnSpeed":
+						globalSettings.FLARMMaxOwnSpeed = int(val.(float64))
+					case "FLARMPFLAUFullID":
+						globalSettings.FLARMPFLAUFullID = val.(bool)
+					case "FLARMMinBearingDist":
+						globalSettings.FLARMMinBearingDist = int(val.(float64))
+					case "FLARMClearSentence":
+						globalSettings.FLARMClearSentence = val.(bool)
+					case "FLARMMaxFixAge":
+						globalSettings.FLARMMaxFixAge = int(val.(float64))
+					case "FLARMUDPBatch":
+						globalSettings.FLARMUDPBatch = val.(bool)
+					case "FLARMNoHandshake":
+						globalSettings.FLARMNoHandshake = val.(bool)
+					case "FLARMPFLAUMaxDist":
+						globalSettings.FLARMPFLAUMaxDist = int(val.(float64))
+					case "FLARMDeviceID":
+						id := strings.ToUpper(strings.TrimSpace(val.(string)))
+						if _, err := strconv.ParseUint(id, 16, 24); id != "" && err != nil {
+							log.Printf("handleSettingsSetRequest:FLARMDeviceID: %s\n", err.Error())
+							continue
+						}
+						globalSettings.FLARMDeviceID = id
+					case "FLARMUDPSentences":
+						globalSettings.FLARMUDPSentences = val.(string)
+					case "FLARMUDPLineEnd":
+						globalSettings.FLARMUDPLineEnd = val.(string)
+					case "FLARMSerialOutput":
+						globalSettings.FLARMSerialOutput = val.(bool)
+					case "FLARMSerialSentences":
+						globalSettings.FLARMSerialSentences = val.(string)
+					case "FLARMSerialLineEnd":
+						globalSettings.FLARMSerialLineEnd = val.(string)
+					case "FLARMSignalSentence":
+						globalSettings.FLARMSignalSentence = val.(bool)
+					case "FLARMDupKeepClosest":
+						globalSettings.FLARMDupKeepClosest = val.(bool)
+					case "FLARMGDL90NoClimb":
+						globalSettings.FLARMGDL90NoClimb = val.(bool)
+					case "FLARMIdleInterval":
+						globalSettings.FLARMIdleInterval = int(val.(float64))
+					case "FLARMVerticalAGL":
+						globalSettings.FLARMVerticalAGL = val.(bool)
+					case "FLARMMaxBytesPerSec":
+						globalSettings.FLARMMaxBytesPerSec = int(val.(float64))
+					case "FLARMMaxRangeNM":
+						globalSettings.FLARMMaxRangeNM = val.(float64)
+					case "FLARMTestObjects":
+						objects := strings.TrimSpace(val.(string))
+						if _, err := parseFlarmTestObjects(objects); err != nil {
+							log.Printf("handleSettingsSetRequest:FLARMTestObjects: %s\n", err)
+							continue
+						}
+						globalSettings.FLARMTestObjects = objects
+					case "FLARMRearArc":
+						globalSettings.FLARMRearArc = int(val.(float64))
+					case "FLARMConnectReplay":
+						globalSettings.FLARMConnectReplay = val.(bool)
+					case "FLARMGGAAllSats":
+						globalSettings.FLARMGGAAllSats = val.(bool)
+					case "FLARMAlarmTieMargin":
+						globalSettings.FLARMAlarmTieMargin = int(val.(float64))
+					case "FLARMEmitPFLAU":
+						globalSettings.FLARMEmitPFLAU = val.(bool)
+					case "FLARMPFLAUHeartbeat":
+						globalSettings.FLARMPFLAUHeartbeat = val.(bool)
+					case "FLARMLongSentences":
+						globalSettings.FLARMLongSentences = val.(string)
+					case "FLARMAlarmsDisabled":
+						globalSettings.FLARMAlarmsDisabled = val.(bool)
+						if globalSettings.FLARMAlarmsDisabled {
+							log.Printf("FLARM traffic alarms disabled.\n")
+						}
 					default:
 						log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
 					}
@@ -841,6 +1073,7 @@ func managementInterface() {
 	http.HandleFunc("/getStatus", handleStatusRequest)
 	http.HandleFunc("/getSituation", handleSituationRequest)
 	http.HandleFunc("/getTowers", handleTowersRequest)
+	http.HandleFunc("/getFLARMStatus", handleFLARMStatusRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
 	http.HandleFunc("/setSettings", handleSettingsSetRequest)
@@ -69,6 +69,8 @@ const (
 	NETWORK_GDL90_STANDARD = 1
 	NETWORK_AHRS_FFSIM     = 2
 	NETWORK_AHRS_GDL90     = 4
+	NETWORK_FLARM_NMEA     = 8
+	NETWORK_FLARM_SERIAL   = 16 // FLARM NMEA for the serial output; no UDP client has this capability
 	dhcp_lease_file        = "/var/lib/dhcp/dhcpd.leases"
 	dhcp_lease_dir         = "/var/lib/dhcp"
 	extra_hosts_file       = "/etc/stratux-static-hosts.conf"
@@ -169,10 +171,17 @@ func isThrottled(k string) bool {
 
 func sendToAllConnectedClients(msg networkMessage) {
 	if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
-		// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen).
-		serialOutputChan <- msg.msg
+		// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen),
+		// unless the serial output carries FLARM NMEA instead.
+		if !globalSettings.FLARMSerialOutput {
+			serialOutputChan <- msg.msg
+		}
 		networkGDL90Chan <- msg.msg
 	}
+	if (msg.msgType & NETWORK_FLARM_SERIAL) != 0 {
+		serialOutputChan <- msg.msg
+		return
+	}
 
 	netMutex.Lock()
 	defer netMutex.Unlock()
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Power supply drivers (UPS HATs, battery gauges) report the voltage here, in microvolts.
+const supplyVoltagePattern = "/sys/class/power_supply/*/voltage_now"
+
+type SupplyVoltageUpdateFunc func(volts float32)
+
+/* supplyVoltageMonitor() reads the supply voltage every second from the
+first power supply driver that reports one and calls a callback. A Pi
+without such a driver never calls back, so SupplyVoltage stays 0 (no
+sensor).  */
+
+func supplyVoltageMonitor(updater SupplyVoltageUpdateFunc) {
+	timer := time.NewTicker(1 * time.Second)
+	for {
+		if volts, ok := readSupplyVoltage(supplyVoltagePattern); ok {
+			updater(volts)
+		}
+		<-timer.C
+	}
+}
+
+// readSupplyVoltage returns the first positive voltage found in the files matching pattern, in volts.
+func readSupplyVoltage(pattern string) (float32, bool) {
+	paths, _ := filepath.Glob(pattern)
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		microvolts, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || microvolts <= 0 {
+			continue
+		}
+		return float32(microvolts) / 1e6, true
+	}
+	return 0, false
+}
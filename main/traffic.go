@@ -75,6 +75,15 @@ const (
 	TARGET_TYPE_TISB   = 4
 )
 
+// What TrafficInfo.Track holds. The headings are numbered like the UAT / GDL90 "tt" field; a true track is 0, the zero
+// value, so sources that don't say report one (UAT numbers it 1). UAT's "not available" (0) is TRACK_TYPE_NONE.
+const (
+	TRACK_TYPE_TRUE_TRACK   = 0
+	TRACK_TYPE_MAG_HEADING  = 2
+	TRACK_TYPE_TRUE_HEADING = 3
+	TRACK_TYPE_NONE         = 4
+)
+
 type TrafficInfo struct {
 	Icao_addr           uint32
 	Reg                 string    // Registration. Calculated from Icao_addr for civil aircraft of US registry.
@@ -82,21 +91,24 @@ type TrafficInfo struct {
 	Emitter_category    uint8     // Formatted using GDL90 standard, e.g. in a Mode ES report, A7 becomes 0x07, B0 becomes 0x08, etc.
 	OnGround            bool      // Air-ground status. On-ground is "true".
 	Addr_type           uint8     // UAT address qualifier. Used by GDL90 format, so translations for ES TIS-B/ADS-R are needed.
+	FlarmIDType         uint8     // PFLAA IDType of a FLARM / OGN address: 0 random, 1 ICAO, 2 FLARM, 3 anonymous. Only for Last_source FLARM.
 	TargetType          uint8     // types decribed in const above
 	SignalLevel         float64   // Signal level, dB RSSI.
 	Squawk              int       // Squawk code
 	Position_valid      bool      //TODO: set when position report received. Unset after n seconds?
 	Lat                 float32   // decimal degrees, north positive
 	Lng                 float32   // decimal degrees, east positive
-	Alt                 int32     // Pressure altitude, feet
+	Datum               string    // Datum the source tagged Lat/Lng with. Empty = WGS84, which all position math assumes.
+	Alt                 int32     // Pressure altitude, feet. Always feet: a source reporting meters is converted on receipt.
 	GnssDiffFromBaroAlt int32     // GNSS altitude above WGS84 datum. Reported in TC 20-22 messages
 	AltIsGNSS           bool      // Pressure alt = 0; GNSS alt = 1
 	NIC                 int       // Navigation Integrity Category.
 	NACp                int       // Navigation Accuracy Category for Position.
 	Track               uint16    // degrees true
+	TrackType           uint8     // TRACK_TYPE_*: Track is the true ground track (usually), or a heading
 	Speed               uint16    // knots
 	Speed_valid         bool      // set when speed report received.
-	Vvel                int16     // feet per minute
+	Vvel                int16     // feet per minute, or VVEL_UNAVAILABLE
 	Timestamp           time.Time // timestamp of traffic message, UTC
 	PriorityStatus      uint8     // Emergency or priority code as defined in GDL90 spec, DO-260B (Type 28 msg) and DO-282B
 
@@ -115,6 +127,7 @@ type TrafficInfo struct {
 	BearingDist_valid    bool      // set when bearing and distance information is valid
 	Bearing              float64   // Bearing in degrees true to traffic from ownship, if it can be calculated. Units: degrees.
 	Distance             float64   // Distance to traffic from ownship, if it can be calculated. Units: meters.
+	RelativeOnly         bool      // Set by a source that reports bearing and distance from ownship instead of a position; they aren't recomputed.
 	//FIXME: Rename variables for consistency, especially "Last_".
 }
 
@@ -132,9 +145,11 @@ type dump1090Data struct {
 	OnGround            *bool
 	Lat                 *float32
 	Lng                 *float32
+	Datum               string // Datum of Lat/Lng, from a feed that tags it. Empty = WGS84.
 	Position_valid      bool
 	NACp                *int
 	Alt                 *int
+	AltIsMeters         bool   // Alt is in meters. dump1090 reports feet; other feeds may not.
 	AltIsGNSS           bool   //
 	GnssDiffFromBaroAlt *int16 // GNSS height above baro altitude in feet; valid range is -3125 to 3125. +/- 3138 indicates larger difference.
 	Vvel                *int16
@@ -155,6 +170,8 @@ var seenTraffic map[uint32]bool // Historical list of all ICAO addresses seen.
 
 var OwnshipTrafficInfo TrafficInfo
 
+const VVEL_UNAVAILABLE = math.MinInt16 // TrafficInfo.Vvel: the source reported no vertical speed
+
 func convertFeetToMeters(feet float32) float32 {
 	return feet * 0.3048
 }
@@ -163,6 +180,24 @@ func convertMetersToFeet(meters float32) float32 {
 	return meters / 0.3048
 }
 
+// isWGS84Datum reports a position datum tag that means WGS84. Untagged positions are WGS84.
+func isWGS84Datum(datum string) bool {
+	switch strings.ToUpper(strings.TrimSpace(datum)) {
+	case "", "WGS84", "WGS-84", "WGS 84", "W84":
+		return true
+	}
+	return false
+}
+
+// dump1090Altitude returns the message's altitude in feet, the unit of TrafficInfo.Alt, whatever the source reports.
+// The unit is read from every message, so a feed switching units mid-stream is right from its next message on.
+func dump1090Altitude(newTi *dump1090Data) int32 {
+	if newTi.AltIsMeters {
+		return int32(math.Floor(float64(convertMetersToFeet(float32(*newTi.Alt))) + 0.5))
+	}
+	return int32(*newTi.Alt)
+}
+
 func cleanupOldEntries() {
 	for icao_addr, ti := range traffic {
 		if stratuxClock.Since(ti.Last_seen) > 60*time.Second { // keep it in the database for up to 60 seconds, so we don't lose tail number, etc...
@@ -194,8 +229,11 @@ func sendTrafficUpdates() {
 		log.Printf("==================================================================\n")
 	}
 	code, _ := strconv.ParseInt(globalSettings.OwnshipModeS, 16, 32)
+	flarmTargets := make([]TrafficInfo, 0)
 	for icao, ti := range traffic { // ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Practical limit likely around ~500 aircraft without filtering.
-		if isGPSValid() {
+		if ti.RelativeOnly {
+			// Bearing and distance came from the source; there is no position to compute them from.
+		} else if isGPSValid() {
 			// func distRect(lat1, lon1, lat2, lon2 float64) (dist, bearing, distN, distE float64) {
 			dist, bearing := distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
 			ti.Distance = dist
@@ -220,6 +258,9 @@ func sendTrafficUpdates() {
 			// end of debug block
 		}
 		traffic[icao] = ti // write the updated ti back to the map
+		if ti.Icao_addr != uint32(code) && isFlarmFresh(ti) {
+			flarmTargets = append(flarmTargets, ti)
+		}
 		//log.Printf("Traffic age of %X is %f seconds\n",icao,ti.Age)
 		if ti.Age > 2 { // if nothing polls an inactive ti, it won't push to the webUI, and its Age won't update.
 			trafficUpdate.SendJSON(ti)
@@ -252,6 +293,10 @@ func sendTrafficUpdates() {
 			sendGDL90(msg, false)
 		}
 	}
+
+	if globalSettings.FLARMFixedInterval <= 0 { // otherwise flarmFixedRateSender() emits the FLARM output
+		sendFlarmTrafficUpdates(flarmTargets)
+	}
 }
 
 // Send update to attached JSON client.
@@ -281,6 +326,11 @@ func isTrafficAlertable(ti TrafficInfo) bool {
 }
 
 func makeTrafficReportMsg(ti TrafficInfo) []byte {
+	return makeTrafficReport(ti, isTrafficAlertable(ti))
+}
+
+// makeTrafficReport builds the traffic report with the alert bit given by the caller, e.g. from a FLARM alarm level.
+func makeTrafficReport(ti TrafficInfo, alert bool) []byte {
 	msg := make([]byte, 28)
 	// See p.16.
 	msg[0] = 0x14 // Message type "Traffic Report".
@@ -289,7 +339,7 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 	msg[1] = ti.Addr_type
 
 	// Set alert if needed
-	if isTrafficAlertable(ti) {
+	if alert {
 		// Set the alert bit.  See pg. 18 of GDL90 ICD
 		msg[1] |= 0x10
 	}
@@ -376,6 +426,9 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 
 	// Vertical velocity.
 	vvel := ti.Vvel / 64 // 64fpm resolution.
+	if ti.Vvel == VVEL_UNAVAILABLE {
+		vvel = 0x800 // no vertical rate information
+	}
 	msg[15] = msg[15] | byte((vvel&0x0F00)>>8)
 	msg[16] = byte(vvel & 0x00FF)
 
@@ -639,6 +692,7 @@ func parseDownlinkReport(s string, signalLevel int) {
 	ns_vel := int32(0) // int16 won't work. Worst case (supersonic), we need 26 bits (25 bits + sign) for root sum of squares speed calculation
 	ew_vel := int32(0)
 	track := uint16(0)
+	trackType := uint8(TRACK_TYPE_TRUE_TRACK)
 	speed_valid := false
 	speed := uint16(0)
 	vvel := int16(0)
@@ -698,8 +752,13 @@ func parseDownlinkReport(s string, signalLevel int) {
 		}
 
 		raw_track := ((uint16(frame[13]) & 0x03) << 9) | (uint16(frame[14]) << 1) | ((uint16(frame[15]) & 0x80) >> 7)
-		//tt := ((raw_track & 0x0600) >> 9)
-		//FIXME: tt == 1 TT_TRACK. tt == 2 TT_MAG_HEADING. tt == 3 TT_TRUE_HEADING.
+		// tt == 0 not available. tt == 1 TT_TRACK. tt == 2 TT_MAG_HEADING. tt == 3 TT_TRUE_HEADING.
+		switch tt := uint8((raw_track & 0x0600) >> 9); tt {
+		case 0:
+			trackType = TRACK_TYPE_NONE
+		case TRACK_TYPE_MAG_HEADING, TRACK_TYPE_TRUE_HEADING:
+			trackType = tt
+		}
 		track = uint16((raw_track & 0x1ff) * 360 / 512)
 
 		// Dimensions of vehicle - skip.
@@ -726,6 +785,7 @@ func parseDownlinkReport(s string, signalLevel int) {
 	}
 
 	ti.Track = track
+	ti.TrackType = trackType
 	ti.Speed = speed
 	ti.Vvel = vvel
 	ti.Speed_valid = speed_valid
@@ -880,7 +940,7 @@ func esListen() {
 			ti.AltIsGNSS = newTi.AltIsGNSS
 
 			if newTi.Alt != nil {
-				ti.Alt = int32(*newTi.Alt)
+				ti.Alt = dump1090Altitude(newTi)
 				ti.Last_alt = stratuxClock.Time
 			}
 
@@ -912,6 +972,7 @@ func esListen() {
 				if valid_position {
 					ti.Lat = lat
 					ti.Lng = lng
+					ti.Datum = newTi.Datum
 					if isGPSValid() {
 						ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
 						ti.BearingDist_valid = true
@@ -948,6 +1009,7 @@ func esListen() {
 
 				if valid_speed {
 					ti.Track = track
+					ti.TrackType = TRACK_TYPE_TRUE_TRACK
 					ti.Speed = speed
 					ti.Speed_valid = true
 					ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates